@@ -0,0 +1,741 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// maxBatchOps caps how many operations a single batch request may carry.
+const maxBatchOps = 500
+
+// tableRef identifies a table in the access API, either by its numeric id or
+// by its name within the token's project.
+type tableRef struct {
+	ID   int
+	Name string
+}
+
+func (t *tableRef) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &t.Name)
+	}
+	return json.Unmarshal(b, &t.ID)
+}
+
+func (t tableRef) isZero() bool {
+	return t.ID == 0 && t.Name == ""
+}
+
+// accessOp is a single operation on a variable, sent either on its own or as
+// one entry of a batch.
+type accessOp struct {
+	Action  string   `json:"action"`
+	Table   tableRef `json:"table"`
+	VarName string   `json:"variable"`
+	Value   any      `json:"value,omitempty"`
+
+	// json, list and map only, a JSON pointer into the value for get, set,
+	// cas, append and remove
+	Path string `json:"path,omitempty"`
+
+	// incr/decr only
+	Delta *float64 `json:"delta,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Clamp bool     `json:"clamp,omitempty"`
+
+	// set/cas only, the write is rejected unless the stored revision matches
+	ExpectedRevision *int `json:"expected_revision,omitempty"`
+}
+
+// accessScope is what a project token grants access to. The project's own
+// token grants everything; named tokens may be read-only or limited to some
+// tables.
+type accessScope struct {
+	ProjectID int
+	UserID    int
+
+	TokenName string
+	ReadOnly  bool
+	Tables    []int // nil allows every table
+
+	// Sunset is set when the project token was rotated and the old one is
+	// used during its grace period; it's when the old token stops working.
+	Sunset int64
+	// ExpiresAt is when the token stops working, 0 if it doesn't expire.
+	ExpiresAt int64
+}
+
+// authenticateToken returns the scope granted by a project token, either
+// the project's own token or a named one. Unknown and expired tokens give
+// ErrNotFound.
+func authenticateToken(store Store, token string) (accessScope, error) {
+	if token == "" {
+		return accessScope{}, ErrNotFound
+	}
+	projectID, userID, sunset, err := store.GetProjectByToken(token)
+	if err == nil {
+		return accessScope{ProjectID: projectID, UserID: userID, Sunset: sunset, ExpiresAt: sunset}, nil
+	} else if err != ErrNotFound {
+		return accessScope{}, err
+	}
+
+	t, userID, err := store.GetProjectTokenByValue(token)
+	if err != nil {
+		return accessScope{}, err
+	}
+	scope := accessScope{
+		ProjectID: t.ProjectID,
+		UserID:    userID,
+		TokenName: t.Name,
+		ReadOnly:  t.ReadOnly,
+		Tables:    t.Tables,
+	}
+	if t.ExpiresAt != nil {
+		scope.ExpiresAt = *t.ExpiresAt
+	}
+	return scope, nil
+}
+
+// tokenRecheck is how often sockets and streams check that the token they
+// were opened with still works.
+const tokenRecheck = 30 * time.Second
+
+// stillValid reports whether token still grants access to the scope's
+// project. Errors other than the token being unknown don't end access.
+func (s *accessScope) stillValid(store Store, token string) bool {
+	scope, err := authenticateToken(store, token)
+	if err == ErrNotFound || (err == nil && scope.ProjectID != s.ProjectID) {
+		return false
+	} else if err == nil {
+		s.ExpiresAt = scope.ExpiresAt
+	}
+	return true
+}
+
+// watchToken closes the returned channel once token stops working, checking
+// every tokenRecheck and when it expires, until done is closed. Revoked and
+// expired tokens, rotated project tokens past their grace period and tokens
+// of deleted users all stop working.
+func watchToken(store Store, token string, scope accessScope, done <-chan struct{}) <-chan struct{} {
+	lost := make(chan struct{})
+	go func() {
+		for {
+			wait := tokenRecheck
+			if scope.ExpiresAt != 0 {
+				wait = min(wait, time.Until(time.Unix(scope.ExpiresAt, 0)))
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if !scope.stillValid(store, token) {
+				close(lost)
+				return
+			}
+		}
+	}()
+	return lost
+}
+
+// setDeprecation tells clients still using a rotated token to switch to the
+// new one before it stops working.
+func (s accessScope) setDeprecation(h http.Header) {
+	if s.Sunset == 0 {
+		return
+	}
+	h.Set("Deprecation", "true")
+	h.Set("Sunset", time.Unix(s.Sunset, 0).UTC().Format(http.TimeFormat))
+}
+
+// actor identifies writes made through the scope in the variable history.
+func (s accessScope) actor() string {
+	if s.TokenName != "" {
+		return "token:" + s.TokenName
+	}
+	return "token"
+}
+
+// allows reports whether the scope covers tableID.
+func (s accessScope) allows(tableID int) bool {
+	return s.Tables == nil || slices.Contains(s.Tables, tableID)
+}
+
+// resolveTable returns the id of the referenced table, making sure it belongs
+// to the scope's project. Tables of other projects are reported as not found.
+func (s accessScope) resolveTable(store Store, ref tableRef) (int, error) {
+	id := ref.ID
+	if ref.Name != "" {
+		var err error
+		id, err = store.GetTableID(s.ProjectID, ref.Name, s.UserID)
+		if err == ErrNotFound {
+			return 0, &accessError{http.StatusNotFound, "table not found", nil}
+		} else if err != nil {
+			return 0, err
+		}
+	} else {
+		projectID, err := store.GetTableProjectID(ref.ID)
+		if err == ErrNotFound || (err == nil && projectID != s.ProjectID) {
+			return 0, &accessError{http.StatusNotFound, "table not found", nil}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	if !s.allows(id) {
+		return 0, &accessError{http.StatusForbidden, "token has no access to this table", nil}
+	}
+	return id, nil
+}
+
+// accessError is returned by runAccessOp, and by the transactions of the
+// variable handlers, and carries the status code the operation failed with.
+type accessError struct {
+	Code int
+	Msg  string
+	// Details are added to the error response, e.g. the current value and
+	// revision on a conflict.
+	Details map[string]any
+}
+
+func (e *accessError) Error() string {
+	return e.Msg
+}
+
+// validationFailed is the error for a value that was rejected, listing
+// every reason.
+func validationFailed(errs ValidationErrors) *accessError {
+	return &accessError{http.StatusBadRequest, errs.Error(), map[string]any{"errors": errs}}
+}
+
+// accessErrorBody maps an error from runAccessOp to a status code and
+// response body.
+func accessErrorBody(err error) (int, map[string]any) {
+	body := map[string]any{}
+	var ae *accessError
+	if !errors.As(err, &ae) {
+		body["error"] = err.Error()
+		return http.StatusInternalServerError, body
+	}
+	for k, v := range ae.Details {
+		body[k] = v
+	}
+	body["error"] = ae.Msg
+	return ae.Code, body
+}
+
+// revisionConflict builds the error for a failed compare-and-set, carrying
+// the variable's current value and revision.
+func revisionConflict(store Store, tableID int, name string) error {
+	val, typ, rev, err := store.GetVariable(tableID, name)
+	if err == ErrNotFound {
+		return &accessError{http.StatusNotFound, "variable not found", nil}
+	} else if err != nil {
+		return err
+	}
+
+	return &accessError{http.StatusConflict, "revision mismatch", map[string]any{
+		"value":    decodeValue(typ, val),
+		"type":     typ,
+		"revision": rev,
+	}}
+}
+
+// valueAtPath returns the part of a stored structured value that the JSON
+// pointer path refers to.
+func valueAtPath(typ, stored, path string) (any, error) {
+	if !isStructured(typ) {
+		return nil, &accessError{http.StatusBadRequest, "path requires a json, list or map variable", nil}
+	}
+	tokens, err := splitPointer(path)
+	if err != nil {
+		return nil, &accessError{http.StatusBadRequest, err.Error(), nil}
+	}
+	doc, err := parseJSONValue(stored)
+	if err != nil {
+		return nil, &accessError{http.StatusConflict, "stored value is not valid JSON", nil}
+	}
+	v, err := pointerGet(doc, tokens)
+	if err != nil {
+		return nil, &accessError{http.StatusNotFound, err.Error(), nil}
+	}
+	return v, nil
+}
+
+// editValue applies a set at op.Path, an append or a remove to a stored
+// structured value and returns the string to store.
+func editValue(typ, stored string, op accessOp) (string, error) {
+	if !isStructured(typ) {
+		return "", &accessError{http.StatusBadRequest, op.Action + " requires a json, list or map variable", nil}
+	}
+	tokens, err := splitPointer(op.Path)
+	if err != nil {
+		return "", &accessError{http.StatusBadRequest, err.Error(), nil}
+	}
+	doc, err := parseJSONValue(stored)
+	if err != nil {
+		return "", &accessError{http.StatusConflict, "stored value is not valid JSON", nil}
+	}
+
+	switch op.Action {
+	case "append":
+		target, err := pointerGet(doc, tokens)
+		if err != nil {
+			return "", &accessError{http.StatusNotFound, err.Error(), nil}
+		}
+		if _, ok := target.([]any); !ok {
+			return "", &accessError{http.StatusBadRequest, "path does not refer to a list", nil}
+		}
+		doc, err = pointerSet(doc, append(tokens, "-"), op.Value)
+	case "remove":
+		if len(tokens) == 0 {
+			return "", &accessError{http.StatusBadRequest, "remove requires a path", nil}
+		}
+		doc, err = pointerRemove(doc, tokens)
+	default:
+		doc, err = pointerSet(doc, tokens, op.Value)
+	}
+	if err != nil {
+		return "", &accessError{http.StatusNotFound, err.Error(), nil}
+	}
+
+	if !hasShape(typ, doc) {
+		return "", &accessError{http.StatusBadRequest, errInvalidValue.Error(), nil}
+	}
+	result, err := marshalJSONValue(doc)
+	if err != nil {
+		return "", &accessError{http.StatusBadRequest, errInvalidValue.Error(), nil}
+	}
+	return result, nil
+}
+
+// decodedVariables lists a table's variables with their values decoded the
+// same way the get action does.
+func decodedVariables(store Store, tableID, userID int) ([]map[string]any, error) {
+	variables, err := store.ListVariables(tableID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]map[string]any, 0, len(variables))
+	for _, v := range variables {
+		variable := map[string]any{
+			"name":  v.Name,
+			"type":  v.Type,
+			"value": decodeValue(v.Type, v.Value),
+		}
+		if v.Type == "enum" {
+			variable["options"] = v.Options
+		}
+		result = append(result, variable)
+	}
+	return result, nil
+}
+
+// runAccessOp executes a single get, set, cas, append, remove, incr, decr,
+// delete, list or dump within scope. Every change it makes is passed to emit.
+func runAccessOp(store Store, scope accessScope, op accessOp, emit func(VariableEvent)) (any, error) {
+	switch op.Action {
+	case "set", "cas", "append", "remove", "incr", "decr", "delete":
+		if scope.ReadOnly {
+			return nil, &accessError{http.StatusForbidden, "token is read-only", nil}
+		}
+	}
+
+	switch op.Action {
+	case "get":
+		tableID, err := scope.resolveTable(store, op.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		val, typ, rev, err := store.GetVariable(tableID, op.VarName)
+		if err == ErrNotFound {
+			return nil, &accessError{http.StatusNotFound, "variable not found", nil}
+		} else if err != nil {
+			return nil, err
+		}
+
+		value := decodeValue(typ, val)
+		if op.Path != "" {
+			if value, err = valueAtPath(typ, val, op.Path); err != nil {
+				return nil, err
+			}
+		}
+		result := map[string]any{
+			"value":    value,
+			"type":     typ,
+			"revision": rev,
+		}
+		if typ == "enum" {
+			if result["options"], _, err = store.GetVariableRules(tableID, op.VarName); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+
+	case "set", "cas", "append", "remove":
+		tableID, err := scope.resolveTable(store, op.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		// Make sure the value matches the type of the variable
+		oldVal, variableType, oldRev, err := store.GetVariable(tableID, op.VarName)
+		if err == ErrNotFound {
+			return nil, &accessError{http.StatusNotFound, "variable not found", nil}
+		} else if err != nil {
+			return nil, err
+		}
+
+		if op.ExpectedRevision == nil && op.Action == "cas" {
+			return nil, &accessError{http.StatusBadRequest, "expected_revision is required", nil}
+		}
+
+		options, constraints, err := store.GetVariableRules(tableID, op.VarName)
+		if err != nil {
+			return nil, err
+		}
+
+		var result string
+		expected := op.ExpectedRevision
+		if (op.Action == "set" || op.Action == "cas") && op.Path == "" {
+			result, err = encodeValue(variableType, options, op.Value)
+			if err == errInvalidValue {
+				return nil, validationFailed(invalidValue(variableType, options))
+			} else if err != nil {
+				return nil, &accessError{http.StatusBadRequest, err.Error(), nil}
+			}
+		} else {
+			if result, err = editValue(variableType, oldVal, op); err != nil {
+				return nil, err
+			}
+			// the edit is based on what was just read, so it must still be
+			// there when writing
+			if expected == nil {
+				expected = &oldRev
+			}
+		}
+		if err := constraints.validate(variableType, result); err != nil {
+			return nil, validationFailed(err.(ValidationErrors))
+		}
+
+		var rev int
+		if expected == nil {
+			rev, err = store.SetVariable(tableID, op.VarName, result)
+		} else {
+			rev, err = store.CompareAndSetVariable(tableID, op.VarName, result, *expected)
+			if err == ErrNotFound {
+				return nil, revisionConflict(store, tableID, op.VarName)
+			}
+		}
+		if err == errInvalidValue {
+			return nil, &accessError{http.StatusBadRequest, err.Error(), nil}
+		} else if err != nil {
+			return nil, err
+		}
+		if err := store.RecordVariableHistory(tableID, op.VarName, result, variableType, rev, scope.actor()); err != nil {
+			return nil, err
+		}
+
+		emit(VariableEvent{
+			Kind:      "set",
+			ProjectID: scope.ProjectID,
+			TableID:   tableID,
+			Name:      op.VarName,
+			Type:      variableType,
+			Value:     decodeValue(variableType, result),
+			OldValue:  decodeValue(variableType, oldVal),
+			Revision:  rev,
+		})
+		return map[string]any{"status": "ok", "revision": rev}, nil
+
+	case "incr", "decr":
+		tableID, err := scope.resolveTable(store, op.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		oldVal, typ, _, err := store.GetVariable(tableID, op.VarName)
+		if err == ErrNotFound {
+			return nil, &accessError{http.StatusNotFound, "variable not found", nil}
+		} else if err != nil {
+			return nil, err
+		}
+		if typ != "int" && typ != "float" {
+			return nil, &accessError{http.StatusBadRequest, "variable is not numeric", nil}
+		}
+
+		delta := 1.0
+		if op.Delta != nil {
+			delta = *op.Delta
+		}
+		if typ == "int" && !(isWhole(&delta) && isWhole(op.Min) && isWhole(op.Max)) {
+			return nil, &accessError{http.StatusBadRequest, "delta and bounds of an int variable must be whole numbers", nil}
+		}
+		if op.Action == "decr" {
+			delta = -delta
+		}
+
+		// the variable's own constraints narrow the bounds further
+		_, constraints, err := store.GetVariableRules(tableID, op.VarName)
+		if err != nil {
+			return nil, err
+		}
+		lower, upper := op.Min, op.Max
+		if c := constraints.Min; c != nil {
+			bound := *c
+			if typ == "int" {
+				bound = math.Ceil(bound)
+			}
+			if lower == nil || bound > *lower {
+				lower = &bound
+			}
+		}
+		if c := constraints.Max; c != nil {
+			bound := *c
+			if typ == "int" {
+				bound = math.Floor(bound)
+			}
+			if upper == nil || bound < *upper {
+				upper = &bound
+			}
+		}
+
+		val, rev, err := store.IncrementVariable(tableID, op.VarName, typ, delta, lower, upper, op.Clamp)
+		if err == ErrNotFound {
+			if lower == nil && upper == nil {
+				return nil, &accessError{http.StatusNotFound, "variable not found", nil}
+			}
+			return nil, &accessError{http.StatusConflict, "value out of bounds", nil}
+		} else if err != nil {
+			return nil, err
+		}
+		if err := store.RecordVariableHistory(tableID, op.VarName, val, typ, rev, scope.actor()); err != nil {
+			return nil, err
+		}
+
+		emit(VariableEvent{
+			Kind:      "set",
+			ProjectID: scope.ProjectID,
+			TableID:   tableID,
+			Name:      op.VarName,
+			Type:      typ,
+			Value:     decodeValue(typ, val),
+			OldValue:  decodeValue(typ, oldVal),
+			Revision:  rev,
+		})
+		return map[string]any{
+			"value":    decodeValue(typ, val),
+			"type":     typ,
+			"revision": rev,
+		}, nil
+
+	case "delete":
+		tableID, err := scope.resolveTable(store, op.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		oldVal, typ, rev, err := store.GetVariable(tableID, op.VarName)
+		if err == nil {
+			err = store.DeleteVariable(tableID, op.VarName, scope.UserID)
+		}
+		if err == ErrNotFound {
+			return nil, &accessError{http.StatusNotFound, "variable not found", nil}
+		} else if err != nil {
+			return nil, err
+		}
+
+		emit(VariableEvent{
+			Kind:      "delete",
+			ProjectID: scope.ProjectID,
+			TableID:   tableID,
+			Name:      op.VarName,
+			Type:      typ,
+			OldValue:  decodeValue(typ, oldVal),
+			Revision:  rev,
+		})
+		return map[string]string{"status": "ok"}, nil
+
+	case "list":
+		tableID, err := scope.resolveTable(store, op.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		variables, err := decodedVariables(store, tableID, scope.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"variables": variables}, nil
+
+	case "dump":
+		tables, err := store.ListTables(scope.ProjectID, scope.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]map[string]any, 0, len(tables))
+		for _, table := range tables {
+			if !scope.allows(table.ID) {
+				continue
+			}
+			variables, err := decodedVariables(store, table.ID, scope.UserID)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, map[string]any{
+				"id":        table.ID,
+				"name":      table.Name,
+				"variables": variables,
+			})
+		}
+		return map[string]any{"tables": result}, nil
+
+	default:
+		return nil, &accessError{http.StatusBadRequest, "unknown action", nil}
+	}
+}
+
+// runAccessSingle runs op in its own transaction, so that a write, its
+// history entry and its webhook deliveries land together, and publishes its
+// events once committed.
+func runAccessSingle(store Store, scope accessScope, op accessOp) (any, error) {
+	var events []VariableEvent
+	var result any
+	err := store.Tx(func(tx Store) error {
+		var err error
+		result, err = runAccessOp(tx, scope, op, func(ev VariableEvent) {
+			events = append(events, ev)
+		})
+		if err != nil {
+			return err
+		}
+		return enqueueWebhooks(tx, events...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range events {
+		hub.Publish(ev)
+	}
+	return result, nil
+}
+
+// runAccessBatch runs ops in order inside one transaction. Ops without a
+// table inherit the request's table. When atomic is set the first failing op
+// rolls back the whole batch; otherwise every op runs in a nested
+// transaction, so a failing one is undone and reported on its own while the
+// rest is committed. Webhook deliveries are stored along with each op, and
+// events are only published once the batch has committed.
+// It returns the status code and body of the response.
+func runAccessBatch(store Store, scope accessScope, table tableRef, ops []accessOp, atomic bool) (int, any) {
+	if len(ops) == 0 {
+		return http.StatusBadRequest, errorResp{"no ops given"}
+	}
+	if len(ops) > maxBatchOps {
+		return http.StatusBadRequest, errorResp{fmt.Sprintf("too many ops (max %d)", maxBatchOps)}
+	}
+
+	var events []VariableEvent
+	results := make([]any, len(ops))
+	var failedCode int
+	var failed map[string]any
+	err := store.Tx(func(tx Store) error {
+		for i, op := range ops {
+			if op.Table.isZero() {
+				op.Table = table
+			}
+
+			var result any
+			var opEvents []VariableEvent
+			run := func(tx Store) error {
+				var err error
+				result, err = runAccessOp(tx, scope, op, func(ev VariableEvent) {
+					opEvents = append(opEvents, ev)
+				})
+				if err != nil {
+					return err
+				}
+				return enqueueWebhooks(tx, opEvents...)
+			}
+			var err error
+			if atomic {
+				err = run(tx)
+			} else {
+				err = tx.Tx(run)
+			}
+			if err != nil {
+				code, body := accessErrorBody(err)
+				if atomic {
+					body["error"] = fmt.Sprintf("op %d: %s", i, body["error"])
+					body["failed_op"] = i
+					failedCode, failed = code, body
+					return err
+				}
+				body["code"] = code
+				results[i] = body
+				continue
+			}
+			results[i] = result
+			events = append(events, opEvents...)
+		}
+		return nil
+	})
+	if failed != nil {
+		return failedCode, failed
+	} else if err != nil {
+		return http.StatusInternalServerError, errorResp{err.Error()}
+	}
+	for _, ev := range events {
+		hub.Publish(ev)
+	}
+	return http.StatusOK, map[string]any{"results": results}
+}
+
+func ProjectAccess(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			accessOp
+			Token  string     `json:"token"`
+			Ops    []accessOp `json:"ops"`
+			Atomic bool       `json:"atomic"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		scope, err := authenticateToken(store, req.Token)
+		if err == ErrNotFound {
+			writeJSON(w, http.StatusUnauthorized, errorResp{"invalid project token"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		scope.setDeprecation(w.Header())
+
+		if req.Action == "batch" || (req.Action == "" && len(req.Ops) > 0) {
+			code, body := runAccessBatch(store, scope, req.Table, req.Ops, req.Atomic)
+			writeJSONVerbatim(w, code, body)
+			return
+		}
+
+		result, err := runAccessSingle(store, scope, req.accessOp)
+		if err != nil {
+			code, body := accessErrorBody(err)
+			writeJSONVerbatim(w, code, body)
+			return
+		}
+		writeJSONVerbatim(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// emailVerifyTTL is how long the link that verifies an email works.
+const emailVerifyTTL = 24 * time.Hour
+
+// accountDeleteTTL is how long a confirmation to delete an account is good
+// for.
+const accountDeleteTTL = 10 * time.Minute
+
+// purposeDeleteAccount is the purpose of account deletion confirmations.
+const purposeDeleteAccount = "delete_account"
+
+// signPurpose signs a short-lived token that lets the user do one thing,
+// such as confirm deleting their account. Having no session, it can't be
+// used as an access token.
+func (ti tokenIssuer) signPurpose(userID int, purpose string, ttl time.Duration) (string, error) {
+	_, token, err := ti.auth.Encode(map[string]any{
+		"user_id": userID,
+		"purpose": purpose,
+		"exp":     jwtauth.ExpireIn(ttl),
+	})
+	return token, err
+}
+
+// checkPurpose reports whether token is an unexpired signPurpose token of
+// the user for purpose.
+func (ti tokenIssuer) checkPurpose(token string, userID int, purpose string) bool {
+	uid, ok := ti.purposeUser(token, purpose)
+	return ok && uid == userID
+}
+
+// purposeUser returns the user of an unexpired signPurpose token for
+// purpose.
+func (ti tokenIssuer) purposeUser(token string, purpose string) (userID int, ok bool) {
+	t, err := jwtauth.VerifyToken(ti.auth, token)
+	if err != nil {
+		return 0, false
+	}
+	claims := t.PrivateClaims()
+	uid, ok := claims["user_id"].(float64)
+	return int(uid), ok && claims["purpose"] == purpose
+}
+
+// checkPassword answers 401 and returns false unless password is the user's.
+func checkPassword(w http.ResponseWriter, store Store, userID int, password string) (User, bool) {
+	user, err := store.GetUser(userID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+		return user, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		writeJSON(w, http.StatusUnauthorized, errorResp{"wrong password"})
+		return user, false
+	}
+	return user, true
+}
+
+// errNoPublicURL is returned by sendEmailVerification on servers without a
+// public URL. Links can't be made from the request's Host header, which
+// anyone can set to their own server.
+var errNoPublicURL = errors.New("email verification needs the server's public-url to be set")
+
+// sendEmailVerification gives the user's email a new verification token
+// and mails the link with it.
+func sendEmailVerification(store Store, mailer Mailer, publicURL string, userID int, email string) error {
+	if publicURL == "" {
+		return errNoPublicURL
+	}
+	token := randomToken()
+	if err := store.SetUserEmail(userID, email, token, time.Now().Add(emailVerifyTTL).Unix()); err != nil {
+		return err
+	}
+
+	link := publicURL + "/verify-email?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Open this link within %s to verify your email:\n\n%s\n", emailVerifyTTL, link)
+	return mailer.Send(email, "Verify your email", body)
+}
+
+func AccountLoad(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		user, err := store.GetUser(userID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, user)
+	}
+}
+
+// AccountPassword changes the password given the current one. Every session
+// ends, as one of them might be why the password is changed; the response
+// carries the tokens of a new one for the caller.
+func AccountPassword(store Store, tokens tokenIssuer, policy accountPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		var req struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		user, ok := checkPassword(w, store, userID, req.CurrentPassword)
+		if !ok {
+			return
+		}
+		if err := policy.checkPassword(user.Username, req.NewPassword); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+
+		var resp tokenResponse
+		err = store.Tx(func(tx Store) error {
+			if err := tx.SetUserPassword(userID, string(hash)); err != nil {
+				return err
+			}
+			if err := tx.DeleteUserSessions(userID); err != nil {
+				return err
+			}
+			resp, err = tokens.startSession(tx, userID)
+			return err
+		})
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func AccountRename(store Store, policy accountPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		var req struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		if err := policy.checkUsername(req.Username); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		if err := store.RenameUser(userID, req.Username); err == ErrExists {
+			writeJSON(w, http.StatusConflict, errorResp{"username taken"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// AccountEmail sets the user's email and mails it a verification link, or
+// removes it when empty.
+func AccountEmail(store Store, mailer Mailer, publicURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if req.Email == "" {
+			if err := store.SetUserEmail(userID, "", "", 0); err != nil {
+				writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+			return
+		}
+		if addr, err := mail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid email"})
+			return
+		}
+
+		err := sendEmailVerification(store, mailer, publicURL, userID, req.Email)
+		if err == ErrExists {
+			writeJSON(w, http.StatusConflict, errorResp{"email taken"})
+			return
+		} else if err == errNoPublicURL {
+			writeJSON(w, http.StatusServiceUnavailable, errorResp{err.Error()})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "verification sent"})
+	}
+}
+
+// AccountEmailResend mails a new verification link for an unverified email.
+func AccountEmailResend(store Store, mailer Mailer, publicURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		user, err := store.GetUser(userID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		if user.Email == "" || user.EmailVerified {
+			writeJSON(w, http.StatusConflict, errorResp{"no email to verify"})
+			return
+		}
+		if err := sendEmailVerification(store, mailer, publicURL, userID, user.Email); err == errNoPublicURL {
+			writeJSON(w, http.StatusServiceUnavailable, errorResp{err.Error()})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "verification sent"})
+	}
+}
+
+// AccountEmailVerify takes the token of a verification link. It needs no
+// login, as the link may be opened anywhere.
+func AccountEmailVerify(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		if _, err := store.VerifyUserEmail(req.Token); err == ErrNotFound {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid or expired verification link"})
+			return
+		} else if err == ErrExists {
+			writeJSON(w, http.StatusConflict, errorResp{"email taken"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// AccountDeleteRequest is the first step of deleting an account: given the
+// password, it answers with a confirmation token for AccountDelete.
+func AccountDeleteRequest(store Store, tokens tokenIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		if _, ok := checkPassword(w, store, userID, req.Password); !ok {
+			return
+		}
+		token, err := tokens.signPurpose(userID, purposeDeleteAccount, accountDeleteTTL)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"confirmation_token": token,
+			"expires_in":         int64(accountDeleteTTL / time.Second),
+		})
+	}
+}
+
+// AccountDelete deletes the account, with its projects and everything in
+// them, given a confirmation token from AccountDeleteRequest.
+func AccountDelete(store Store, tokens tokenIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		var req struct {
+			ConfirmationToken string `json:"confirmation_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		if !tokens.checkPurpose(req.ConfirmationToken, userID, purposeDeleteAccount) {
+			writeJSON(w, http.StatusForbidden, errorResp{"invalid or expired confirmation"})
+			return
+		}
+		if err := store.DeleteUser(userID); err != nil && err != ErrNotFound {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testMailer keeps the mail it is given.
+type testMailer struct {
+	sent []string
+}
+
+func (m *testMailer) Send(to, subject, body string) error {
+	m.sent = append(m.sent, body)
+	return nil
+}
+
+func TestAccount(t *testing.T) {
+	forEachStore(t, testAccount)
+}
+
+func testAccount(t *testing.T, store Store) {
+	mailer := &testMailer{}
+	cfg := DefaultConfig()
+	cfg.PublicURL = "https://reduser.example"
+	send := newTestAPI(t, store, cfg, mailer).send
+	login := func(username, password string) (int, tokenResponse) {
+		var tokens tokenResponse
+		code := send("POST", "/api/login", "", `{"username":"`+username+`","password":"`+password+`"}`, &tokens)
+		return code, tokens
+	}
+
+	send("POST", "/api/register", "", `{"username":"alice","password":"correct horse"}`, nil)
+	send("POST", "/api/register", "", `{"username":"bob","password":"correct horse"}`, nil)
+	_, alice := login("alice", "correct horse")
+
+	var user User
+	assert.Equal(t, http.StatusOK, send("GET", "/api/account", alice.Token, "", &user))
+	assert.Equal(t, "alice", user.Username)
+	assert.Empty(t, user.PasswordHash)
+
+	// usernames
+	assert.Equal(t, http.StatusConflict, send("PUT", "/api/account/username", alice.Token, `{"username":"bob"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, send("PUT", "/api/account/username", alice.Token, `{"username":""}`, nil))
+	assert.Equal(t, http.StatusOK, send("PUT", "/api/account/username", alice.Token, `{"username":"carol"}`, nil))
+
+	// emails are verified through a mailed link
+	assert.Equal(t, http.StatusBadRequest, send("PUT", "/api/account/email", alice.Token, `{"email":"not an email"}`, nil))
+	assert.Equal(t, http.StatusConflict, send("POST", "/api/account/email/resend", alice.Token, "", nil))
+	assert.Equal(t, http.StatusOK, send("PUT", "/api/account/email", alice.Token, `{"email":"carol@example.com"}`, nil))
+	assert.Equal(t, http.StatusOK, send("POST", "/api/account/email/resend", alice.Token, "", nil))
+	assert.Len(t, mailer.sent, 2)
+	link := regexp.MustCompile(`https://reduser\.example/verify-email\?token=(\S+)`).FindStringSubmatch(mailer.sent[1])
+	assert.Len(t, link, 2)
+	token, _ := url.QueryUnescape(link[1])
+	first := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(mailer.sent[0])[1]
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/verify-email", "", `{"token":"`+first+`"}`, nil))
+	assert.Equal(t, http.StatusOK, send("POST", "/api/verify-email", "", `{"token":"`+token+`"}`, nil))
+	send("GET", "/api/account", alice.Token, "", &user)
+	assert.Equal(t, "carol@example.com", user.Email)
+	assert.True(t, user.EmailVerified)
+
+	_, bob := login("bob", "correct horse")
+	assert.Equal(t, http.StatusConflict, send("PUT", "/api/account/email", bob.Token, `{"email":"carol@example.com"}`, nil))
+
+	// without a public URL links could only come from the Host header,
+	// which anyone can forge, so nothing is sent
+	cfg.PublicURL = ""
+	bare := newTestAPI(t, store, cfg, mailer)
+	assert.Equal(t, http.StatusServiceUnavailable, bare.send("PUT", "/api/account/email", bob.Token, `{"email":"bob@example.com"}`, nil))
+	assert.Len(t, mailer.sent, 2)
+	send("GET", "/api/account", bob.Token, "", &user)
+	assert.Empty(t, user.Email)
+
+	// changing the password ends every other session
+	_, other := login("carol", "correct horse")
+	var renewed tokenResponse
+	assert.Equal(t, http.StatusUnauthorized, send("PUT", "/api/account/password", alice.Token,
+		`{"current_password":"wrong","new_password":"battery staple"}`, nil))
+	assert.Equal(t, http.StatusOK, send("PUT", "/api/account/password", alice.Token,
+		`{"current_password":"correct horse","new_password":"battery staple"}`, &renewed))
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/account", alice.Token, "", nil))
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/account", other.Token, "", nil))
+	assert.Equal(t, http.StatusOK, send("GET", "/api/account", renewed.Token, "", nil))
+	code, _ := login("carol", "correct horse")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// deleting takes the password, then the confirmation it gave
+	var confirm struct {
+		ConfirmationToken string `json:"confirmation_token"`
+		ExpiresIn         int64  `json:"expires_in"`
+	}
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/account/delete", renewed.Token, `{"password":"correct horse"}`, nil))
+	assert.Equal(t, http.StatusOK, send("POST", "/api/account/delete", renewed.Token, `{"password":"battery staple"}`, &confirm))
+	assert.Equal(t, int64(accountDeleteTTL.Seconds()), confirm.ExpiresIn)
+	assert.Equal(t, http.StatusForbidden, send("DELETE", "/api/account", renewed.Token, `{"confirmation_token":"`+renewed.Token+`"}`, nil))
+	assert.Equal(t, http.StatusForbidden, send("DELETE", "/api/account", bob.Token, `{"confirmation_token":"`+confirm.ConfirmationToken+`"}`, nil))
+	assert.Equal(t, http.StatusOK, send("DELETE", "/api/account", renewed.Token, `{"confirmation_token":"`+confirm.ConfirmationToken+`"}`, nil))
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/account", renewed.Token, "", nil))
+	code, _ = login("carol", "battery staple")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/account", bob.Token, "", nil))
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultJWTSecret is the key dashboard tokens were signed with before it
+// could be configured. Everyone knows it, so only --dev servers may use it.
+const defaultJWTSecret = "secret-signing-key"
+
+// minJWTSecretLength is the shortest signing key accepted outside --dev: as
+// many bytes as HS256 produces.
+const minJWTSecretLength = 32
+
+// Config is how the server is set up. Every setting can be given as a flag,
+// as an environment variable named REDUSER_ and the flag name in upper case
+// with underscores, or in a JSON config file under the flag name with
+// underscores:
+//
+//	{"addr": ":8080", "cors_origins": ["https://example.com"], "token_ttl": "12h"}
+//
+// Flags win over the environment, which wins over the file. The file is
+// given with -config or REDUSER_CONFIG.
+type Config struct {
+	Addr string
+	// DB is the SQLite database file, used unless Postgres or Memory is set.
+	DB        string
+	Postgres  string
+	Memory    bool
+	JWTSecret string
+	// TokenTTL is how long a dashboard access token lasts. SessionTTL is
+	// how long its session lasts without being refreshed.
+	TokenTTL    time.Duration
+	SessionTTL  time.Duration
+	CORSOrigins []string
+	FrontendDir string
+	// PublicURL is where the dashboard is reached, for links in emails.
+	// Without it no emails can be verified.
+	PublicURL string
+	// UsernamePattern is a regular expression usernames must match.
+	UsernamePattern string
+	// PasswordMinLength is the fewest characters a password may have, and
+	// PasswordMinClasses the fewest kinds of them: lower case letters,
+	// upper case letters, digits and everything else.
+	PasswordMinLength  int
+	PasswordMinClasses int
+	// BreachedPasswords is a file of passwords known to have leaked, one
+	// per line, that aren't accepted whatever their case.
+	BreachedPasswords string
+	// Registration is who may register: anyone ("open"), those with an
+	// invite code ("invite"), or anyone, but only able to log in once
+	// approved ("approval").
+	Registration string
+	// ReadTimeout, WriteTimeout and IdleTimeout are those of http.Server;
+	// zero means none. Streams set their own.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ShutdownTimeout is how long requests in flight may take to finish
+	// once the server is asked to stop.
+	ShutdownTimeout time.Duration
+	// TLSCert and TLSKey are PEM files to serve HTTPS with. They are read
+	// again when they change.
+	TLSCert string
+	TLSKey  string
+	// WebhookAllowPrivate lets webhooks point to loopback, link-local and
+	// private addresses, for receivers on the same network.
+	WebhookAllowPrivate bool
+	// Dev allows settings that are only fine on a developer's machine, such
+	// as the default signing key.
+	Dev bool
+
+	// breached holds the passwords of BreachedPasswords in lower case.
+	breached map[string]bool
+}
+
+// The registration modes.
+const (
+	registrationOpen     = "open"
+	registrationInvite   = "invite"
+	registrationApproval = "approval"
+)
+
+// DefaultConfig is the configuration without any flags, environment or file.
+func DefaultConfig() Config {
+	return Config{
+		Addr:        "localhost:8080",
+		DB:          "app.db",
+		JWTSecret:   defaultJWTSecret,
+		TokenTTL:    15 * time.Minute,
+		SessionTTL:  30 * 24 * time.Hour,
+		CORSOrigins: []string{"*"},
+		FrontendDir: "frontend",
+
+		UsernamePattern:    `^[A-Za-z0-9][A-Za-z0-9_.-]{2,31}$`,
+		PasswordMinLength:  8,
+		PasswordMinClasses: 1,
+		Registration:       registrationOpen,
+
+		ReadTimeout:     15 * time.Second,
+		WriteTimeout:    30 * time.Second,
+		IdleTimeout:     2 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// setting is one configurable value. set parses it from its text form; list
+// values are separated by commas.
+type setting struct {
+	name   string
+	usage  string
+	isBool bool
+	set    func(c *Config, v string) error
+}
+
+var settings = []setting{
+	{"addr", "address to listen on", false, func(c *Config, v string) error {
+		c.Addr = v
+		return nil
+	}},
+	{"db", "SQLite database file", false, func(c *Config, v string) error {
+		c.DB = v
+		return nil
+	}},
+	{"postgres", "connection string of a Postgres database to use instead of the SQLite file; live updates and webhooks only cover changes made through this server", false, func(c *Config, v string) error {
+		c.Postgres = v
+		return nil
+	}},
+	{"memory", "keep everything in memory instead; nothing survives a restart", true, func(c *Config, v string) (err error) {
+		c.Memory, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"jwt-secret", "key dashboard tokens are signed with, at least 32 bytes", false, func(c *Config, v string) error {
+		c.JWTSecret = v
+		return nil
+	}},
+	{"token-ttl", "how long a dashboard access token lasts, such as 15m", false, duration(func(c *Config) *time.Duration { return &c.TokenTTL })},
+	{"session-ttl", "how long a dashboard session lasts without being refreshed", false, duration(func(c *Config) *time.Duration { return &c.SessionTTL })},
+	{"cors-origins", "comma-separated origins allowed to call the API, or *", false, func(c *Config, v string) error {
+		c.CORSOrigins = nil
+		for _, o := range strings.Split(v, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				c.CORSOrigins = append(c.CORSOrigins, o)
+			}
+		}
+		return nil
+	}},
+	{"frontend-dir", "directory the dashboard is served from", false, func(c *Config, v string) error {
+		c.FrontendDir = v
+		return nil
+	}},
+	{"public-url", "URL the dashboard is reached at, for links in emails; needed to verify emails", false, func(c *Config, v string) error {
+		c.PublicURL = strings.TrimSuffix(v, "/")
+		return nil
+	}},
+	{"username-pattern", "regular expression usernames must match", false, func(c *Config, v string) error {
+		c.UsernamePattern = v
+		return nil
+	}},
+	{"password-min-length", "fewest characters a password may have", false, integer(func(c *Config) *int { return &c.PasswordMinLength })},
+	{"password-min-classes", "fewest of lower case, upper case, digits and symbols a password must mix, 1 to 4", false, integer(func(c *Config) *int { return &c.PasswordMinClasses })},
+	{"breached-passwords", "file of leaked passwords, one per line, to refuse", false, func(c *Config, v string) error {
+		c.BreachedPasswords = v
+		return nil
+	}},
+	{"registration", "who may register: open, invite (with a code from \"reduser invite\") or approval (by \"reduser users approve\")", false, func(c *Config, v string) error {
+		c.Registration = v
+		return nil
+	}},
+	{"read-timeout", "how long reading a request may take, 0 for no limit", false, duration(func(c *Config) *time.Duration { return &c.ReadTimeout })},
+	{"write-timeout", "how long writing a response may take, 0 for no limit", false, duration(func(c *Config) *time.Duration { return &c.WriteTimeout })},
+	{"idle-timeout", "how long an idle keep-alive connection stays open, 0 for no limit", false, duration(func(c *Config) *time.Duration { return &c.IdleTimeout })},
+	{"shutdown-timeout", "how long requests in flight may take to finish on shutdown", false, duration(func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+	{"tls-cert", "PEM certificate file to serve HTTPS with, reloaded when it changes", false, func(c *Config, v string) error {
+		c.TLSCert = v
+		return nil
+	}},
+	{"tls-key", "PEM private key file of tls-cert", false, func(c *Config, v string) error {
+		c.TLSKey = v
+		return nil
+	}},
+	{"webhook-allow-private", "let webhooks point to loopback, link-local and private addresses", true, func(c *Config, v string) (err error) {
+		c.WebhookAllowPrivate, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"dev", "allow development-only settings such as the default signing key", true, func(c *Config, v string) (err error) {
+		c.Dev, err = strconv.ParseBool(v)
+		return err
+	}},
+}
+
+// duration is the set func of the time.Duration that field picks out.
+func duration(field func(c *Config) *time.Duration) func(c *Config, v string) error {
+	return func(c *Config, v string) (err error) {
+		*field(c), err = time.ParseDuration(v)
+		return err
+	}
+}
+
+// integer is the set func of the int that field picks out.
+func integer(field func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) (err error) {
+		*field(c), err = strconv.Atoi(v)
+		return err
+	}
+}
+
+// legacyEnvNames are environment variables that were read before settings
+// got their names from flags.
+var legacyEnvNames = map[string]string{
+	"postgres": "REDUSER_POSTGRES_DSN",
+}
+
+func (s setting) envName() string {
+	if env, ok := legacyEnvNames[s.name]; ok {
+		return env
+	}
+	return "REDUSER_" + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+func fileKey(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// LoadConfig builds the configuration from the defaults, the config file,
+// getenv and the flags in args, and validates it. It returns the arguments
+// left after the flags.
+func LoadConfig(args []string, getenv func(string) string, output io.Writer) (Config, []string, error) {
+	fs := flag.NewFlagSet("reduser", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: reduser [flags] [migrate [up|status] | invite [-ttl duration] | users pending|approve|reject]")
+		fs.PrintDefaults()
+	}
+
+	// flags are only collected here and applied last
+	type given struct {
+		s *setting
+		v string
+	}
+	var flags []given
+	configPath := getenv("REDUSER_CONFIG")
+	fs.StringVar(&configPath, "config", configPath, "JSON config file")
+	for i := range settings {
+		s := &settings[i]
+		usage := fmt.Sprintf("%s (%s)", s.usage, s.envName())
+		if s.isBool {
+			fs.BoolFunc(s.name, usage, func(v string) error {
+				flags = append(flags, given{s, v})
+				return nil
+			})
+		} else {
+			fs.Func(s.name, usage, func(v string) error {
+				flags = append(flags, given{s, v})
+				return nil
+			})
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	c := DefaultConfig()
+	if configPath != "" {
+		if err := c.loadFile(configPath); err != nil {
+			return Config{}, nil, err
+		}
+	}
+	for _, s := range settings {
+		if v := getenv(s.envName()); v != "" {
+			if err := s.set(&c, v); err != nil {
+				return Config{}, nil, fmt.Errorf("%s: %w", s.envName(), err)
+			}
+		}
+	}
+	for _, f := range flags {
+		if err := f.s.set(&c, f.v); err != nil {
+			return Config{}, nil, fmt.Errorf("-%s: %w", f.s.name, err)
+		}
+	}
+	if err := c.validate(); err != nil {
+		return c, fs.Args(), err
+	}
+	return c, fs.Args(), c.loadBreachedPasswords()
+}
+
+// loadFile applies the settings in the JSON config file at path. Lists may
+// be given as arrays, and booleans and numbers as such.
+func (c *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := json.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for key, value := range values {
+		i := -1
+		for j, s := range settings {
+			if fileKey(s.name) == key {
+				i = j
+			}
+		}
+		if i < 0 {
+			return fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = v
+		case bool, float64:
+			text = fmt.Sprint(v)
+		case []any:
+			items := make([]string, len(v))
+			for j, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("%s: %s must be a list of strings", path, key)
+				}
+				items[j] = s
+			}
+			text = strings.Join(items, ",")
+		default:
+			return fmt.Errorf("%s: invalid value for %s", path, key)
+		}
+		if err := settings[i].set(c, text); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+// loadBreachedPasswords reads the BreachedPasswords file, if there is one.
+func (c *Config) loadBreachedPasswords() error {
+	if c.BreachedPasswords == "" {
+		return nil
+	}
+	f, err := os.Open(c.BreachedPasswords)
+	if err != nil {
+		return fmt.Errorf("breached-passwords: %w", err)
+	}
+	defer f.Close()
+
+	c.breached = map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if pw := strings.TrimSpace(scanner.Text()); pw != "" {
+			c.breached[strings.ToLower(pw)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("breached-passwords: %w", err)
+	}
+	return nil
+}
+
+// validate checks the settings on their own and together. The signing key
+// and the frontend directory are checked separately by checkSigningKey and
+// checkFrontendDir, as only serving needs them.
+func (c Config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("addr: %w", err))
+	}
+	if c.Memory && c.Postgres != "" {
+		errs = append(errs, errors.New("memory and postgres can't be used together"))
+	}
+	if !c.Memory && c.Postgres == "" && c.DB == "" {
+		errs = append(errs, errors.New("db must not be empty"))
+	}
+	if c.TokenTTL <= 0 {
+		errs = append(errs, errors.New("token-ttl must be positive"))
+	}
+	if c.SessionTTL < c.TokenTTL {
+		errs = append(errs, errors.New("session-ttl must not be shorter than token-ttl"))
+	}
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{{"read-timeout", c.ReadTimeout}, {"write-timeout", c.WriteTimeout}, {"idle-timeout", c.IdleTimeout}} {
+		if t.d < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", t.name))
+		}
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown-timeout must be positive"))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls-cert and tls-key must be given together"))
+	}
+	if len(c.CORSOrigins) == 0 {
+		errs = append(errs, errors.New("cors-origins must not be empty"))
+	}
+	for _, o := range c.CORSOrigins {
+		if o == "*" {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			errs = append(errs, fmt.Errorf("cors-origins: %q is not an origin such as https://example.com", o))
+		}
+	}
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("public-url: %q is not a URL such as https://example.com", c.PublicURL))
+		}
+	}
+	if _, err := regexp.Compile(c.UsernamePattern); err != nil {
+		errs = append(errs, fmt.Errorf("username-pattern: %w", err))
+	}
+	if c.PasswordMinLength < 1 || c.PasswordMinLength > maxPasswordBytes {
+		errs = append(errs, fmt.Errorf("password-min-length must be between 1 and %d", maxPasswordBytes))
+	}
+	if c.PasswordMinClasses < 1 || c.PasswordMinClasses > 4 {
+		errs = append(errs, errors.New("password-min-classes must be between 1 and 4"))
+	}
+	switch c.Registration {
+	case registrationOpen, registrationInvite, registrationApproval:
+	default:
+		errs = append(errs, fmt.Errorf("registration: %q is not open, invite or approval", c.Registration))
+	}
+	return errors.Join(errs...)
+}
+
+// checkFrontendDir checks that the dashboard can be served. Like the signing
+// key it's only checked for serving, so the other commands work anywhere.
+func (c Config) checkFrontendDir() error {
+	if info, err := os.Stat(c.FrontendDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("frontend-dir: %q is not a directory", c.FrontendDir)
+	}
+	return nil
+}
+
+// checkSigningKey refuses the default signing key, and keys too short to be
+// safe, unless Dev is set.
+func (c Config) checkSigningKey() error {
+	if c.Dev {
+		return nil
+	}
+	if c.JWTSecret == defaultJWTSecret {
+		return fmt.Errorf("refusing to sign tokens with the default key; set REDUSER_JWT_SECRET or pass --dev")
+	}
+	if len(c.JWTSecret) < minJWTSecretLength {
+		return fmt.Errorf("jwt-secret must be at least %d bytes", minJWTSecretLength)
+	}
+	return nil
+}
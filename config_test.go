@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+
+	cfg, args, err := LoadConfig(nil, getenv, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), cfg)
+	assert.Empty(t, args)
+
+	file := filepath.Join(t.TempDir(), "reduser.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{
+		"addr": ":9000",
+		"db": "file.db",
+		"token_ttl": "1h",
+		"cors_origins": ["https://a.example", "https://b.example"],
+		"dev": true
+	}`), 0o600))
+	env["REDUSER_CONFIG"] = file
+	env["REDUSER_DB"] = "env.db"
+	env["REDUSER_TOKEN_TTL"] = "2h"
+
+	// file < environment < flags
+	cfg, args, err = LoadConfig([]string{"-token-ttl", "3h", "migrate", "status"}, getenv, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, ":9000", cfg.Addr)
+	assert.Equal(t, "env.db", cfg.DB)
+	assert.Equal(t, 3*time.Hour, cfg.TokenTTL)
+	assert.Equal(t, []string{"https://a.example", "https://b.example"}, cfg.CORSOrigins)
+	assert.True(t, cfg.Dev)
+	assert.Equal(t, []string{"migrate", "status"}, args)
+
+	cfg, _, err = LoadConfig([]string{"--dev=false", "-cors-origins", "https://c.example, *"}, getenv, io.Discard)
+	assert.NoError(t, err)
+	assert.False(t, cfg.Dev)
+	assert.Equal(t, []string{"https://c.example", "*"}, cfg.CORSOrigins)
+
+	env["REDUSER_TOKEN_TTL"] = "soon"
+	_, _, err = LoadConfig(nil, getenv, io.Discard)
+	assert.ErrorContains(t, err, "REDUSER_TOKEN_TTL")
+	delete(env, "REDUSER_TOKEN_TTL")
+
+	// breached passwords are read once the rest is valid
+	breached := filepath.Join(t.TempDir(), "breached.txt")
+	assert.NoError(t, os.WriteFile(breached, []byte("123456\r\nPassword\n\n"), 0o600))
+	cfg, _, err = LoadConfig([]string{"-breached-passwords", breached, "-password-min-length", "12"}, getenv, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, 12, cfg.PasswordMinLength)
+	assert.Equal(t, map[string]bool{"123456": true, "password": true}, cfg.breached)
+	_, _, err = LoadConfig([]string{"-breached-passwords", breached + ".missing"}, getenv, io.Discard)
+	assert.ErrorContains(t, err, "breached-passwords")
+
+	assert.NoError(t, os.WriteFile(file, []byte(`{"port": 80}`), 0o600))
+	_, _, err = LoadConfig(nil, getenv, io.Discard)
+	assert.ErrorContains(t, err, `unknown setting "port"`)
+}
+
+func TestConfigValidate(t *testing.T) {
+	for name, change := range map[string]func(c *Config){
+		"addr":          func(c *Config) { c.Addr = "localhost" },
+		"backends":      func(c *Config) { c.Memory, c.Postgres = true, "postgres://db" },
+		"db":            func(c *Config) { c.DB = "" },
+		"token ttl":     func(c *Config) { c.TokenTTL = 0 },
+		"no origins":    func(c *Config) { c.CORSOrigins = nil },
+		"origin scheme": func(c *Config) { c.CORSOrigins = []string{"example.com"} },
+		"origin path":   func(c *Config) { c.CORSOrigins = []string{"https://example.com/app"} },
+		"timeout":       func(c *Config) { c.WriteTimeout = -time.Second },
+		"shutdown":      func(c *Config) { c.ShutdownTimeout = 0 },
+		"tls":           func(c *Config) { c.TLSCert = "cert.pem" },
+		"username":      func(c *Config) { c.UsernamePattern = "[a-z" },
+		"password":      func(c *Config) { c.PasswordMinLength = 0 },
+		"classes":       func(c *Config) { c.PasswordMinClasses = 5 },
+		"registration":  func(c *Config) { c.Registration = "closed" },
+	} {
+		cfg := DefaultConfig()
+		change(&cfg)
+		assert.Error(t, cfg.validate(), name)
+	}
+
+	cfg := DefaultConfig()
+	assert.NoError(t, cfg.validate())
+	assert.ErrorContains(t, cfg.checkSigningKey(), "default key")
+	cfg.JWTSecret = "short"
+	assert.ErrorContains(t, cfg.checkSigningKey(), "at least 32 bytes")
+	cfg.Dev = true
+	assert.NoError(t, cfg.checkSigningKey())
+	cfg.Dev, cfg.JWTSecret = false, "0123456789abcdef0123456789abcdef"
+	assert.NoError(t, cfg.checkSigningKey())
+
+	// Only serving needs the frontend
+	assert.NoError(t, cfg.checkFrontendDir())
+	cfg.FrontendDir = "missing"
+	assert.NoError(t, cfg.validate())
+	assert.ErrorContains(t, cfg.checkFrontendDir(), "frontend-dir")
+}
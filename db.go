@@ -2,58 +2,150 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+	"strings"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
-func InitDB(path string) *sql.DB {
-	db, err := sql.Open("sqlite3", path)
+// OpenDB opens the database at path without touching its schema. Foreign
+// keys are enforced on every connection, and transactions are IMMEDIATE.
+func OpenDB(path string) *sql.DB {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	// Transactions read before they write, so they take the write lock up
+	// front; deferred ones would fail with "database is locked" when two
+	// upgrade at once, instead of waiting on the busy timeout.
+	db, err := sql.Open("sqlite3", path+sep+"_foreign_keys=on&_txlock=immediate&_busy_timeout=5000")
 	if err != nil {
 		log.Fatalf("failed to open db: %v", err)
 	}
+	return db
+}
 
-	// run migrations
-	stmts := []string{
-		`PRAGMA foreign_keys = ON;`,
-		`CREATE TABLE IF NOT EXISTS users (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            username TEXT NOT NULL UNIQUE,
-            password_hash TEXT NOT NULL
-        );`,
-		`CREATE TABLE IF NOT EXISTS projects (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            user_id INTEGER NOT NULL,
-            name TEXT NOT NULL,
-            token TEXT NOT NULL UNIQUE,
-            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
-        );`,
-		`CREATE TABLE IF NOT EXISTS tables (
+// InitDB opens the database at path and migrates it to the current schema.
+// It refuses databases migrated by a newer binary.
+func InitDB(path string) *sql.DB {
+	db := OpenDB(path)
+	if err := migrate(db, migrations); err != nil {
+		log.Fatalf("migration error: %v", err)
+	}
+	return db
+}
+
+func addColumnIfMissing(db DBTX, table, column, def string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + def)
+	return err
+}
+
+// variableTypes are the types a variable can have. The type CHECK of the
+// variables table is built from them.
+var variableTypes = []string{"string", "int", "float", "bool", "json", "list", "map", "datetime", "duration", "enum"}
+
+// variablesTable returns the CREATE statement of the variables table under
+// the given name. Names are unique per table. Structured values have to be
+// valid JSON of the right shape; options holds the allowed values of an enum
+// as a JSON array, constraints the variable's Constraints as a JSON object.
+func variablesTable(name string) string {
+	types := make([]string, len(variableTypes))
+	for i, t := range variableTypes {
+		types[i] = "'" + t + "'"
+	}
+
+	return `CREATE TABLE IF NOT EXISTS ` + name + ` (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
-            project_id INTEGER NOT NULL,
-            user_id INTEGER NOT NULL,
             name TEXT NOT NULL,
-            FOREIGN KEY(project_id) REFERENCES projects(id) ON DELETE CASCADE,
-            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
-            UNIQUE(project_id, user_id, name)
-        );`,
-		`CREATE TABLE IF NOT EXISTS variables (
-            name TEXT NOT NULL PRIMARY KEY,
             table_id INTEGER NOT NULL,
             user_id INTEGER NOT NULL,
             value TEXT,
-            type TEXT NOT NULL CHECK (type IN ('string','int','float','bool')),
+            type TEXT NOT NULL CHECK (type IN (` + strings.Join(types, ",") + `)),
+            revision INTEGER NOT NULL DEFAULT 0,
+            options TEXT,
+            constraints TEXT,
+            CHECK (CASE type
+                WHEN 'json' THEN json_valid(value)
+                WHEN 'list' THEN CASE WHEN json_valid(value) THEN json_type(value) = 'array' ELSE 0 END
+                WHEN 'map' THEN CASE WHEN json_valid(value) THEN json_type(value) = 'object' ELSE 0 END
+                ELSE 1 END),
             FOREIGN KEY(table_id) REFERENCES tables(id) ON DELETE CASCADE,
             FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
-            UNIQUE(table_id, user_id, name)
-        );`,
+            UNIQUE(table_id, name)
+        );`
+}
+
+// rebuildTable recreates table from create when its stored definition
+// differs, copying over the columns both versions have. SQLite can't change
+// the constraints of an existing table, so this is how they're updated. It
+// runs inside a migration, where foreign keys are off.
+func rebuildTable(db DBTX, table string, create func(name string) string) error {
+	var stored string
+	if err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&stored); err != nil {
+		return err
+	}
+	// sqlite_master keeps the statement from the column list on as written
+	want := create(table)
+	want = strings.TrimSuffix(want[strings.Index(want, "("):], ";")
+	if stored[strings.Index(stored, "("):] == want {
+		return nil
+	}
+
+	if _, err := db.Exec(create(table + "_new")); err != nil {
+		return err
+	}
+	rows, err := db.Query(
+		`SELECT name FROM pragma_table_info(?) WHERE name IN (SELECT name FROM pragma_table_info(?))`,
+		table, table+"_new",
+	)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
 	}
+	rows.Close()
+	columns := strings.Join(names, ", ")
 
+	stmts := []string{
+		`INSERT INTO ` + table + `_new(` + columns + `) SELECT ` + columns + ` FROM ` + table,
+		`DROP TABLE ` + table,
+		`ALTER TABLE ` + table + `_new RENAME TO ` + table,
+	}
 	for _, s := range stmts {
 		if _, err := db.Exec(s); err != nil {
-			log.Fatalf("migration error: %v\nstmt: %s", err, s)
+			return err
 		}
 	}
+	return nil
+}
 
-	return db
+// checkError maps a violated CHECK constraint, such as a structured value
+// that isn't valid JSON of its type, to errInvalidValue, a violated UNIQUE
+// constraint to ErrExists and a reference to a missing row to ErrNotFound.
+func checkError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.ExtendedCode {
+		case sqlite3.ErrConstraintCheck:
+			return errInvalidValue
+		case sqlite3.ErrConstraintUnique:
+			return ErrExists
+		case sqlite3.ErrConstraintForeignKey:
+			return ErrNotFound
+		}
+	}
+	return err
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVariableNamespaces(t *testing.T) {
+	db := InitDB("file:namespaces?mode=memory&cache=shared")
+	defer db.Close()
+	store := NewSQLStore(db)
+
+	assert.NoError(t, store.CreateUser("alice", "x"))
+	assert.NoError(t, store.CreateUser("bob", "x"))
+	alice, _, _ := store.GetUserByUsername("alice")
+	bob, _, _ := store.GetUserByUsername("bob")
+	aliceProject, _ := store.CreateProject(alice, "Game", "alice-token")
+	otherProject, _ := store.CreateProject(alice, "Launcher", "launcher-token")
+	bobProject, _ := store.CreateProject(bob, "Game", "bob-token")
+	client, _ := store.CreateTable(aliceProject, "Client", alice)
+	server, _ := store.CreateTable(aliceProject, "Server", alice)
+	launcher, _ := store.CreateTable(otherProject, "Client", alice)
+	bobs, _ := store.CreateTable(bobProject, "Client", bob)
+
+	tables := map[int]int{client: alice, server: alice, launcher: alice, bobs: bob}
+	for tableID, userID := range tables {
+		assert.NoError(t, store.CreateVariable(tableID, "version", "1", "int", nil, Constraints{}, userID))
+	}
+	assert.ErrorIs(t, store.CreateVariable(client, "version", "2", "int", nil, Constraints{}, alice), ErrExists)
+	assert.ErrorIs(t, store.CreateVariable(client, "intruder", "", "string", nil, Constraints{}, bob), ErrNotFound)
+
+	_, err := store.SetVariable(server, "version", "2")
+	assert.NoError(t, err)
+	assert.NoError(t, store.DeleteVariable(launcher, "version", alice))
+
+	val, _, _, err := store.GetVariable(server, "version")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", val)
+	for _, tableID := range []int{client, bobs} {
+		val, _, rev, err := store.GetVariable(tableID, "version")
+		assert.NoError(t, err)
+		assert.Equal(t, "1", val)
+		assert.Equal(t, 0, rev)
+	}
+	_, _, _, err = store.GetVariable(launcher, "version")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMigrateLegacyVariables(t *testing.T) {
+	// in app.db variable names were still the primary key of the variables
+	// table
+	db := InitDB(fixtureDB(t))
+	defer db.Close()
+	store := NewSQLStore(db)
+
+	vars, err := store.ListVariables(1, 1)
+	assert.NoError(t, err)
+	var names []string
+	for _, v := range vars {
+		names = append(names, v.Name)
+		assert.Equal(t, "string", v.Type)
+	}
+	assert.ElementsMatch(t, []string{"Variable", "Variable1", "Variable2"}, names)
+
+	other, err := store.CreateTable(1, "Other", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateVariable(other, "Variable", "x", "string", nil, Constraints{}, 1))
+	assert.ErrorIs(t, store.CreateVariable(1, "Variable", "x", "string", nil, Constraints{}, 1), ErrExists)
+}
+
+func TestConcurrentIncrements(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "app.db"))
+	defer db.Close()
+	store := NewSQLStore(db)
+
+	assert.NoError(t, store.CreateUser("alice", "x"))
+	alice, _, _ := store.GetUserByUsername("alice")
+	project, _ := store.CreateProject(alice, "Game", "token")
+	table, _ := store.CreateTable(project, "Client", alice)
+	assert.NoError(t, store.CreateVariable(table, "count", "0", "int", nil, Constraints{}, alice))
+
+	const n = 50
+	scope := accessScope{ProjectID: project, UserID: alice}
+	errs := make(chan error, n)
+	for range n {
+		go func() {
+			_, err := runAccessSingle(store, scope, accessOp{Action: "incr", Table: tableRef{ID: table}, VarName: "count"})
+			errs <- err
+		}()
+	}
+	for range n {
+		assert.NoError(t, <-errs)
+	}
+	val, _, _, err := store.GetVariable(table, "count")
+	assert.NoError(t, err)
+	assert.Equal(t, "50", val)
+}
@@ -4,7 +4,84 @@ document.getElementById("createProjectBtn").onclick = () => {
 	const name = prompt("New project name:", "Project");
 	if (name) {
 		createProject(name);
-		load();
+		const twoFactor = {
+	panel: document.getElementById("twoFactor"),
+	setup: document.getElementById("twoFactorSetup"),
+	on: document.getElementById("twoFactorOn"),
+	recovery: document.getElementById("recoveryCodes"),
+};
+
+function showRecoveryCodes(codes) {
+	document.getElementById("recoveryCodesList").textContent = codes.join("\n");
+	twoFactor.recovery.hidden = false;
+}
+
+function showTwoFactor(enabled) {
+	twoFactor.panel.hidden = false;
+	twoFactor.setup.hidden = true;
+	twoFactor.on.hidden = !enabled;
+	twoFactor.recovery.hidden = true;
+}
+
+document.getElementById("twoFactorBtn").onclick = async () => {
+	if (!twoFactor.panel.hidden) {
+		twoFactor.panel.hidden = true;
+		return;
+	}
+	const account = await loadAccount();
+	showTwoFactor(account.totp_enabled);
+	if (account.totp_enabled) return;
+
+	const password = prompt("Your password, to set up two-factor authentication:");
+	if (!password) {
+		twoFactor.panel.hidden = true;
+		return;
+	}
+	const res = await setupTwoFactor(password);
+	const data = await res.json();
+	if (!res.ok) {
+		alert(data.error);
+		twoFactor.panel.hidden = true;
+		return;
+	}
+	document.getElementById("twoFactorQR").src = data.qr_code;
+	document.getElementById("twoFactorSecret").textContent = data.secret;
+	twoFactor.setup.hidden = false;
+};
+
+document.getElementById("twoFactorConfirmBtn").onclick = async () => {
+	const res = await confirmTwoFactor(document.getElementById("twoFactorCode").value);
+	const data = await res.json();
+	if (!res.ok) {
+		alert(data.error);
+		return;
+	}
+	showTwoFactor(true);
+	showRecoveryCodes(data.recovery_codes);
+};
+
+document.getElementById("recoveryCodesBtn").onclick = async () => {
+	const password = prompt("Your password, to replace your recovery codes:");
+	if (!password) return;
+	const res = await replaceRecoveryCodes(password);
+	const data = await res.json();
+	if (res.ok) showRecoveryCodes(data.recovery_codes);
+	else alert(data.error);
+};
+
+document.getElementById("twoFactorOffBtn").onclick = async () => {
+	const password = prompt("Your password, to turn two-factor authentication off:");
+	if (!password) return;
+	const code = prompt("A code from your app, or a recovery code:");
+	if (!code) return;
+	const res = await disableTwoFactor(password, code);
+	if (res.ok) {
+		twoFactor.panel.hidden = true;
+		alert("Two-factor authentication is off.");
+	} else alert((await res.json()).error);
+};
+
+load();
 	}
 };
 
@@ -29,4 +106,79 @@ async function load() {
 	renderProjects(projects);
 }
 
+const twoFactor = {
+	panel: document.getElementById("twoFactor"),
+	setup: document.getElementById("twoFactorSetup"),
+	on: document.getElementById("twoFactorOn"),
+	recovery: document.getElementById("recoveryCodes"),
+};
+
+function showRecoveryCodes(codes) {
+	document.getElementById("recoveryCodesList").textContent = codes.join("\n");
+	twoFactor.recovery.hidden = false;
+}
+
+function showTwoFactor(enabled) {
+	twoFactor.panel.hidden = false;
+	twoFactor.setup.hidden = true;
+	twoFactor.on.hidden = !enabled;
+	twoFactor.recovery.hidden = true;
+}
+
+document.getElementById("twoFactorBtn").onclick = async () => {
+	if (!twoFactor.panel.hidden) {
+		twoFactor.panel.hidden = true;
+		return;
+	}
+	const account = await loadAccount();
+	showTwoFactor(account.totp_enabled);
+	if (account.totp_enabled) return;
+
+	const password = prompt("Your password, to set up two-factor authentication:");
+	if (!password) {
+		twoFactor.panel.hidden = true;
+		return;
+	}
+	const res = await setupTwoFactor(password);
+	const data = await res.json();
+	if (!res.ok) {
+		alert(data.error);
+		twoFactor.panel.hidden = true;
+		return;
+	}
+	document.getElementById("twoFactorQR").src = data.qr_code;
+	document.getElementById("twoFactorSecret").textContent = data.secret;
+	twoFactor.setup.hidden = false;
+};
+
+document.getElementById("twoFactorConfirmBtn").onclick = async () => {
+	const res = await confirmTwoFactor(document.getElementById("twoFactorCode").value);
+	const data = await res.json();
+	if (!res.ok) {
+		alert(data.error);
+		return;
+	}
+	showTwoFactor(true);
+	showRecoveryCodes(data.recovery_codes);
+};
+
+document.getElementById("recoveryCodesBtn").onclick = async () => {
+	const password = prompt("Your password, to replace your recovery codes:");
+	if (!password) return;
+	const res = await replaceRecoveryCodes(password);
+	const data = await res.json();
+	if (res.ok) showRecoveryCodes(data.recovery_codes);
+	else alert(data.error);
+};
+
+document.getElementById("twoFactorOffBtn").onclick = async () => {
+	const password = prompt("Your password, to turn two-factor authentication off:");
+	if (!password) return;
+	const code = prompt("A code from your app, or a recovery code:");
+	if (!code) return;
+	const res = await disableTwoFactor(password, code);
+	if (res.ok) showTwoFactor(false);
+	else alert((await res.json()).error);
+};
+
 load();
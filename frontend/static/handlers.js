@@ -1,16 +1,82 @@
-const apiBase = "http://localhost:8080/api";
-let jwt = "";
-
-if (document.cookie) {
-	const cookies = document.cookie.split(";");
-	for (const cookie of cookies) {
-		const [name, value] = cookie.split("=");
-		if (name === "jwt") {
-			jwt = value;
-		}
+const apiBase = "/api";
+let jwt = getCookie("jwt");
+
+function getCookie(name) {
+	for (const cookie of document.cookie.split(";")) {
+		const [key, value] = cookie.trim().split("=");
+		if (key === name) return value;
 	}
+	return "";
+}
+
+function saveTokens(data) {
+	jwt = data.token;
+	document.cookie = `jwt=${jwt};path=/;max-age=${data.expires_in}`;
+	document.cookie = `refresh=${data.refresh_token};path=/;max-age=${data.refresh_expires_in}`;
 }
 
+function clearTokens() {
+	jwt = "";
+	document.cookie = "jwt=;path=/;max-age=0";
+	document.cookie = "refresh=;path=/;max-age=0";
+}
+
+function loginTarget() {
+	const next = new URLSearchParams(location.search).get("next");
+	return next && next.startsWith("/") && !next.startsWith("//") ? next : "/dashboard";
+}
+
+// refreshSession trades the refresh token for new tokens. Requests that
+// fail at the same time share one refresh; when another tab refreshed with
+// the same token first, its tokens are picked up from the cookies.
+let refreshing = null;
+function refreshSession() {
+	if (!refreshing) {
+		refreshing = (async () => {
+			const before = getCookie("jwt");
+			const res = await fetch(`${apiBase}/refresh`, {
+				method: "POST",
+				headers: { "Content-Type": "application/json" },
+				body: JSON.stringify({ refresh_token: getCookie("refresh") }),
+			});
+			if (res.ok) {
+				saveTokens(await res.json());
+				return true;
+			}
+			if (res.status === 409) {
+				await new Promise((resolve) => setTimeout(resolve, 500));
+				jwt = getCookie("jwt");
+				return jwt !== "" && jwt !== before;
+			}
+			return false;
+		})().finally(() => {
+			refreshing = null;
+		});
+	}
+	return refreshing;
+}
+
+// authFetch is fetch with the access token, refreshing it when it has
+// expired. Without a session left it goes back to the login page.
+async function authFetch(url, options = {}) {
+	const send = () =>
+		fetch(url, {
+			...options,
+			headers: { ...options.headers, Authorization: "Bearer " + jwt },
+		});
+	let res = await send();
+	if (res.status === 401 && getCookie("refresh") && (await refreshSession())) {
+		res = await send();
+	}
+	if (res.status === 401) {
+		clearTokens();
+		location = "/login?next=" + encodeURIComponent(location.pathname);
+	}
+	return res;
+}
+
+// login logs in, or returns the challenge to pass to loginVerify along
+// with a code when the account has two-factor authentication.
 async function login(username, password) {
 	const res = await fetch(`${apiBase}/login`, {
 		method: "POST",
@@ -18,141 +84,261 @@ async function login(username, password) {
 		headers: { "Content-Type": "application/json" },
 	});
 	const data = await res.json();
+	if (data.challenge_token) return data.challenge_token;
 	if (data.token) {
-		jwt = data.token;
-		document.cookie = `jwt=${jwt};path=/;max-age=${60 * 60 * 24 * 30}`;
-		document.location = "/dashboard";
-	} else alert("Login failed");
+		saveTokens(data);
+		document.location = loginTarget();
+	} else alert(res.status === 403 ? data.error : "Login failed");
 }
 
-async function register(username, password) {
-	await fetch(`${apiBase}/register`, {
+async function loginVerify(challenge_token, code) {
+	const res = await fetch(`${apiBase}/login/verify`, {
 		method: "POST",
-		body: JSON.stringify({ username, password }),
+		body: JSON.stringify({ challenge_token, code }),
 		headers: { "Content-Type": "application/json" },
 	});
-	login(username, password);
+	const data = await res.json();
+	if (data.token) {
+		saveTokens(data);
+		document.location = loginTarget();
+	} else alert(data.error);
 }
 
-async function loadProjects() {
-	const res = await fetch(`${apiBase}/projects`, {
-		headers: { Authorization: "Bearer " + jwt },
+async function loadRegisterRules() {
+	const res = await fetch(`${apiBase}/register`);
+	return await res.json();
+}
+
+async function register(username, password, invite_code) {
+	const res = await fetch(`${apiBase}/register`, {
+		method: "POST",
+		body: JSON.stringify({ username, password, invite_code }),
+		headers: { "Content-Type": "application/json" },
 	});
+	if (res.status === 202) {
+		alert("Thanks for registering. You can log in once your account is approved.");
+		document.location = "/login";
+	} else if (res.ok) {
+		login(username, password);
+	} else {
+		alert((await res.json()).error);
+	}
+}
+
+async function loadProjects() {
+	const res = await authFetch(`${apiBase}/projects`);
 	const list = await res.json();
 	return list;
 }
 
 async function createProject(name) {
-	await fetch(`${apiBase}/projects`, {
+	await authFetch(`${apiBase}/projects`, {
 		method: "POST",
-		headers: {
-			"Content-Type": "application/json",
-			Authorization: "Bearer " + jwt,
-		},
+		headers: { "Content-Type": "application/json" },
 		body: JSON.stringify({ name }),
 	});
 }
 
 async function loadProject(currentProjectId) {
-	const res = await fetch(`${apiBase}/projects/${currentProjectId}`, {
-		headers: { Authorization: "Bearer " + jwt },
-	});
+	const res = await authFetch(`${apiBase}/projects/${currentProjectId}`);
 	const project = await res.json();
 	return project;
 }
 
 async function createTable(currentProjectId, name) {
-	await fetch(`${apiBase}/projects/${currentProjectId}/tables`, {
+	await authFetch(`${apiBase}/projects/${currentProjectId}/tables`, {
 		method: "POST",
-		headers: {
-			"Content-Type": "application/json",
-			Authorization: "Bearer " + jwt,
-		},
+		headers: { "Content-Type": "application/json" },
 		body: JSON.stringify({ name }),
 	});
 }
 
 async function newVar(currentProjectId, currentTableId, name, type) {
-	await fetch(
+	await authFetch(
 		`${apiBase}/projects/${currentProjectId}/tables/${currentTableId}/variables`,
 		{
 			method: "POST",
-			headers: {
-				"Content-Type": "application/json",
-				Authorization: "Bearer " + jwt,
-			},
+			headers: { "Content-Type": "application/json" },
 			body: JSON.stringify({ name, type, value: "" }),
 		},
 	);
 }
 
-async function setVariable(currentProjectId, currentTableId, type, name) {
-	await fetch(
+async function setVariable(
+	currentProjectId,
+	currentTableId,
+	type,
+	name,
+	options = {},
+) {
+	const res = await authFetch(
 		`${apiBase}/projects/${currentProjectId}/tables/${currentTableId}/variables/${name}`,
 		{
 			method: "PUT",
-			headers: {
-				"Content-Type": "application/json",
-				Authorization: "Bearer " + jwt,
-			},
-			body: JSON.stringify({ new_type: type }),
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify({ new_type: type, ...options }),
 		},
 	);
+	return await res.json();
 }
 
 async function deleteVariable(name, currentProjectId, currentTableId) {
-	await fetch(
+	await authFetch(
 		`${apiBase}/projects/${currentProjectId}/tables/${currentTableId}/variables/${name}`,
 		{
 			method: "DELETE",
-			headers: { Authorization: "Bearer " + jwt },
 		},
 	);
 }
 
 async function updateProject(currentProjectId, name) {
-	await fetch(`${apiBase}/projects/${currentProjectId}`, {
+	await authFetch(`${apiBase}/projects/${currentProjectId}`, {
 		method: "PUT",
-		headers: {
-			"Content-Type": "application/json",
-			Authorization: "Bearer " + jwt,
-		},
+		headers: { "Content-Type": "application/json" },
 		body: JSON.stringify({ name }),
 	});
 }
 
+async function rotateProjectToken(currentProjectId, gracePeriod) {
+	const res = await authFetch(
+		`${apiBase}/projects/${currentProjectId}/token/rotate`,
+		{
+			method: "POST",
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify({ grace_period: gracePeriod }),
+		},
+	);
+	return await res.json();
+}
+
 async function updateTableName(currentProjectId, currentTableId, name) {
-	await fetch(
+	await authFetch(
 		`${apiBase}/projects/${currentProjectId}/tables/${currentTableId}`,
 		{
 			method: "PUT",
-			headers: {
-				"Content-Type": "application/json",
-				Authorization: "Bearer " + jwt,
-			},
+			headers: { "Content-Type": "application/json" },
 			body: JSON.stringify({ name }),
 		},
 	);
 }
 
 async function deleteProject(currentProjectId) {
-	await fetch(`${apiBase}/projects/${currentProjectId}`, {
+	await authFetch(`${apiBase}/projects/${currentProjectId}`, {
 		method: "DELETE",
-		headers: { Authorization: "Bearer " + jwt },
 	});
 }
 
 async function deleteTable(currentProjectId, currentTableId) {
-	await fetch(
+	await authFetch(
 		`${apiBase}/projects/${currentProjectId}/tables/${currentTableId}`,
 		{
 			method: "DELETE",
-			headers: { Authorization: "Bearer " + jwt },
 		},
 	);
 }
 
-document.getElementById("logoutBtn").onclick = () => {
-	document.cookie = "jwt=;path=/;max-age=0";
+async function loadWebhooks(currentProjectId) {
+	const res = await authFetch(`${apiBase}/projects/${currentProjectId}/webhooks`);
+	return await res.json();
+}
+
+async function createWebhook(currentProjectId, url, tableId) {
+	const res = await authFetch(`${apiBase}/projects/${currentProjectId}/webhooks`, {
+		method: "POST",
+		headers: { "Content-Type": "application/json" },
+		body: JSON.stringify({ url, table_id: tableId }),
+	});
+	return await res.json();
+}
+
+async function deleteWebhook(currentProjectId, webhookId) {
+	await authFetch(`${apiBase}/projects/${currentProjectId}/webhooks/${webhookId}`, {
+		method: "DELETE",
+	});
+}
+
+async function loadWebhookDeliveries(currentProjectId, webhookId) {
+	const res = await authFetch(
+		`${apiBase}/projects/${currentProjectId}/webhooks/${webhookId}/deliveries`,
+	);
+	return await res.json();
+}
+
+async function loadTokens(currentProjectId) {
+	const res = await authFetch(`${apiBase}/projects/${currentProjectId}/tokens`);
+	return await res.json();
+}
+
+async function createToken(currentProjectId, name, scope, tables) {
+	const res = await authFetch(`${apiBase}/projects/${currentProjectId}/tokens`, {
+		method: "POST",
+		headers: { "Content-Type": "application/json" },
+		body: JSON.stringify({ name, scope, tables }),
+	});
+	return await res.json();
+}
+
+async function revokeToken(currentProjectId, tokenId) {
+	await authFetch(`${apiBase}/projects/${currentProjectId}/tokens/${tokenId}`, {
+		method: "DELETE",
+	});
+}
+
+async function verifyEmail(token) {
+	const res = await fetch(`${apiBase}/verify-email`, {
+		method: "POST",
+		headers: { "Content-Type": "application/json" },
+		body: JSON.stringify({ token }),
+	});
+	return res.status;
+}
+
+async function loadAccount() {
+	const res = await authFetch(`${apiBase}/account`);
+	return await res.json();
+}
+
+async function setupTwoFactor(password) {
+	return await authFetch(`${apiBase}/account/2fa/setup`, {
+		method: "POST",
+		headers: { "Content-Type": "application/json" },
+		body: JSON.stringify({ password }),
+	});
+}
+
+async function confirmTwoFactor(code) {
+	return await authFetch(`${apiBase}/account/2fa/confirm`, {
+		method: "POST",
+		headers: { "Content-Type": "application/json" },
+		body: JSON.stringify({ code }),
+	});
+}
+
+async function replaceRecoveryCodes(password) {
+	return await authFetch(`${apiBase}/account/2fa/recovery-codes`, {
+		method: "POST",
+		headers: { "Content-Type": "application/json" },
+		body: JSON.stringify({ password }),
+	});
+}
+
+async function disableTwoFactor(password, code) {
+	return await authFetch(`${apiBase}/account/2fa`, {
+		method: "DELETE",
+		headers: { "Content-Type": "application/json" },
+		body: JSON.stringify({ password, code }),
+	});
+}
+
+async function logout(everywhere) {
+	await authFetch(`${apiBase}/logout${everywhere ? "/all" : ""}`, {
+		method: "POST",
+	});
+	clearTokens();
 	location = "/";
-};
+}
+
+const logoutBtn = document.getElementById("logoutBtn");
+if (logoutBtn) logoutBtn.onclick = () => logout(false);
+const logoutAllBtn = document.getElementById("logoutAllBtn");
+if (logoutAllBtn) logoutAllBtn.onclick = () => logout(true);
@@ -1,14 +1,33 @@
+// a session that is still alive only needs new tokens
+if (getCookie("refresh")) {
+	refreshSession().then((ok) => {
+		if (ok) document.location = loginTarget();
+	});
+}
+
 const loginForm = document.getElementById("loginForm");
+const codeInput = document.getElementById("code");
+let challenge = null;
 
 loginForm.onsubmit = async (e) => {
 	e.preventDefault();
-	const username = document.getElementById("username").value;
-	const password = document.getElementById("password").value;
+	if (challenge) {
+		if (codeInput.value) loginVerify(challenge, codeInput.value);
+		return;
+	}
 
-	if (!username || !password) {
+	const username = document.getElementById("username");
+	const password = document.getElementById("password");
+	if (!username.value || !password.value) {
 		alert("Please enter username and password");
 		return;
 	}
 
-	login(username, password);
+	challenge = await login(username.value, password.value);
+	if (challenge) {
+		// the password was right; the code is all that is left to ask
+		username.hidden = password.hidden = true;
+		codeInput.hidden = false;
+		codeInput.focus();
+	}
 };
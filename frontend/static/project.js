@@ -19,9 +19,24 @@ document.getElementById("renameBtn").onclick = () => {
 	}
 };
 
+document.getElementById("rotateBtn").onclick = async () => {
+	const hours = prompt("Hours the old token keeps working:", "24");
+	if (hours === null) return;
+	const res = await rotateProjectToken(id, Math.round(Number(hours) * 3600));
+	if (res.error) {
+		alert(res.error);
+		return;
+	}
+	load();
+};
+
 function renderProject(project) {
 	document.getElementById("projectTitle").textContent = project.name;
 	document.getElementById("projectToken").textContent = project.token;
+	document.getElementById("previousToken").textContent =
+		project.previous_token_expires_at
+			? `The previous token works until ${new Date(project.previous_token_expires_at * 1000).toLocaleString()}`
+			: "";
 	const tables = project.tables || [];
 	renderTables(tables);
 }
@@ -125,7 +140,8 @@ function renderVars(vars, t) {
 		nameTd.textContent = v.name;
 		tr.appendChild(nameTd);
 		const typeTd = document.createElement("td");
-		typeTd.textContent = v.type;
+		typeTd.textContent =
+			v.type === "enum" ? `enum (${(v.options || []).join(" | ")})` : v.type;
 		tr.appendChild(typeTd);
 		const valueTd = document.createElement("td");
 		valueTd.textContent = v.value;
@@ -152,7 +168,12 @@ function renderVars(vars, t) {
 			select.innerHTML = `<option value="string">string</option>
                                 <option value="int">int</option>
                                 <option value="float">float</option>
-                                <option value="bool">boolean</option>`;
+                                <option value="bool">boolean</option>
+                                <option value="json">json</option>
+                                <option value="list">list</option>
+                                <option value="map">map</option>
+                                <option value="datetime">datetime</option>
+                                <option value="duration">duration</option>`;
 			typeTd.textContent = "";
 			typeTd.appendChild(select);
 
@@ -161,7 +182,22 @@ function renderVars(vars, t) {
 			saveBtn.textContent = "Save";
 			saveBtn.onclick = async () => {
 				const type = select.value;
-				await setVariable(id, t.id, type, v.name);
+				const preview = await setVariable(id, t.id, type, v.name, {
+					dry_run: true,
+				});
+				let res;
+				if (preview.error) {
+					if (
+						!confirm(
+							`${preview.error}\n\nReplace the value with the ${type} zero value?`,
+						)
+					)
+						return;
+					res = await setVariable(id, t.id, type, v.name, { force: true });
+				} else {
+					res = await setVariable(id, t.id, type, v.name);
+				}
+				if (res.error) alert(res.error);
 				load();
 			};
 			actionsTd.appendChild(saveBtn);
@@ -175,9 +211,185 @@ function renderVars(vars, t) {
 	return table;
 }
 
+function renderTokens(tokens, tables) {
+	const container = document.getElementById("tokensList");
+	container.innerHTML = "";
+
+	const newBtn = document.createElement("button");
+	newBtn.textContent = "+ New Token";
+	newBtn.style.backgroundColor = "var(--primary-color)";
+	newBtn.onclick = async () => {
+		const name = prompt("Token name:");
+		if (!name) return;
+		const scope = confirm("Allow writes? (Cancel for read-only)")
+			? "read_write"
+			: "read";
+		const tableNames = prompt(
+			"Comma separated table names (leave empty for all tables):",
+			"",
+		);
+		let tableIds = null;
+		if (tableNames) {
+			tableIds = [];
+			for (const tableName of tableNames.split(",")) {
+				const table = tables.find((t) => t.name === tableName.trim());
+				if (!table) {
+					alert(`No such table: ${tableName.trim()}`);
+					return;
+				}
+				tableIds.push(table.id);
+			}
+		}
+		const res = await createToken(id, name, scope, tableIds);
+		if (res.error) {
+			alert(res.error);
+			return;
+		}
+		prompt("Token (only shown once):", res.token);
+		load();
+	};
+	container.appendChild(newBtn);
+
+	tokens.forEach((token) => {
+		const div = document.createElement("div");
+		div.className = "item";
+		div.style.display = "flex";
+		div.style.justifyContent = "space-between";
+
+		const title = document.createElement("h3");
+		const names = token.tables
+			? token.tables
+					.map((tid) => (tables.find((t) => t.id === tid) || {}).name)
+					.filter(Boolean)
+					.join(", ")
+			: "all tables";
+		const lastUsed = token.last_used_at
+			? new Date(token.last_used_at * 1000).toLocaleString()
+			: "never";
+		title.textContent = `${token.name} (${token.read_only ? "read" : "read/write"}, ${names}, last used ${lastUsed})`;
+		div.appendChild(title);
+
+		const delBtn = document.createElement("button");
+		delBtn.textContent = "Revoke";
+		delBtn.style.backgroundColor = "var(--warning-color)";
+		delBtn.onclick = async () => {
+			if (confirm("Are you sure you want to revoke this token?")) {
+				await revokeToken(id, token.id);
+				load();
+			}
+		};
+		div.appendChild(delBtn);
+		container.appendChild(div);
+	});
+}
+
+function renderWebhooks(webhooks, tables) {
+	const container = document.getElementById("webhooksList");
+	container.innerHTML = "";
+
+	const newBtn = document.createElement("button");
+	newBtn.textContent = "+ New Webhook";
+	newBtn.style.backgroundColor = "var(--primary-color)";
+	newBtn.onclick = async () => {
+		const url = prompt("Webhook URL:", "https://");
+		if (!url) return;
+		const tableName = prompt("Table name (leave empty for all tables):", "");
+		const table = tables.find((t) => t.name === tableName);
+		if (tableName && !table) {
+			alert("No such table");
+			return;
+		}
+		const res = await createWebhook(id, url, table ? table.id : 0);
+		if (res.error) {
+			alert(res.error);
+			return;
+		}
+		prompt("Signing secret (only shown once):", res.secret);
+		load();
+	};
+	container.appendChild(newBtn);
+
+	webhooks.forEach((hook) => {
+		const div = document.createElement("div");
+		div.className = "item";
+
+		const header = document.createElement("div");
+		header.style.display = "flex";
+		header.style.justifyContent = "space-between";
+
+		const title = document.createElement("h3");
+		const table = tables.find((t) => t.id === hook.table_id);
+		title.textContent = `${hook.url} (${table ? table.name : "all tables"})`;
+		header.appendChild(title);
+
+		const actions = document.createElement("div");
+		const logBtn = document.createElement("button");
+		logBtn.textContent = "Deliveries";
+		logBtn.style.marginRight = "10px";
+		logBtn.onclick = async () => {
+			const deliveries = await loadWebhookDeliveries(id, hook.id);
+			div.querySelector("table")?.remove();
+			div.appendChild(renderDeliveries(deliveries));
+		};
+		actions.appendChild(logBtn);
+
+		const delBtn = document.createElement("button");
+		delBtn.textContent = "Delete Webhook";
+		delBtn.style.backgroundColor = "var(--warning-color)";
+		delBtn.onclick = async () => {
+			if (confirm("Are you sure you want to delete this webhook?")) {
+				await deleteWebhook(id, hook.id);
+				load();
+			}
+		};
+		actions.appendChild(delBtn);
+		header.appendChild(actions);
+
+		div.appendChild(header);
+		container.appendChild(div);
+	});
+}
+
+function renderDeliveries(deliveries) {
+	const table = document.createElement("table");
+	const thead = document.createElement("thead");
+	const tr = document.createElement("tr");
+	["Time", "Event", "Status", "Attempts", "Response", "Error"].forEach((h) => {
+		const th = document.createElement("th");
+		th.textContent = h;
+		tr.appendChild(th);
+	});
+	thead.appendChild(tr);
+	table.appendChild(thead);
+
+	const tbody = document.createElement("tbody");
+	deliveries.forEach((d) => {
+		const tr = document.createElement("tr");
+		[
+			new Date(d.created_at * 1000).toLocaleString(),
+			d.event,
+			d.status,
+			d.attempts,
+			d.response_code || "",
+			d.last_error,
+		].forEach((value) => {
+			const td = document.createElement("td");
+			td.textContent = value;
+			tr.appendChild(td);
+		});
+		tbody.appendChild(tr);
+	});
+	table.appendChild(tbody);
+	return table;
+}
+
 async function load() {
 	const project = await loadProject(id);
 	renderProject(project);
+	const tokens = (await loadTokens(id)) || [];
+	renderTokens(tokens, project.tables || []);
+	const webhooks = (await loadWebhooks(id)) || [];
+	renderWebhooks(webhooks, project.tables || []);
 }
 
 load();
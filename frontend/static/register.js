@@ -1,4 +1,11 @@
 const loginForm = document.getElementById("loginForm");
+const inviteCode = document.getElementById("inviteCode");
+
+loadRegisterRules().then((rules) => {
+	inviteCode.hidden = rules.registration !== "invite";
+	document.getElementById("password").placeholder =
+		`Password (at least ${rules.password_min_length} characters)`;
+});
 
 loginForm.onsubmit = async (e) => {
 	e.preventDefault();
@@ -10,5 +17,5 @@ loginForm.onsubmit = async (e) => {
 		return;
 	}
 
-	register(username, password);
+	register(username, password, inviteCode.value);
 };
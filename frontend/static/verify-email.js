@@ -0,0 +1,16 @@
+const status = document.getElementById("status");
+const token = new URLSearchParams(location.search).get("token");
+
+if (!token) {
+	status.textContent = "This link has no verification token.";
+} else {
+	verifyEmail(token).then((code) => {
+		if (code === 200) {
+			status.textContent = "Your email is verified.";
+		} else if (code === 409) {
+			status.textContent = "Another account has verified this email already.";
+		} else {
+			status.textContent = "This link is invalid or has expired.";
+		}
+	});
+}
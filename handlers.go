@@ -2,11 +2,16 @@ package main
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"time"
 
@@ -19,14 +24,6 @@ import (
 	"github.com/google/uuid"
 )
 
-// global JWT setup
-var tokenAuth *jwtauth.JWTAuth
-
-func init() {
-	// replace with a secure key from env in prod
-	tokenAuth = jwtauth.New("HS256", []byte("secret-signing-key"), nil)
-}
-
 type errorResp struct {
 	Error string `json:"error"`
 }
@@ -53,28 +50,100 @@ func writeJSON(w http.ResponseWriter, code int, v any) {
 	_, _ = w.Write(converted)
 }
 
+// writeJSONVerbatim writes v without writeJSON's key conversion. It's used
+// for responses carrying variable values, since the keys of json and map
+// values are the user's own.
+func writeJSONVerbatim(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeValidationErrors answers with every reason a value was rejected.
+func writeValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	writeJSON(w, http.StatusBadRequest, map[string]any{"error": errs.Error(), "errors": errs})
+}
+
 // --- Auth Handlers ---
 
-func Register(db *sql.DB) http.HandlerFunc {
+// Register creates a user as the policy allows. On servers that approve
+// registrations it answers 202, as the user can't log in yet.
+func Register(store Store, policy accountPolicy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
-			Username string `json:"username"`
-			Password string `json:"password"`
+			Username   string `json:"username"`
+			Password   string `json:"password"`
+			InviteCode string `json:"invite_code"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
 			return
 		}
-		hash, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-		if err := CreateUser(db, req.Username, string(hash)); err != nil {
+		if err := policy.checkUsername(req.Username); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		if err := policy.checkPassword(req.Username, req.Password); err != nil {
 			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
 			return
 		}
-		writeJSON(w, http.StatusCreated, map[string]string{"status": "ok"})
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+
+		errInvite := errors.New("invalid invite code")
+		err = store.Tx(func(tx Store) error {
+			if err := tx.CreateUser(req.Username, string(hash)); err != nil {
+				return err
+			}
+			userID, _, err := tx.GetUserByUsername(req.Username)
+			if err != nil {
+				return err
+			}
+			switch policy.registration {
+			case registrationInvite:
+				if err := tx.UseInvite(req.InviteCode, userID); err == ErrNotFound {
+					return errInvite
+				} else if err != nil {
+					return err
+				}
+			case registrationApproval:
+				return tx.SetUserApproved(userID, false)
+			}
+			return nil
+		})
+		switch {
+		case err == ErrExists:
+			writeJSON(w, http.StatusConflict, errorResp{"username taken"})
+		case err == errInvite:
+			writeJSON(w, http.StatusForbidden, errorResp{err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+		case policy.registration == registrationApproval:
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "awaiting approval"})
+		default:
+			writeJSON(w, http.StatusCreated, map[string]string{"status": "ok"})
+		}
+	}
+}
+
+// RegisterRules tells the register page what it has to ask for.
+func RegisterRules(policy accountPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"registration":         policy.registration,
+			"username_pattern":     policy.username.String(),
+			"password_min_length":  policy.minLength,
+			"password_min_classes": policy.minClasses,
+		})
 	}
 }
 
-func Login(db *sql.DB) http.HandlerFunc {
+// Login starts a dashboard session and answers with its tokens. Users with
+// two-factor authentication get a challenge token instead, for LoginVerify.
+func Login(store Store, tokens tokenIssuer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Username string `json:"username"`
@@ -84,7 +153,7 @@ func Login(db *sql.DB) http.HandlerFunc {
 			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
 			return
 		}
-		userID, pwHash, err := GetUserByUsername(db, req.Username)
+		userID, pwHash, err := store.GetUserByUsername(req.Username)
 		if err != nil {
 			writeJSON(w, http.StatusUnauthorized, errorResp{"invalid credentials"})
 			return
@@ -93,139 +162,46 @@ func Login(db *sql.DB) http.HandlerFunc {
 			writeJSON(w, http.StatusUnauthorized, errorResp{"invalid credentials"})
 			return
 		}
-		// create token
-		_, tokenString, _ := tokenAuth.Encode(map[string]any{
-			"user_id": userID,
-			"exp":     jwtauth.ExpireIn(time.Hour * 24 * 30),
-		})
-		writeJSON(w, http.StatusOK, map[string]string{"token": tokenString})
-	}
-}
-
-func ProjectAccess(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Token   string `json:"token"`
-			Action  string `json:"action"`
-			TableId int    `json:"table"`
-			VarName string `json:"variable"`
-			Value   any    `json:"value,omitempty"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+		user, err := store.GetUser(userID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
 		}
-		_, _, err := GetProjectByToken(db, req.Token)
-		if err != nil {
-			writeJSON(w, http.StatusUnauthorized, errorResp{"invalid project token"})
+		if !user.Approved {
+			writeJSON(w, http.StatusForbidden, errorResp{"account awaiting approval"})
 			return
 		}
-
-		switch req.Action {
-		case "get":
-			val, typ, err := GetVariable(db, req.TableId, req.VarName)
-			if err == ErrNotFound {
-				writeJSON(w, http.StatusNotFound, errorResp{"variable not found"})
-				return
-			} else if err != nil {
+		if user.TOTPEnabled {
+			challenge, err := tokens.signPurpose(userID, purposeLoginChallenge, loginChallengeTTL)
+			if err != nil {
 				writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 				return
 			}
-
-			var result any
-			switch typ {
-			case "string":
-				result = val
-			case "int":
-				i, err := strconv.Atoi(val)
-				if err != nil {
-					result = val
-				} else {
-					result = i
-				}
-			case "float":
-				f, err := strconv.ParseFloat(val, 64)
-				if err != nil {
-					result = val
-				} else {
-					result = f
-				}
-			case "bool":
-				b, err := strconv.ParseBool(val)
-				if err != nil {
-					result = val
-				} else {
-					result = b
-				}
-			}
-
 			writeJSON(w, http.StatusOK, map[string]any{
-				"value": result,
-				"type":  typ,
+				"two_factor_required": true,
+				"challenge_token":     challenge,
+				"expires_in":          int64(loginChallengeTTL / time.Second),
 			})
-
-		case "set":
-			// Make sure the value matches the type of the variable
-			variableType, err := GetVariableType(db, req.TableId, req.VarName)
-			if err != nil {
-				writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
-				return
-			}
-
-			result := fmt.Sprintf("%v", req.Value)
-
-			// try to convert the value to the type of the variable
-			switch variableType {
-			case "string":
-			case "int":
-				if _, ok := req.Value.(int); ok {
-					break
-				}
-
-				_, err := strconv.Atoi(result)
-				if err != nil {
-					writeJSON(w, http.StatusBadRequest, errorResp{"invalid value"})
-					return
-				}
-			case "float":
-				if _, ok := req.Value.(float64); ok {
-					break
-				}
-
-				_, err = strconv.ParseFloat(result, 64)
-				if err != nil {
-					writeJSON(w, http.StatusBadRequest, errorResp{"invalid value"})
-					return
-				}
-			case "bool":
-				if _, ok := req.Value.(bool); ok {
-					break
-				}
-
-				_, err := strconv.ParseBool(result)
-				if err != nil {
-					writeJSON(w, http.StatusBadRequest, errorResp{"invalid value"})
-					return
-				}
-			default:
-				writeJSON(w, http.StatusBadRequest, errorResp{"invalid variable type"})
-				return
-			}
-
-			if err := SetVariable(db, req.TableId, req.VarName, result); err != nil {
-				writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
-				return
-			}
-
-			writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
-
-		default:
-			writeJSON(w, http.StatusBadRequest, errorResp{"unknown action"})
+			return
 		}
+		answerWithSession(w, store, tokens, userID)
 	}
 }
 
-func ProjectCreate(db *sql.DB) http.HandlerFunc {
+// answerWithSession answers a login with the tokens of a new session.
+func answerWithSession(w http.ResponseWriter, store Store, tokens tokenIssuer, userID int) {
+	if err := store.DeleteExpiredSessions(time.Now().Unix()); err != nil {
+		log.Printf("sessions: %v", err)
+	}
+	resp, err := tokens.startSession(store, userID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func ProjectCreate(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Name string `json:"name"`
@@ -241,7 +217,7 @@ func ProjectCreate(db *sql.DB) http.HandlerFunc {
 
 		token := uuid.New().String()
 
-		pid, err := CreateProject(db, userID, req.Name, token)
+		pid, err := store.CreateProject(userID, req.Name, token)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
@@ -250,12 +226,12 @@ func ProjectCreate(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func ProjectList(db *sql.DB) http.HandlerFunc {
+func ProjectList(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the user ID from the JWT token
 		_, claims, _ := jwtauth.FromContext(r.Context())
 		userID := int(claims["user_id"].(float64))
-		projects, err := ListProjects(db, userID)
+		projects, err := store.ListProjects(userID)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
@@ -264,7 +240,7 @@ func ProjectList(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func ProjectRename(db *sql.DB) http.HandlerFunc {
+func ProjectRename(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Name string `json:"name"`
@@ -284,7 +260,7 @@ func ProjectRename(db *sql.DB) http.HandlerFunc {
 		_, claims, _ := jwtauth.FromContext(r.Context())
 		userID := int(claims["user_id"].(float64))
 
-		if err := RenameProject(db, projectId, req.Name, userID); err != nil {
+		if err := store.RenameProject(projectId, req.Name, userID); err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
 		}
@@ -292,7 +268,7 @@ func ProjectRename(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func ProjectDelete(db *sql.DB) http.HandlerFunc {
+func ProjectDelete(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the user ID from the JWT token
 		projectIdStr := chi.URLParam(r, "projectID")
@@ -303,7 +279,7 @@ func ProjectDelete(db *sql.DB) http.HandlerFunc {
 		_, claims, _ := jwtauth.FromContext(r.Context())
 		userID := int(claims["user_id"].(float64))
 
-		if err := DeleteProject(db, projectId, userID); err != nil {
+		if err := store.DeleteProject(projectId, userID); err != nil {
 
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
@@ -312,7 +288,7 @@ func ProjectDelete(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func TableCreate(db *sql.DB) http.HandlerFunc {
+func TableCreate(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Name string `json:"name"`
@@ -331,8 +307,14 @@ func TableCreate(db *sql.DB) http.HandlerFunc {
 			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
 		}
 
-		tid, err := CreateTable(db, projectId, req.Name, userID)
-		if err != nil {
+		tid, err := store.CreateTable(projectId, req.Name, userID)
+		if err == ErrNotFound {
+			writeJSON(w, http.StatusNotFound, errorResp{"project not found"})
+			return
+		} else if err == ErrExists {
+			writeJSON(w, http.StatusConflict, errorResp{"table already exists"})
+			return
+		} else if err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
 		}
@@ -340,7 +322,7 @@ func TableCreate(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func TableList(db *sql.DB) http.HandlerFunc {
+func TableList(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the user ID from the JWT token
 		_, claims, _ := jwtauth.FromContext(r.Context())
@@ -351,7 +333,7 @@ func TableList(db *sql.DB) http.HandlerFunc {
 			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
 		}
 
-		tables, err := ListTables(db, projectId, userID)
+		tables, err := store.ListTables(projectId, userID)
 
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
@@ -361,7 +343,7 @@ func TableList(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func TableRename(db *sql.DB) http.HandlerFunc {
+func TableRename(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Name string `json:"name"`
@@ -380,7 +362,10 @@ func TableRename(db *sql.DB) http.HandlerFunc {
 			writeJSON(w, http.StatusBadRequest, errorResp{"invalid table ID"})
 		}
 
-		if err := RenameTable(db, tableId, req.Name, userID); err != nil {
+		if err := store.RenameTable(tableId, req.Name, userID); err == ErrExists {
+			writeJSON(w, http.StatusConflict, errorResp{"table already exists"})
+			return
+		} else if err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
 		}
@@ -388,7 +373,7 @@ func TableRename(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func TableDelete(db *sql.DB) http.HandlerFunc {
+func TableDelete(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the user ID from the JWT token
 		_, claims, _ := jwtauth.FromContext(r.Context())
@@ -399,7 +384,7 @@ func TableDelete(db *sql.DB) http.HandlerFunc {
 			writeJSON(w, http.StatusBadRequest, errorResp{"invalid table ID"})
 		}
 
-		if err := DeleteTable(db, tableId, userID); err != nil {
+		if err := store.DeleteTable(tableId, userID); err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
 		}
@@ -407,7 +392,40 @@ func TableDelete(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func VariableList(db *sql.DB) http.HandlerFunc {
+// variableSnapshot returns an event carrying the current state of a
+// variable, for publishing changes made through the dashboard API.
+func variableSnapshot(store Store, tableID int, name string) (VariableEvent, bool) {
+	projectID, err := store.GetTableProjectID(tableID)
+	if err != nil {
+		return VariableEvent{}, false
+	}
+	val, typ, rev, err := store.GetVariable(tableID, name)
+	if err != nil {
+		return VariableEvent{}, false
+	}
+
+	return VariableEvent{
+		ProjectID: projectID,
+		TableID:   tableID,
+		Name:      name,
+		Type:      typ,
+		Value:     decodeValue(typ, val),
+		Revision:  rev,
+	}, true
+}
+
+// recordUserHistory stores the current version of a variable changed through
+// the JWT API. It belongs in the change's transaction, so that the change
+// fails with it.
+func recordUserHistory(store Store, tableID int, name string, userID int) error {
+	val, typ, rev, err := store.GetVariable(tableID, name)
+	if err != nil {
+		return err
+	}
+	return store.RecordVariableHistory(tableID, name, val, typ, rev, fmt.Sprintf("user:%d", userID))
+}
+
+func VariableList(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the user ID from the JWT token
 		_, claims, _ := jwtauth.FromContext(r.Context())
@@ -418,7 +436,7 @@ func VariableList(db *sql.DB) http.HandlerFunc {
 			writeJSON(w, http.StatusBadRequest, errorResp{"invalid table ID"})
 		}
 
-		variables, err := ListVariables(db, tableId, userID)
+		variables, err := store.ListVariables(tableId, userID)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
@@ -427,17 +445,27 @@ func VariableList(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func VariableCreate(db *sql.DB) http.HandlerFunc {
+func VariableCreate(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
-			Name  string `json:"name"`
-			Value string `json:"value"`
-			Type  string `json:"type"`
+			Name        string      `json:"name"`
+			Value       string      `json:"value"`
+			Type        string      `json:"type"`
+			Options     []string    `json:"options"`
+			Constraints Constraints `json:"constraints"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
 			return
 		}
+		if err := checkOptions(req.Type, req.Options); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		if err := req.Constraints.check(req.Type); err != nil {
+			writeValidationErrors(w, err.(ValidationErrors))
+			return
+		}
 
 		// Get the user ID from the JWT token
 		_, claims, _ := jwtauth.FromContext(r.Context())
@@ -448,15 +476,42 @@ func VariableCreate(db *sql.DB) http.HandlerFunc {
 			writeJSON(w, http.StatusBadRequest, errorResp{"invalid table ID"})
 		}
 
-		if err := CreateVariable(db, tableId, req.Name, req.Value, req.Type, userID); err != nil {
+		var ev VariableEvent
+		err = store.Tx(func(tx Store) error {
+			err := tx.CreateVariable(tableId, req.Name, req.Value, req.Type, req.Options, req.Constraints, userID)
+			if err != nil {
+				return err
+			}
+			if err := recordUserHistory(tx, tableId, req.Name, userID); err != nil {
+				return err
+			}
+			ev, _ = variableSnapshot(tx, tableId, req.Name)
+			ev.Kind = "create"
+			return enqueueWebhooks(tx, ev)
+		})
+		var invalid ValidationErrors
+		if errors.As(err, &invalid) {
+			writeValidationErrors(w, invalid)
+			return
+		} else if err == errInvalidType || err == errInvalidValue {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		} else if err == ErrExists {
+			writeJSON(w, http.StatusConflict, errorResp{"variable already exists"})
+			return
+		} else if err == ErrNotFound {
+			writeJSON(w, http.StatusNotFound, errorResp{"table not found"})
+			return
+		} else if err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
 		}
+		hub.Publish(ev)
 		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 	}
 }
 
-func VariableDelete(db *sql.DB) http.HandlerFunc {
+func VariableDelete(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the user ID from the JWT token
 		_, claims, _ := jwtauth.FromContext(r.Context())
@@ -468,7 +523,20 @@ func VariableDelete(db *sql.DB) http.HandlerFunc {
 		}
 		name := chi.URLParam(r, "name")
 
-		if err := DeleteVariable(db, tableId, name, userID); err != nil {
+		var ev VariableEvent
+		var existed bool
+		err = store.Tx(func(tx Store) error {
+			ev, existed = variableSnapshot(tx, tableId, name)
+			if err := tx.DeleteVariable(tableId, name, userID); err != nil || !existed {
+				return err
+			}
+			ev.Kind = "delete"
+			ev.OldValue, ev.Value = ev.Value, nil
+			return enqueueWebhooks(tx, ev)
+		})
+		if err == nil && existed {
+			hub.Publish(ev)
+		} else if err != nil && err != ErrNotFound {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
 		}
@@ -476,10 +544,19 @@ func VariableDelete(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func VariableUpdate(db *sql.DB) http.HandlerFunc {
+// VariableUpdate changes the type of a variable, converting its value. A
+// value that doesn't convert is an error unless a new value is given or
+// force falls back to the type's zero value. Constraints that don't apply
+// to the new type are dropped. With dry_run nothing is written and the
+// response tells what would have happened.
+func VariableUpdate(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
-			Type string `json:"new_type"`
+			Type    string   `json:"new_type"`
+			Value   *string  `json:"value"`
+			Options []string `json:"options"`
+			Force   bool     `json:"force"`
+			DryRun  bool     `json:"dry_run"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
@@ -493,18 +570,342 @@ func VariableUpdate(db *sql.DB) http.HandlerFunc {
 		tableId, err := strconv.Atoi(tableIdStr)
 		if err != nil {
 			writeJSON(w, http.StatusBadRequest, errorResp{"invalid table ID"})
+			return
 		}
 		name := chi.URLParam(r, "name")
 
-		if err := UpdateVariable(db, tableId, name, req.Type, userID); err != nil {
+		var ev VariableEvent
+		var body map[string]any
+		err = store.Tx(func(tx Store) error {
+			stored, _, err := tx.GetUserVariable(tableId, name, userID)
+			if err == ErrNotFound {
+				return &accessError{http.StatusNotFound, "variable not found", nil}
+			} else if err != nil {
+				return err
+			}
+			before, _ := variableSnapshot(tx, tableId, name)
+			options, constraints, err := tx.GetVariableRules(tableId, name)
+			if err != nil {
+				return err
+			}
+
+			// an enum keeps its options unless new ones are given
+			if req.Options != nil || req.Type != "enum" || before.Type != "enum" {
+				options = req.Options
+			}
+			if err := checkOptions(req.Type, options); err != nil {
+				return &accessError{http.StatusBadRequest, err.Error(), nil}
+			}
+			body = map[string]any{
+				"type":      req.Type,
+				"old_type":  before.Type,
+				"old_value": before.Value,
+			}
+			if constraints.check(req.Type) != nil {
+				constraints = Constraints{}
+				body["constraints_dropped"] = true
+			}
+			if req.DryRun {
+				body["dry_run"] = true
+			}
+			// a failed change still tells what it would have been
+			fail := func(err error) error {
+				var invalid ValidationErrors
+				if errors.As(err, &invalid) {
+					body["errors"] = invalid
+				}
+				return &accessError{http.StatusBadRequest, err.Error(), body}
+			}
+
+			var value, source string
+			switch {
+			case req.Value != nil:
+				source = "value"
+				value, err = convertValue("string", req.Type, options, *req.Value)
+				if err == errInvalidValue {
+					err = invalidValue(req.Type, options)
+				}
+			default:
+				source = "converted"
+				value, err = convertValue(before.Type, req.Type, options, stored)
+				if err == nil {
+					err = constraints.validate(req.Type, value)
+				}
+				if err != nil && err != errInvalidType && req.Force {
+					source = "force"
+					value, err = zeroValue(req.Type, options)
+				} else if err == errInvalidValue {
+					err = fmt.Errorf("cannot convert %q from %s to %s; send a new value or force", stored, before.Type, req.Type)
+				}
+			}
+			if err == nil && source != "converted" {
+				err = constraints.validate(req.Type, value)
+			}
+			if err != nil {
+				return fail(err)
+			}
+			body["value"] = decodeValue(req.Type, value)
+			body["source"] = source
+			if req.DryRun {
+				return nil
+			}
+
+			rev, err := tx.ChangeVariableType(tableId, name, req.Type, value, options, constraints, userID)
+			if err == ErrNotFound {
+				return &accessError{http.StatusNotFound, "variable not found", nil}
+			} else if err != nil {
+				return fail(err)
+			}
+			if err := recordUserHistory(tx, tableId, name, userID); err != nil {
+				return err
+			}
+
+			ev = before
+			ev.Kind = "update"
+			ev.OldType, ev.OldValue = before.Type, before.Value
+			ev.Type, ev.Value, ev.Revision = req.Type, body["value"], rev
+			return enqueueWebhooks(tx, ev)
+		})
+		if err != nil {
+			code, body := accessErrorBody(err)
+			writeJSONVerbatim(w, code, body)
+			return
+		}
+		if req.DryRun {
+			writeJSONVerbatim(w, http.StatusOK, body)
+			return
+		}
+
+		hub.Publish(ev)
+
+		body["status"] = "ok"
+		body["revision"] = ev.Revision
+		writeJSONVerbatim(w, http.StatusOK, body)
+	}
+}
+
+// maxHistoryPage caps the limit parameter of VariableHistory.
+const maxHistoryPage = 100
+
+func VariableHistory(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		tableId, err := strconv.Atoi(chi.URLParam(r, "tableID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid table ID"})
+			return
+		}
+		name := chi.URLParam(r, "name")
+
+		limit, offset := 20, 0
+		if s := r.URL.Query().Get("limit"); s != "" {
+			if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+				writeJSON(w, http.StatusBadRequest, errorResp{"invalid limit"})
+				return
+			}
+			limit = min(limit, maxHistoryPage)
+		}
+		if s := r.URL.Query().Get("offset"); s != "" {
+			if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+				writeJSON(w, http.StatusBadRequest, errorResp{"invalid offset"})
+				return
+			}
+		}
+
+		entries, total, err := store.ListVariableHistory(tableId, name, userID, limit, offset)
+		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
 		}
+		writeJSON(w, http.StatusOK, map[string]any{"entries": entries, "total": total})
+	}
+}
+
+// VariableRollback restores the value and type of a history entry. The
+// restore is a change of its own, so it gets a new revision and history entry.
+// The value has to pass the variable's options and constraints as if it
+// were set now; constraints that don't apply to the restored type are
+// dropped, as VariableUpdate does.
+func VariableRollback(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			HistoryID int `json:"history_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		tableId, err := strconv.Atoi(chi.URLParam(r, "tableID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid table ID"})
+			return
+		}
+		name := chi.URLParam(r, "name")
+
+		var ev VariableEvent
+		err = store.Tx(func(tx Store) error {
+			entry, err := tx.GetHistoryEntry(req.HistoryID, tableId, name, userID)
+			if err == ErrNotFound {
+				return &accessError{http.StatusNotFound, "history entry not found", nil}
+			} else if err != nil {
+				return err
+			}
+			before, ok := variableSnapshot(tx, tableId, name)
+			if !ok {
+				return &accessError{http.StatusNotFound, "variable not found", nil}
+			}
+			options, constraints, err := tx.GetVariableRules(tableId, name)
+			if err != nil {
+				return err
+			}
+			if entry.Type != "enum" {
+				options = nil
+			}
+			if err := checkOptions(entry.Type, options); err != nil {
+				return &accessError{http.StatusBadRequest, err.Error(), nil}
+			}
+			if constraints.check(entry.Type) != nil {
+				constraints = Constraints{}
+			}
+			value, err := encodeValue(entry.Type, options, decodeValue(entry.Type, entry.Value))
+			if err == errInvalidValue {
+				err = invalidValue(entry.Type, options)
+			}
+			if err == nil {
+				err = constraints.validate(entry.Type, value)
+			}
+			var invalid ValidationErrors
+			if errors.As(err, &invalid) {
+				return validationFailed(invalid)
+			} else if err != nil {
+				return &accessError{http.StatusBadRequest, err.Error(), nil}
+			}
+
+			rev, err := tx.ChangeVariableType(tableId, name, entry.Type, value, options, constraints, userID)
+			if err != nil {
+				return err
+			}
+			if err := tx.RecordVariableHistory(tableId, name, value, entry.Type, rev, fmt.Sprintf("user:%d", userID)); err != nil {
+				return err
+			}
+
+			ev = before
+			ev.Kind = "set"
+			ev.Type, ev.Value, ev.Revision = entry.Type, decodeValue(entry.Type, value), rev
+			ev.OldValue = before.Value
+			ev.OldType = ""
+			if before.Type != entry.Type {
+				ev.Kind = "update"
+				ev.OldType = before.Type
+			}
+			return enqueueWebhooks(tx, ev)
+		})
+		if err != nil {
+			code, body := accessErrorBody(err)
+			writeJSONVerbatim(w, code, body)
+			return
+		}
+
+		hub.Publish(ev)
+
+		writeJSONVerbatim(w, http.StatusOK, map[string]any{
+			"value":    ev.Value,
+			"type":     ev.Type,
+			"revision": ev.Revision,
+		})
+	}
+}
+
+// VariableConstraints replaces the constraints of a variable. They have to
+// fit its type, and its current value has to satisfy them.
+func VariableConstraints(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Constraints
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		tableId, err := strconv.Atoi(chi.URLParam(r, "tableID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid table ID"})
+			return
+		}
+		name := chi.URLParam(r, "name")
+
+		err = store.Tx(func(tx Store) error {
+			val, typ, err := tx.GetUserVariable(tableId, name, userID)
+			if err == ErrNotFound {
+				return &accessError{http.StatusNotFound, "variable not found", nil}
+			} else if err != nil {
+				return err
+			}
+			if err := req.check(typ); err != nil {
+				return validationFailed(err.(ValidationErrors))
+			}
+			if err := req.validate(typ, val); err != nil {
+				return validationFailed(err.(ValidationErrors))
+			}
+			if err := tx.SetVariableConstraints(tableId, name, req, userID); err == ErrNotFound {
+				return &accessError{http.StatusNotFound, "variable not found", nil}
+			} else if err != nil {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			code, body := accessErrorBody(err)
+			writeJSONVerbatim(w, code, body)
+			return
+		}
 		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 	}
 }
 
-func ProjectLoad(db *sql.DB) http.HandlerFunc {
+// ProjectHistoryRetention sets how many versions are kept per variable of a
+// project; 0 turns history off.
+func ProjectHistoryRetention(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Retention *int `json:"retention"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		if req.Retention == nil || *req.Retention < 0 {
+			writeJSON(w, http.StatusBadRequest, errorResp{"retention must be a number of versions, 0 or more"})
+			return
+		}
+
+		projectId, err := strconv.Atoi(chi.URLParam(r, "projectID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
+			return
+		}
+
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+
+		if err := store.SetHistoryRetention(projectId, *req.Retention, userID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+func ProjectLoad(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		projectIdStr := chi.URLParam(r, "projectID")
 		projectId, err := strconv.Atoi(projectIdStr)
@@ -516,7 +917,7 @@ func ProjectLoad(db *sql.DB) http.HandlerFunc {
 		_, claims, _ := jwtauth.FromContext(r.Context())
 		userID := int(claims["user_id"].(float64))
 
-		project, err := GetProject(db, projectId, userID)
+		project, err := store.GetProject(projectId, userID)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
 			return
@@ -526,9 +927,321 @@ func ProjectLoad(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func MountAPIRoutes(r chi.Router, db *sql.DB) {
+func WebhookCreate(store Store, allowPrivate bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			URL     string `json:"url"`
+			TableID int    `json:"table_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid webhook URL"})
+			return
+		}
+		if !allowPrivate {
+			if err := checkWebhookHost(r.Context(), u.Hostname()); err == errPrivateAddress {
+				writeJSON(w, http.StatusBadRequest, errorResp{"webhook URL must point to a public address"})
+				return
+			} else if err != nil {
+				writeJSON(w, http.StatusBadRequest, errorResp{"webhook host could not be resolved"})
+				return
+			}
+		}
+
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		projectIdStr := chi.URLParam(r, "projectID")
+		projectId, err := strconv.Atoi(projectIdStr)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
+			return
+		}
+
+		if req.TableID != 0 {
+			if tableProject, err := store.GetTableProjectID(req.TableID); err != nil || tableProject != projectId {
+				writeJSON(w, http.StatusBadRequest, errorResp{"invalid table ID"})
+				return
+			}
+		}
+
+		secret := newWebhookSecret()
+		id, err := store.CreateWebhook(projectId, req.TableID, req.URL, secret, userID)
+		if err == ErrNotFound {
+			writeJSON(w, http.StatusNotFound, errorResp{"project not found"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		// the secret is only ever shown here
+		writeJSON(w, http.StatusCreated, map[string]any{"webhook_id": id, "secret": secret})
+	}
+}
+
+func WebhookList(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		projectIdStr := chi.URLParam(r, "projectID")
+		projectId, err := strconv.Atoi(projectIdStr)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
+			return
+		}
+
+		webhooks, err := store.ListWebhooks(projectId, userID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, webhooks)
+	}
+}
+
+func WebhookDelete(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		projectId, err := strconv.Atoi(chi.URLParam(r, "projectID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
+			return
+		}
+		webhookId, err := strconv.Atoi(chi.URLParam(r, "webhookID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid webhook ID"})
+			return
+		}
+
+		if err := store.DeleteWebhook(webhookId, projectId, userID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+func WebhookDeliveries(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		projectId, err := strconv.Atoi(chi.URLParam(r, "projectID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
+			return
+		}
+		webhookId, err := strconv.Atoi(chi.URLParam(r, "webhookID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid webhook ID"})
+			return
+		}
+
+		webhooks, err := store.ListWebhooks(projectId, userID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		if !slices.ContainsFunc(webhooks, func(h Webhook) bool { return h.ID == webhookId }) {
+			writeJSON(w, http.StatusNotFound, errorResp{"webhook not found"})
+			return
+		}
+
+		deliveries, err := store.ListWebhookDeliveries(webhookId, userID, 50)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, deliveries)
+	}
+}
+
+const (
+	// defaultTokenGrace is how long a rotated project token keeps working
+	// when no grace period is given.
+	defaultTokenGrace = 24 * time.Hour
+	maxTokenGrace     = 30 * 24 * time.Hour
+)
+
+// ProjectTokenRotate issues a new project token. The old one stays valid for
+// grace_period seconds, during which responses to it carry a Deprecation
+// header.
+func ProjectTokenRotate(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			GracePeriod *int64 `json:"grace_period"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		grace := defaultTokenGrace
+		if req.GracePeriod != nil {
+			grace = time.Duration(*req.GracePeriod) * time.Second
+			if grace < 0 || grace > maxTokenGrace {
+				writeJSON(w, http.StatusBadRequest, errorResp{fmt.Sprintf("grace_period must be between 0 and %d seconds", int(maxTokenGrace.Seconds()))})
+				return
+			}
+		}
+
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		projectId, err := strconv.Atoi(chi.URLParam(r, "projectID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
+			return
+		}
+
+		token := uuid.New().String()
+		graceUntil := time.Now().Add(grace).Unix()
+		if err := store.RotateProjectToken(projectId, token, graceUntil, userID); err == ErrNotFound {
+			writeJSON(w, http.StatusNotFound, errorResp{"project not found"})
+			return
+		} else if err == ErrTokenInGrace {
+			writeJSON(w, http.StatusConflict, errorResp{"the previous token is still in its grace period; rotate with grace_period 0 to end it now"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"token":                     token,
+			"previous_token_expires_at": graceUntil,
+		})
+	}
+}
+
+func ProjectTokenCreate(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name      string `json:"name"`
+			Scope     string `json:"scope"`
+			Tables    []int  `json:"tables"`
+			ExpiresAt *int64 `json:"expires_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		if req.Name == "" {
+			writeJSON(w, http.StatusBadRequest, errorResp{"name is required"})
+			return
+		}
+		if req.Scope != "read" && req.Scope != "read_write" {
+			writeJSON(w, http.StatusBadRequest, errorResp{`scope must be "read" or "read_write"`})
+			return
+		}
+		if req.ExpiresAt != nil && *req.ExpiresAt <= time.Now().Unix() {
+			writeJSON(w, http.StatusBadRequest, errorResp{"expires_at must be in the future"})
+			return
+		}
+
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		projectId, err := strconv.Atoi(chi.URLParam(r, "projectID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
+			return
+		}
+
+		for _, tableID := range req.Tables {
+			if tableProject, err := store.GetTableProjectID(tableID); err != nil || tableProject != projectId {
+				writeJSON(w, http.StatusBadRequest, errorResp{"invalid table ID"})
+				return
+			}
+		}
+
+		token := uuid.New().String()
+		id, err := store.CreateProjectToken(ProjectToken{
+			ProjectID: projectId,
+			Name:      req.Name,
+			ReadOnly:  req.Scope == "read",
+			Tables:    req.Tables,
+			ExpiresAt: req.ExpiresAt,
+		}, token, userID)
+		if err == ErrNotFound {
+			writeJSON(w, http.StatusNotFound, errorResp{"project not found"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		// only a hash is stored, so the token is only ever shown here
+		writeJSON(w, http.StatusCreated, map[string]any{"token_id": id, "token": token})
+	}
+}
+
+func ProjectTokenList(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		projectId, err := strconv.Atoi(chi.URLParam(r, "projectID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
+			return
+		}
+
+		tokens, err := store.ListProjectTokens(projectId, userID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, tokens)
+	}
+}
+
+func ProjectTokenRevoke(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the JWT token
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		projectId, err := strconv.Atoi(chi.URLParam(r, "projectID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid project ID"})
+			return
+		}
+		tokenId, err := strconv.Atoi(chi.URLParam(r, "tokenID"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{"invalid token ID"})
+			return
+		}
+
+		if err := store.RevokeProjectToken(tokenId, projectId, userID); err == ErrNotFound {
+			writeJSON(w, http.StatusNotFound, errorResp{"token not found"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// MountAPIRoutes serves the API and the dashboard as cfg sets them up.
+// Account emails go through mailer.
+func MountAPIRoutes(r chi.Router, store Store, cfg Config, mailer Mailer) {
+	tokenAuth := jwtauth.New("HS256", []byte(cfg.JWTSecret), nil)
+	tokens := tokenIssuer{tokenAuth, cfg.TokenTTL, cfg.SessionTTL}
+	policy := newAccountPolicy(cfg)
+	attempts := newAttemptLimiter(twoFactorAttempts, twoFactorWindow)
+	frontend := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, filepath.Join(cfg.FrontendDir, name))
+		}
+	}
+
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"},
+		AllowedOrigins:   cfg.CORSOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
@@ -537,37 +1250,81 @@ func MountAPIRoutes(r chi.Router, db *sql.DB) {
 
 	// Public API routes
 	r.Route("/api", func(r chi.Router) {
-		r.Post("/register", Register(db))
-		r.Post("/login", Login(db))
-		r.Post("/access", ProjectAccess(db))
+		r.Get("/register", RegisterRules(policy))
+		r.Post("/register", Register(store, policy))
+		r.Post("/login", Login(store, tokens))
+		r.Post("/login/verify", LoginVerify(store, tokens, attempts))
+		r.Post("/refresh", Refresh(store, tokens))
+		r.Post("/verify-email", AccountEmailVerify(store))
+		r.Post("/access", ProjectAccess(store))
+		r.Get("/access/stream", ProjectAccessStream(store))
+		r.Get("/access/ws", ProjectAccessSocket(store))
 
 		// JWT‑protected subrouter:
 		r.Group(func(r chi.Router) {
 			r.Use(jwtauth.Verifier(tokenAuth))
 			r.Use(jwtauth.Authenticator(tokenAuth))
+			r.Use(RequireSession(store))
 
 			r.Use(render.SetContentType(render.ContentTypeJSON))
+			r.Post("/logout", Logout(store))
+			r.Post("/logout/all", LogoutAll(store))
+			r.Route("/account", func(r chi.Router) {
+				r.Get("/", AccountLoad(store))
+				r.Put("/password", AccountPassword(store, tokens, policy))
+				r.Put("/username", AccountRename(store, policy))
+				r.Put("/email", AccountEmail(store, mailer, cfg.PublicURL))
+				r.Post("/email/resend", AccountEmailResend(store, mailer, cfg.PublicURL))
+				r.Post("/delete", AccountDeleteRequest(store, tokens))
+				r.Delete("/", AccountDelete(store, tokens))
+				r.Route("/2fa", func(r chi.Router) {
+					r.Post("/setup", AccountTOTPSetup(store))
+					r.Post("/confirm", AccountTOTPConfirm(store, attempts))
+					r.Post("/recovery-codes", AccountRecoveryCodes(store))
+					r.Delete("/", AccountTOTPDisable(store, attempts))
+				})
+			})
 			r.Route("/projects", func(r chi.Router) {
-				r.Post("/", ProjectCreate(db))
-				r.Get("/", ProjectList(db))
+				r.Post("/", ProjectCreate(store))
+				r.Get("/", ProjectList(store))
 				r.Route("/{projectID}", func(r chi.Router) {
-					r.Get("/", ProjectLoad(db))
-					r.Put("/", ProjectRename(db))
-					r.Delete("/", ProjectDelete(db))
+					r.Get("/", ProjectLoad(store))
+					r.Put("/", ProjectRename(store))
+					r.Delete("/", ProjectDelete(store))
+					r.Put("/history", ProjectHistoryRetention(store))
+
+					r.Post("/token/rotate", ProjectTokenRotate(store))
+					r.Route("/tokens", func(r chi.Router) {
+						r.Post("/", ProjectTokenCreate(store))
+						r.Get("/", ProjectTokenList(store))
+						r.Delete("/{tokenID}", ProjectTokenRevoke(store))
+					})
+
+					r.Route("/webhooks", func(r chi.Router) {
+						r.Post("/", WebhookCreate(store, cfg.WebhookAllowPrivate))
+						r.Get("/", WebhookList(store))
+						r.Route("/{webhookID}", func(r chi.Router) {
+							r.Delete("/", WebhookDelete(store))
+							r.Get("/deliveries", WebhookDeliveries(store))
+						})
+					})
 
 					r.Route("/tables", func(r chi.Router) {
-						r.Post("/", TableCreate(db))
-						r.Get("/", TableList(db))
+						r.Post("/", TableCreate(store))
+						r.Get("/", TableList(store))
 						r.Route("/{tableID}", func(r chi.Router) {
-							r.Put("/", TableRename(db))
-							r.Delete("/", TableDelete(db))
+							r.Put("/", TableRename(store))
+							r.Delete("/", TableDelete(store))
 
 							r.Route("/variables", func(r chi.Router) {
-								r.Post("/", VariableCreate(db))
-								r.Get("/", VariableList(db))
+								r.Post("/", VariableCreate(store))
+								r.Get("/", VariableList(store))
 								r.Route("/{name}", func(r chi.Router) {
-									r.Put("/", VariableUpdate(db))
-									r.Delete("/", VariableDelete(db))
+									r.Put("/", VariableUpdate(store))
+									r.Delete("/", VariableDelete(store))
+									r.Get("/history", VariableHistory(store))
+									r.Post("/rollback", VariableRollback(store))
+									r.Put("/constraints", VariableConstraints(store))
 								})
 							})
 						})
@@ -578,34 +1335,21 @@ func MountAPIRoutes(r chi.Router, db *sql.DB) {
 	})
 
 	// Frontend routes
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "frontend/index.html")
-	})
-
-	r.Get("/docs", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "frontend/docs.html")
-	})
-
-	r.Get("/login", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "frontend/login.html")
-	})
-
-	r.Get("/register", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "frontend/register.html")
-	})
+	r.Get("/", frontend("index.html"))
+	r.Get("/docs", frontend("docs.html"))
+	r.Get("/login", frontend("login.html"))
+	r.Get("/register", frontend("register.html"))
+	r.Get("/verify-email", frontend("verify-email.html"))
 
 	r.Group(func(r chi.Router) {
 		r.Use(jwtauth.Verifier(tokenAuth))
-		r.Use(jwtauth.Authenticator(tokenAuth))
-		r.Get("/dashboard", func(w http.ResponseWriter, r *http.Request) {
-			http.ServeFile(w, r, "frontend/dashboard.html")
-		})
+		r.Use(requirePageSession(store))
+		r.Get("/dashboard", frontend("dashboard.html"))
 		r.Route("/project/{projectID}", func(r chi.Router) {
-			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-				http.ServeFile(w, r, "frontend/project.html")
-			})
+			r.Get("/", frontend("project.html"))
 		})
 	})
 
-	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.Dir("frontend/static"))))
+	static := http.Dir(filepath.Join(cfg.FrontendDir, "static"))
+	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(static)))
 }
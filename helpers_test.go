@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// forEachStore runs fn as a subtest with an empty store of each kind.
+func forEachStore(t *testing.T, fn func(t *testing.T, store Store)) {
+	for backend, open := range storeBackends {
+		t.Run(backend, func(t *testing.T) {
+			fn(t, open(t))
+		})
+	}
+}
+
+// testAPI is the API served over a store for the length of a test.
+type testAPI struct {
+	t   *testing.T
+	URL string
+}
+
+func newTestAPI(t *testing.T, store Store, cfg Config, mailer Mailer) *testAPI {
+	router := chi.NewRouter()
+	MountAPIRoutes(router, store, cfg, mailer)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return &testAPI{t: t, URL: server.URL}
+}
+
+// send makes a request and returns its status code. A string body is sent
+// as it is and anything else but nil as JSON; token, when set, is sent as
+// the bearer token; and the response is decoded into out unless it's nil.
+func (a *testAPI) send(method, path, token string, body, out any) int {
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r = strings.NewReader(b)
+	default:
+		data, _ := json.Marshal(b)
+		r = bytes.NewReader(data)
+	}
+	req, _ := http.NewRequest(method, a.URL+path, r)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(a.t, err) {
+		return 0
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it
+// is dropped.
+const subscriberBuffer = 64
+
+var (
+	// errSubscriberBehind ends a subscription whose buffer was full.
+	errSubscriberBehind = errors.New("too many events were not read in time")
+	// errHubClosed ends the subscriptions of a server shutting down.
+	errHubClosed = errors.New("server shutting down")
+)
+
+// VariableEvent describes a change to a variable. Kind is one of "create",
+// "update", "set" or "delete". OldType is only set when the type changed.
+type VariableEvent struct {
+	Kind      string `json:"kind"`
+	ProjectID int    `json:"project_id"`
+	TableID   int    `json:"table_id"`
+	Name      string `json:"variable"`
+	Type      string `json:"type,omitempty"`
+	Value     any    `json:"value"`
+	OldType   string `json:"old_type,omitempty"`
+	OldValue  any    `json:"old_value"`
+	Revision  int    `json:"revision"`
+}
+
+// Subscription receives the events of one project, or of a single table when
+// TableID is set. C is closed when the subscription ends.
+type Subscription struct {
+	ProjectID int
+	TableID   int
+	C         chan VariableEvent
+
+	// Err is why the hub ended the subscription, errSubscriberBehind or
+	// errHubClosed, and nil if it was unsubscribed. It's set before C is
+	// closed.
+	Err error
+}
+
+func (s *Subscription) matches(ev VariableEvent) bool {
+	return ev.ProjectID == s.ProjectID && (s.TableID == 0 || ev.TableID == s.TableID)
+}
+
+// Hub is an in-process pub/sub for variable changes. Events don't go
+// through the database, so servers sharing a Postgres database don't see
+// each other's changes; streams, sockets and webhooks need a single server.
+type Hub struct {
+	mu        sync.Mutex
+	subs      map[*Subscription]struct{}
+	listeners map[int]func(VariableEvent)
+	nextID    int
+	closed    bool
+}
+
+// hub receives the changes of every write path.
+var hub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{
+		subs:      map[*Subscription]struct{}{},
+		listeners: map[int]func(VariableEvent){},
+	}
+}
+
+// Listen registers fn to be called synchronously with every published event
+// of every project. Events are published once their change has committed,
+// which is when the webhook dispatcher is woken. The returned func removes
+// the listener.
+func (h *Hub) Listen(fn func(VariableEvent)) (cancel func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := h.nextID
+	h.nextID++
+	h.listeners[id] = fn
+	return func() {
+		h.mu.Lock()
+		delete(h.listeners, id)
+		h.mu.Unlock()
+	}
+}
+
+func (h *Hub) Subscribe(projectID, tableID int) *Subscription {
+	s := &Subscription{
+		ProjectID: projectID,
+		TableID:   tableID,
+		C:         make(chan VariableEvent, subscriberBuffer),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		s.Err = errHubClosed
+		close(s.C)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+// CloseSubscriptions ends every subscription, and those made later right
+// away, so that streams finish when the server shuts down. Listeners are
+// unaffected.
+func (h *Hub) CloseSubscriptions() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		delete(h.subs, s)
+		s.Err = errHubClosed
+		close(s.C)
+	}
+}
+
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.C)
+	}
+}
+
+// Publish delivers ev to every matching subscriber without blocking, then
+// calls the listeners. Subscribers whose buffer is full are dropped so a slow
+// reader can't hold up writers; their channel is closed and they have to
+// resubscribe.
+func (h *Hub) Publish(ev VariableEvent) {
+	h.mu.Lock()
+	listeners := make([]func(VariableEvent), 0, len(h.listeners))
+	for _, fn := range h.listeners {
+		listeners = append(listeners, fn)
+	}
+	h.publishLocked(ev)
+	h.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(ev)
+	}
+}
+
+func (h *Hub) publishLocked(ev VariableEvent) {
+	for s := range h.subs {
+		if !s.matches(ev) {
+			continue
+		}
+		select {
+		case s.C <- ev:
+		default:
+			delete(h.subs, s)
+			s.Err = errSubscriberBehind
+			close(s.C)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import "log"
+
+// Mailer sends the emails of account management, such as the link that
+// verifies an address.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// LogMailer is a Mailer that only logs what it would send, for servers that
+// have no way to send email.
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
@@ -1,19 +1,243 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
 
 func main() {
-	db := InitDB("app.db")
-	defer db.Close()
+	cfg, args, err := LoadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			os.Exit(runMigrate(args[1:], cfg))
+		case "invite":
+			os.Exit(runInvite(args[1:], cfg))
+		case "users":
+			os.Exit(runUsers(args[1:], cfg))
+		}
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		os.Exit(2)
+	}
+	if err := errors.Join(cfg.checkSigningKey(), cfg.checkFrontendDir()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	os.Exit(runServer(cfg))
+}
+
+// runServer serves until SIGINT or SIGTERM, then lets requests in flight
+// finish before closing the database.
+func runServer(cfg Config) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// a second signal stops right away
+		<-ctx.Done()
+		stop()
+	}()
+
+	store, closeStore := openStore(cfg)
+	defer closeStore()
+
+	webhooks := NewWebhookDispatcher(store)
+	webhooks.AllowPrivate = cfg.WebhookAllowPrivate
+	hub.Listen(webhooks.Notify)
+	webhooksCtx, stopWebhooks := context.WithCancel(context.Background())
+	webhooksDone := make(chan struct{})
+	go func() {
+		webhooks.Run(webhooksCtx)
+		close(webhooksDone)
+	}()
+	defer func() {
+		stopWebhooks()
+		<-webhooksDone
+	}()
 
 	r := chi.NewRouter()
-	MountAPIRoutes(r, db)
+	MountAPIRoutes(r, store, cfg, LogMailer{})
+
+	srv, err := newServer(cfg, r)
+	if err != nil {
+		log.Printf("failed to set up the server: %v", err)
+		return 1
+	}
+	scheme := "http"
+	if srv.TLSConfig != nil {
+		scheme = "https"
+	}
+	log.Printf("listening on %s://%s", scheme, cfg.Addr)
+	if err := serve(ctx, srv, cfg.ShutdownTimeout); err != nil {
+		log.Printf("server: %v", err)
+		return 1
+	}
+	log.Println("stopped")
+	return 0
+}
+
+// openStore opens the store cfg points at, migrating it if need be.
+func openStore(cfg Config) (Store, func() error) {
+	switch {
+	case cfg.Memory:
+		return NewMemoryStore(), func() error { return nil }
+	case cfg.Postgres != "":
+		db := InitPostgres(cfg.Postgres)
+		return NewPostgresStore(db), db.Close
+	default:
+		db := InitDB(cfg.DB)
+		return NewSQLStore(db), db.Close
+	}
+}
+
+// runMigrate implements "migrate", which brings the database up to date,
+// and "migrate status", which lists the migrations without applying any.
+// They work on the database cfg points at.
+func runMigrate(args []string, cfg Config) int {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "status" && args[0] != "up") {
+		fmt.Fprintln(os.Stderr, "usage: reduser [flags] migrate [up|status]")
+		return 2
+	}
+	if cfg.Memory {
+		fmt.Fprintln(os.Stderr, "an in-memory database has nothing to migrate")
+		return 2
+	}
+
+	initDB, openDB, statusesOf, steps, target := InitDB, OpenDB, MigrationStatuses, migrations, cfg.DB
+	if cfg.Postgres != "" {
+		initDB, openDB, statusesOf, steps, target = InitPostgres, OpenPostgres, PostgresMigrationStatuses, pgMigrations, cfg.Postgres
+	}
+
+	if len(args) == 0 || args[0] == "up" {
+		db := initDB(target)
+		defer db.Close()
+		log.Printf("database is at schema version %d", len(steps))
+		return 0
+	}
+
+	db := openDB(target)
+	defer db.Close()
+	statuses, err := statusesOf(db)
+	if err != nil {
+		log.Printf("failed to read migrations: %v", err)
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, s := range statuses {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = time.Unix(*s.AppliedAt, 0).Format(time.RFC3339)
+		}
+		if s.Version > len(steps) {
+			applied += " (newer than this binary)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	w.Flush()
+	return 0
+}
+
+// runInvite implements "invite", which prints a new invite code for
+// servers where registering takes one.
+func runInvite(args []string, cfg Config) int {
+	fs := flag.NewFlagSet("invite", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 7*24*time.Hour, "how long the code works")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: reduser [flags] invite [-ttl duration]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 || *ttl <= 0 {
+		if err == nil {
+			fs.Usage()
+		}
+		return 2
+	}
+	if cfg.Memory {
+		fmt.Fprintln(os.Stderr, "invites can't be made for an in-memory database")
+		return 2
+	}
+
+	store, closeStore := openStore(cfg)
+	defer closeStore()
+	code := randomToken()
+	if err := store.CreateInvite(code, time.Now().Add(*ttl).Unix()); err != nil {
+		log.Printf("failed to create the invite: %v", err)
+		return 1
+	}
+	fmt.Println(code)
+	return 0
+}
+
+// runUsers implements "users pending", which lists the registrations
+// awaiting approval, and "users approve" and "users reject", which let the
+// users named log in or delete them. Only users awaiting approval can be
+// approved or rejected.
+func runUsers(args []string, cfg Config) int {
+	if len(args) == 0 || (args[0] == "pending") != (len(args) == 1) ||
+		(args[0] != "pending" && args[0] != "approve" && args[0] != "reject") {
+		fmt.Fprintln(os.Stderr, "usage: reduser [flags] users pending|approve USERNAME...|reject USERNAME...")
+		return 2
+	}
+	if cfg.Memory {
+		fmt.Fprintln(os.Stderr, "an in-memory database has no users yet")
+		return 2
+	}
+
+	store, closeStore := openStore(cfg)
+	defer closeStore()
+	if args[0] == "pending" {
+		users, err := store.ListPendingUsers()
+		if err != nil {
+			log.Printf("failed to list users: %v", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSERNAME\tEMAIL")
+		for _, u := range users {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", u.ID, u.Username, u.Email)
+		}
+		w.Flush()
+		return 0
+	}
 
-	log.Println("listening on localhost:8080")
-	http.ListenAndServe("localhost:8080", r)
+	status := 0
+	for _, name := range args[1:] {
+		userID, _, err := store.GetUserByUsername(name)
+		var user User
+		if err == nil {
+			user, err = store.GetUser(userID)
+		}
+		switch {
+		case err != nil:
+		case user.Approved:
+			err = errors.New("not awaiting approval")
+		case args[0] == "approve":
+			err = store.SetUserApproved(userID, true)
+		default:
+			err = store.DeleteUser(userID)
+		}
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			status = 1
+		}
+	}
+	return status
 }
@@ -1,29 +1,34 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestAuthAndProjectFlow(t *testing.T) {
-	// Setup in memory DB
-	db := InitDB(":memory:?cache=shared")
-	defer db.Close()
+	forEachStore(t, testAuthAndProjectFlow)
+}
 
+func testAuthAndProjectFlow(t *testing.T, store Store) {
 	// Set up test server
 	router := chi.NewRouter() // this should return your *http.ServeMux or chi.Router
-	MountAPIRoutes(router, db)
+	MountAPIRoutes(router, store, DefaultConfig(), LogMailer{})
 	server := httptest.NewServer(router)
 	defer server.Close()
 
 	// Register
-	resp, err := http.Post(server.URL+"/api/register", "application/json", bytes.NewBufferString(`{"username":"testuser","password":"1234"}`))
+	resp, err := http.Post(server.URL+"/api/register", "application/json", bytes.NewBufferString(`{"username":"testuser","password":"correct horse"}`))
 	assert.NoError(t, err)
 
 	assert.Equal(t, http.StatusCreated, resp.StatusCode)
@@ -34,13 +39,33 @@ func TestAuthAndProjectFlow(t *testing.T) {
 	var loginResp struct {
 		Token string `json:"token"`
 	}
-	resp, err = http.Post(server.URL+"/api/login", "application/json", bytes.NewBufferString(`{"username":"testuser","password":"1234"}`))
+	resp, err = http.Post(server.URL+"/api/login", "application/json", bytes.NewBufferString(`{"username":"testuser","password":"correct horse"}`))
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	json.NewDecoder(resp.Body).Decode(&loginResp)
 	assert.NotEmpty(t, loginResp.Token)
 	token := loginResp.Token
 
+	// send makes a dashboard request about the variables of table 1, path
+	// following their URL, and decodes the response
+	send := func(method, path, body string) (int, map[string]any) {
+		req, _ := http.NewRequest(method, server.URL+"/api/projects/1/tables/1/variables"+path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ := http.DefaultClient.Do(req)
+		var respBody map[string]any
+		json.NewDecoder(resp.Body).Decode(&respBody)
+		return resp.StatusCode, respBody
+	}
+	// access runs an action on a variable of table 1 with the project token;
+	// extra holds further fields of the request
+	access := func(variable, action, extra string) (int, map[string]any) {
+		body := `{"variable":"` + variable + `","table":1,"token":"` + projectToken + `","action":"` + action + `"` + extra + `}`
+		resp, _ := http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		var respBody map[string]any
+		json.NewDecoder(resp.Body).Decode(&respBody)
+		return resp.StatusCode, respBody
+	}
+
 	// Fake JWT Test
 	t.Run("Rejects fake JWTs", func(t *testing.T) {
 		req, _ := http.NewRequest("GET", server.URL+"/api/projects", nil)
@@ -136,7 +161,8 @@ func TestAuthAndProjectFlow(t *testing.T) {
 
 	// Update variable
 	t.Run("Update variable", func(t *testing.T) {
-		body := `{"new_type":"int"}`
+		// "hi" has no int value, so it's replaced by 0
+		body := `{"new_type":"int","force":true}`
 		req, _ := http.NewRequest("PUT", server.URL+"/api/projects/1/tables/1/variables/var1", bytes.NewBufferString(body))
 		req.Header.Set("Authorization", "Bearer "+token)
 		req.Header.Set("Content-Type", "application/json")
@@ -168,6 +194,759 @@ func TestAuthAndProjectFlow(t *testing.T) {
 		assert.Equal(t, "int", respBody.Type)
 	})
 
+	// Batch access
+	t.Run("Batch access", func(t *testing.T) {
+		body := `{"token":"` + projectToken + `","action":"batch","table":1,"ops":[
+			{"action":"set","variable":"var1","value":7},
+			{"action":"get","variable":"var1"},
+			{"action":"get","variable":"missing"}
+		]}`
+		resp, _ := http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var respBody struct {
+			Results []struct {
+				Status string `json:"status"`
+				Value  any    `json:"value"`
+				Error  string `json:"error"`
+				Code   int    `json:"code"`
+			} `json:"results"`
+		}
+		json.NewDecoder(resp.Body).Decode(&respBody)
+		assert.Len(t, respBody.Results, 3)
+		assert.Equal(t, "ok", respBody.Results[0].Status)
+		assert.Equal(t, float64(7), respBody.Results[1].Value)
+		assert.Equal(t, http.StatusNotFound, respBody.Results[2].Code)
+
+		// An atomic batch with a failing op must not apply the earlier set
+		body = `{"token":"` + projectToken + `","table":1,"atomic":true,"ops":[
+			{"action":"set","variable":"var1","value":99},
+			{"action":"set","variable":"var1","value":"nope"}
+		]}`
+		resp, _ = http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		body = `{"variable":"var1","table":1,"token":"` + projectToken + `","action":"get"}`
+		resp, _ = http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		var getBody struct {
+			Value int `json:"value"`
+		}
+		json.NewDecoder(resp.Body).Decode(&getBody)
+		assert.Equal(t, 7, getBody.Value)
+	})
+
+	// Increment and decrement
+	t.Run("Increment variable", func(t *testing.T) {
+		code, body := access("var1", "incr", `,"delta":3`)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, float64(10), body["value"])
+
+		code, _ = access("var1", "decr", `,"delta":100,"min":0`)
+		assert.Equal(t, http.StatusConflict, code)
+
+		code, body = access("var1", "decr", `,"delta":100,"min":0,"clamp":true`)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, float64(0), body["value"])
+
+		code, _ = access("var1", "incr", `,"delta":0.5`)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, body = access("var1", "incr", "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, float64(1), body["value"])
+	})
+
+	// Compare and swap
+	t.Run("Compare and swap", func(t *testing.T) {
+		code, current := access("var1", "get", "")
+		assert.Equal(t, http.StatusOK, code)
+		revision, _ := current["revision"].(float64)
+		assert.NotZero(t, revision)
+
+		stale := strconv.Itoa(int(revision) - 1)
+		code, conflict := access("var1", "cas", `,"value":5,"expected_revision":`+stale)
+		assert.Equal(t, http.StatusConflict, code)
+		assert.Equal(t, current["value"], conflict["value"])
+		assert.Equal(t, revision, conflict["revision"])
+
+		code, updated := access("var1", "set", `,"value":5,"expected_revision":`+strconv.Itoa(int(revision)))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, revision+1, updated["revision"])
+
+		code, _ = access("var1", "cas", `,"value":6`)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	// List and dump
+	t.Run("List and dump variables", func(t *testing.T) {
+		type variable struct {
+			Name  string `json:"name"`
+			Type  string `json:"type"`
+			Value any    `json:"value"`
+		}
+
+		body := `{"table":"MyTable","token":"` + projectToken + `","action":"list"}`
+		resp, _ := http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var listBody struct {
+			Variables []variable `json:"variables"`
+		}
+		json.NewDecoder(resp.Body).Decode(&listBody)
+		assert.Equal(t, []variable{{"var1", "int", float64(5)}}, listBody.Variables)
+
+		body = `{"token":"` + projectToken + `","action":"dump"}`
+		resp, _ = http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var dumpBody struct {
+			Tables []struct {
+				ID        int        `json:"id"`
+				Name      string     `json:"name"`
+				Variables []variable `json:"variables"`
+			} `json:"tables"`
+		}
+		json.NewDecoder(resp.Body).Decode(&dumpBody)
+		assert.Len(t, dumpBody.Tables, 1)
+		assert.Equal(t, "MyTable", dumpBody.Tables[0].Name)
+		assert.Equal(t, listBody.Variables, dumpBody.Tables[0].Variables)
+	})
+
+	// Event stream
+	t.Run("Stream variable changes", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/access/stream?table=MyTable&token=" + projectToken)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		lines := make(chan string)
+		go func() {
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			close(lines)
+		}()
+		// wait for the subscription before writing
+		assert.Equal(t, ": connected", <-lines)
+
+		body := `{"variable":"var1","value":8,"table":1,"token":"` + projectToken + `","action":"set"}`
+		resp2, _ := http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		assert.Equal(t, http.StatusOK, resp2.StatusCode)
+
+		var event VariableEvent
+		timeout := time.After(5 * time.Second)
+		for event.Kind == "" {
+			select {
+			case line := <-lines:
+				if data, ok := strings.CutPrefix(line, "data: "); ok {
+					json.Unmarshal([]byte(data), &event)
+				}
+			case <-timeout:
+				t.Fatal("no event received")
+			}
+		}
+		assert.Equal(t, "set", event.Kind)
+		assert.Equal(t, "var1", event.Name)
+		assert.Equal(t, float64(8), event.Value)
+	})
+
+	// WebSocket access
+	t.Run("WebSocket access", func(t *testing.T) {
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/access/ws?token=" + projectToken
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		type message struct {
+			ID           any             `json:"id"`
+			Code         int             `json:"code"`
+			Body         json.RawMessage `json:"body"`
+			Event        *VariableEvent  `json:"event"`
+			Unsubscribed *wsUnsubscribed `json:"unsubscribed"`
+		}
+
+		conn.WriteJSON(map[string]any{"id": 1, "action": "subscribe", "table": "MyTable"})
+		var msg message
+		assert.NoError(t, conn.ReadJSON(&msg))
+		assert.Equal(t, float64(1), msg.ID)
+		assert.Equal(t, http.StatusOK, msg.Code)
+
+		conn.WriteJSON(map[string]any{"id": "two", "action": "set", "table": "MyTable", "variable": "var1", "value": 9})
+		// the reply and the event may arrive in either order
+		var reply, event message
+		for i := 0; i < 2; i++ {
+			var msg message
+			assert.NoError(t, conn.ReadJSON(&msg))
+			if msg.Event != nil {
+				event = msg
+			} else {
+				reply = msg
+			}
+		}
+		assert.Equal(t, "two", reply.ID)
+		assert.Equal(t, http.StatusOK, reply.Code)
+		assert.Equal(t, float64(9), event.Event.Value)
+
+		conn.WriteJSON(map[string]any{"id": 3, "action": "get", "table": "MyTable", "variable": "missing"})
+		assert.NoError(t, conn.ReadJSON(&msg))
+		assert.Equal(t, http.StatusNotFound, msg.Code)
+
+		// A subscription the hub drops for falling behind is announced.
+		// Unread events fill the socket's buffers before the subscription's
+		// own, so far more are published than those could hold.
+		filler := VariableEvent{Kind: "set", ProjectID: 1, TableID: 1, Name: "var1", Type: "string", Value: strings.Repeat("x", 16<<10)}
+		for i := 0; i < 8000; i++ {
+			hub.Publish(filler)
+		}
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		for {
+			msg = message{}
+			if !assert.NoError(t, conn.ReadJSON(&msg)) || msg.Unsubscribed != nil {
+				break
+			}
+		}
+		if assert.NotNil(t, msg.Unsubscribed) {
+			assert.Equal(t, 1, msg.Unsubscribed.TableID)
+			assert.Contains(t, msg.Unsubscribed.Error, "subscribe again")
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		// and the table can be subscribed to again
+		conn.WriteJSON(map[string]any{"id": 4, "action": "subscribe", "table": "MyTable"})
+		assert.NoError(t, conn.ReadJSON(&msg))
+		assert.Equal(t, float64(4), msg.ID)
+		conn.WriteJSON(map[string]any{"id": 5, "action": "set", "table": "MyTable", "variable": "var1", "value": 10})
+		event = message{}
+		for i := 0; i < 2; i++ {
+			var msg message
+			assert.NoError(t, conn.ReadJSON(&msg))
+			if msg.Event != nil {
+				event = msg
+			}
+		}
+		if assert.NotNil(t, event.Event) {
+			assert.Equal(t, float64(10), event.Event.Value)
+		}
+
+		// ops without an action are a batch, as on /api/access
+		conn.WriteJSON(map[string]any{"id": 6, "table": "MyTable", "ops": []map[string]any{{"action": "get", "variable": "var1"}}})
+		msg = message{}
+		assert.NoError(t, conn.ReadJSON(&msg))
+		assert.Equal(t, http.StatusOK, msg.Code)
+		var batch struct {
+			Results []struct {
+				Value any `json:"value"`
+			} `json:"results"`
+		}
+		json.Unmarshal(msg.Body, &batch)
+		if assert.Len(t, batch.Results, 1) {
+			assert.Equal(t, float64(10), batch.Results[0].Value)
+		}
+	})
+
+	// Access by table name
+	t.Run("Access table by name", func(t *testing.T) {
+		body := `{"variable":"var1","table":"MyTable","token":"` + projectToken + `","action":"get"}`
+		resp, _ := http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		body = `{"variable":"var1","table":"NoSuchTable","token":"` + projectToken + `","action":"get"}`
+		resp, _ = http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	// Tokens of other projects can't reach this project's tables
+	t.Run("Rejects tables of other projects", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", server.URL+"/api/projects", bytes.NewBufferString(`{"name":"Other"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ := http.DefaultClient.Do(req)
+		var created struct {
+			ProjectID int `json:"project_id"`
+		}
+		json.NewDecoder(resp.Body).Decode(&created)
+
+		req, _ = http.NewRequest("GET", server.URL+"/api/projects/"+strconv.Itoa(created.ProjectID), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ = http.DefaultClient.Do(req)
+		var other struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(resp.Body).Decode(&other)
+		assert.NotEmpty(t, other.Token)
+
+		body := `{"variable":"var1","table":1,"token":"` + other.Token + `","action":"get"}`
+		resp, _ = http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	// History and rollback
+	t.Run("Variable history and rollback", func(t *testing.T) {
+		set := func(value int) {
+			body := `{"variable":"var1","table":1,"token":"` + projectToken + `","action":"set","value":` + strconv.Itoa(value) + `}`
+			resp, _ := http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+		type history struct {
+			Entries []struct {
+				ID    int    `json:"id"`
+				Value string `json:"value"`
+				Actor string `json:"actor"`
+			} `json:"entries"`
+			Total int `json:"total"`
+		}
+		list := func(query string) history {
+			req, _ := http.NewRequest("GET", server.URL+"/api/projects/1/tables/1/variables/var1/history"+query, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, _ := http.DefaultClient.Do(req)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			var h history
+			json.NewDecoder(resp.Body).Decode(&h)
+			return h
+		}
+
+		set(7)
+		set(8)
+		h := list("?limit=2")
+		assert.Len(t, h.Entries, 2)
+		assert.GreaterOrEqual(t, h.Total, 2)
+		assert.Equal(t, "8", h.Entries[0].Value)
+		assert.Equal(t, "7", h.Entries[1].Value)
+		assert.Equal(t, "token", h.Entries[0].Actor)
+
+		body := `{"history_id":` + strconv.Itoa(h.Entries[1].ID) + `}`
+		req, _ := http.NewRequest("POST", server.URL+"/api/projects/1/tables/1/variables/var1/rollback", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		body = `{"variable":"var1","table":1,"token":"` + projectToken + `","action":"get"}`
+		resp, _ = http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		var got struct {
+			Value int `json:"value"`
+		}
+		json.NewDecoder(resp.Body).Decode(&got)
+		assert.Equal(t, 7, got.Value)
+
+		h = list("")
+		assert.Equal(t, "7", h.Entries[0].Value)
+		assert.Equal(t, "user:1", h.Entries[0].Actor)
+
+		// Unknown entries can't be restored
+		req, _ = http.NewRequest("POST", server.URL+"/api/projects/1/tables/1/variables/var1/rollback", bytes.NewBufferString(`{"history_id":9999}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// Lowering the retention prunes old versions on the next change
+		req, _ = http.NewRequest("PUT", server.URL+"/api/projects/1/history", bytes.NewBufferString(`{"retention":2}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		set(9)
+		assert.Equal(t, 2, list("").Total)
+
+		// Restored values have to pass the constraints in force now
+		set(20)
+		set(5)
+		req, _ = http.NewRequest("PUT", server.URL+"/api/projects/1/tables/1/variables/var1/constraints", bytes.NewBufferString(`{"max":10}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		h = list("")
+		assert.Equal(t, "20", h.Entries[1].Value)
+		body = `{"history_id":` + strconv.Itoa(h.Entries[1].ID) + `}`
+		req, _ = http.NewRequest("POST", server.URL+"/api/projects/1/tables/1/variables/var1/rollback", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		req, _ = http.NewRequest("PUT", server.URL+"/api/projects/1/tables/1/variables/var1/constraints", bytes.NewBufferString(`{}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// A variable created again under the same name starts a new history
+		authed := func(method, path, body string) int {
+			code, _ := send(method, path, body)
+			return code
+		}
+		assert.Equal(t, http.StatusOK, authed("POST", "", `{"name":"phoenix","value":"1","type":"int"}`))
+		body = `{"variable":"phoenix","table":1,"token":"` + projectToken + `","action":"set","value":2}`
+		resp, _ = http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, http.StatusOK, authed("DELETE", "/phoenix", ""))
+		assert.Equal(t, http.StatusOK, authed("POST", "", `{"name":"phoenix","value":"1","type":"int"}`))
+		req, _ = http.NewRequest("GET", server.URL+"/api/projects/1/tables/1/variables/phoenix/history", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ = http.DefaultClient.Do(req)
+		var phoenix history
+		json.NewDecoder(resp.Body).Decode(&phoenix)
+		assert.Equal(t, 1, phoenix.Total)
+		assert.Equal(t, "1", phoenix.Entries[0].Value)
+		assert.Equal(t, http.StatusOK, authed("DELETE", "/phoenix", ""))
+	})
+
+	// Named tokens
+	t.Run("Scoped project tokens", func(t *testing.T) {
+		authed := func(method, path, body string) *http.Response {
+			req, _ := http.NewRequest(method, server.URL+path, bytes.NewBufferString(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, _ := http.DefaultClient.Do(req)
+			return resp
+		}
+		access := func(body string) int {
+			resp, _ := http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+			return resp.StatusCode
+		}
+		type created struct {
+			TokenID int    `json:"token_id"`
+			Token   string `json:"token"`
+		}
+
+		resp := authed("POST", "/api/projects/1/tables", `{"name":"Limited"}`)
+		var table struct {
+			TableID int `json:"table_id"`
+		}
+		json.NewDecoder(resp.Body).Decode(&table)
+
+		resp = authed("POST", "/api/projects/1/tokens", `{"name":"reader","scope":"read","tables":[1]}`)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		var reader created
+		json.NewDecoder(resp.Body).Decode(&reader)
+		assert.NotEmpty(t, reader.Token)
+
+		assert.Equal(t, http.StatusOK, access(`{"variable":"var1","table":1,"token":"`+reader.Token+`","action":"get"}`))
+		assert.Equal(t, http.StatusForbidden, access(`{"variable":"var1","table":1,"token":"`+reader.Token+`","action":"set","value":1}`))
+		assert.Equal(t, http.StatusForbidden, access(`{"table":`+strconv.Itoa(table.TableID)+`,"token":"`+reader.Token+`","action":"list"}`))
+
+		resp, _ = http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(`{"token":"`+reader.Token+`","action":"dump"}`))
+		var dump struct {
+			Tables []struct {
+				ID int `json:"id"`
+			} `json:"tables"`
+		}
+		json.NewDecoder(resp.Body).Decode(&dump)
+		assert.Len(t, dump.Tables, 1)
+
+		resp = authed("POST", "/api/projects/1/tokens", `{"name":"writer","scope":"read_write"}`)
+		var writer created
+		json.NewDecoder(resp.Body).Decode(&writer)
+		assert.Equal(t, http.StatusOK, access(`{"variable":"var1","table":1,"token":"`+writer.Token+`","action":"set","value":3}`))
+
+		resp = authed("GET", "/api/projects/1/tokens", "")
+		var tokens []struct {
+			Name       string `json:"name"`
+			ReadOnly   bool   `json:"read_only"`
+			Tables     []int  `json:"tables"`
+			LastUsedAt *int64 `json:"last_used_at"`
+		}
+		json.NewDecoder(resp.Body).Decode(&tokens)
+		assert.Len(t, tokens, 2)
+		assert.Equal(t, "reader", tokens[0].Name)
+		assert.True(t, tokens[0].ReadOnly)
+		assert.Equal(t, []int{1}, tokens[0].Tables)
+		assert.NotNil(t, tokens[0].LastUsedAt)
+		assert.Nil(t, tokens[1].Tables)
+
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/access/ws?token=" + writer.Token
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		resp = authed("DELETE", "/api/projects/1/tokens/"+strconv.Itoa(writer.TokenID), "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, access(`{"variable":"var1","table":1,"token":"`+writer.Token+`","action":"get"}`))
+
+		// Open sockets lose access with the token
+		conn.WriteJSON(map[string]any{"id": 1, "action": "get", "table": 1, "variable": "var1"})
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "%v", err)
+
+		// and streams when it expires
+		resp = authed("POST", "/api/projects/1/tokens", `{"name":"brief","scope":"read","expires_at":`+strconv.FormatInt(time.Now().Unix()+2, 10)+`}`)
+		var brief created
+		json.NewDecoder(resp.Body).Decode(&brief)
+		stream, err := http.Get(server.URL + "/api/access/stream?token=" + brief.Token)
+		assert.NoError(t, err)
+		defer stream.Body.Close()
+		assert.Equal(t, http.StatusOK, stream.StatusCode)
+		ended := make(chan string)
+		go func() {
+			var last string
+			scanner := bufio.NewScanner(stream.Body)
+			for scanner.Scan() {
+				if strings.HasPrefix(scanner.Text(), "event: ") {
+					last = scanner.Text()
+				}
+			}
+			ended <- last
+		}()
+		select {
+		case last := <-ended:
+			assert.Equal(t, "event: error", last)
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream outlived its token")
+		}
+
+		// Expiries have to lie in the future
+		resp = authed("POST", "/api/projects/1/tokens", `{"name":"old","scope":"read","expires_at":1}`)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	// Token rotation
+	t.Run("Rotate project token", func(t *testing.T) {
+		get := func(projToken string) *http.Response {
+			body := `{"variable":"var1","table":1,"token":"` + projToken + `","action":"get"}`
+			resp, _ := http.Post(server.URL+"/api/access", "application/json", bytes.NewBufferString(body))
+			return resp
+		}
+
+		req, _ := http.NewRequest("POST", server.URL+"/api/projects/1/token/rotate", bytes.NewBufferString(`{"grace_period":3600}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var rotated struct {
+			Token     string `json:"token"`
+			ExpiresAt int64  `json:"previous_token_expires_at"`
+		}
+		json.NewDecoder(resp.Body).Decode(&rotated)
+		assert.NotEqual(t, projectToken, rotated.Token)
+
+		// The old token still works within the grace period, but is deprecated
+		resp = get(projectToken)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "true", resp.Header.Get("Deprecation"))
+		assert.Equal(t, time.Unix(rotated.ExpiresAt, 0).UTC().Format(http.TimeFormat), resp.Header.Get("Sunset"))
+
+		resp = get(rotated.Token)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Deprecation"))
+
+		// Another rotation with grace would cut the first one's short
+		req, _ = http.NewRequest("POST", server.URL+"/api/projects/1/token/rotate", bytes.NewBufferString(`{"grace_period":60}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		assert.Equal(t, http.StatusOK, get(projectToken).StatusCode)
+		assert.Equal(t, http.StatusOK, get(rotated.Token).StatusCode)
+
+		// Without a grace period the old token stops working right away
+		req, _ = http.NewRequest("POST", server.URL+"/api/projects/1/token/rotate", bytes.NewBufferString(`{"grace_period":0}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		oldToken := rotated.Token
+		json.NewDecoder(resp.Body).Decode(&rotated)
+		assert.Equal(t, http.StatusUnauthorized, get(oldToken).StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, get(projectToken).StatusCode)
+
+		projectToken = rotated.Token
+	})
+
+	// Webhooks may not reach into the server's own network
+	t.Run("Rejects private webhook URLs", func(t *testing.T) {
+		for _, target := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://[::1]/hook", "https://10.0.0.5/hook", "http://169.254.169.254/latest/meta-data"} {
+			req, _ := http.NewRequest("POST", server.URL+"/api/projects/1/webhooks", bytes.NewBufferString(`{"url":"`+target+`"}`))
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, _ := http.DefaultClient.Do(req)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, target)
+		}
+
+		req, _ := http.NewRequest("POST", server.URL+"/api/projects/1/webhooks", bytes.NewBufferString(`{"url":"https://93.184.215.14/hook"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		var created struct {
+			ID int `json:"webhook_id"`
+		}
+		json.NewDecoder(resp.Body).Decode(&created)
+
+		// deliveries are only listed under the webhook's own project
+		deliveries := func(path string) int {
+			req, _ := http.NewRequest("GET", server.URL+path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, _ := http.DefaultClient.Do(req)
+			return resp.StatusCode
+		}
+		id := strconv.Itoa(created.ID)
+		assert.Equal(t, http.StatusOK, deliveries("/api/projects/1/webhooks/"+id+"/deliveries"))
+		assert.Equal(t, http.StatusNotFound, deliveries("/api/projects/2/webhooks/"+id+"/deliveries"))
+		assert.Equal(t, http.StatusNotFound, deliveries("/api/projects/1/webhooks/"+strconv.Itoa(created.ID+1)+"/deliveries"))
+	})
+
+	// json, list and map variables
+	t.Run("Structured variables", func(t *testing.T) {
+		create := func(name, typ, value string) int {
+			body, _ := json.Marshal(map[string]string{"name": name, "type": typ, "value": value})
+			req, _ := http.NewRequest("POST", server.URL+"/api/projects/1/tables/1/variables", bytes.NewBuffer(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, _ := http.DefaultClient.Do(req)
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, http.StatusOK, create("settings", "map", `{"maxPlayers": 4, "modes": ["coop"]}`))
+		assert.Equal(t, http.StatusBadRequest, create("broken", "list", `{"a": 1}`))
+		assert.Equal(t, http.StatusBadRequest, create("broken", "json", `{`))
+		assert.Equal(t, http.StatusOK, create("empty", "list", ""))
+
+		// Keys come back exactly as they were stored
+		code, body := access("settings", "get", "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, map[string]any{"maxPlayers": float64(4), "modes": []any{"coop"}}, body["value"])
+
+		code, _ = access("settings", "set", `,"path":"/maxPlayers","value":8`)
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = access("settings", "append", `,"path":"/modes","value":"versus"`)
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = access("settings", "set", `,"path":"/limits","value":{"rate":1.5}`)
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = access("settings", "remove", `,"path":"/limits/rate"`)
+		assert.Equal(t, http.StatusOK, code)
+
+		code, body = access("settings", "get", "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, map[string]any{
+			"maxPlayers": float64(8),
+			"modes":      []any{"coop", "versus"},
+			"limits":     map[string]any{},
+		}, body["value"])
+
+		code, body = access("settings", "get", `,"path":"/modes/1"`)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "versus", body["value"])
+
+		code, _ = access("settings", "get", `,"path":"/missing"`)
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = access("settings", "append", `,"path":"/maxPlayers","value":1`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = access("settings", "set", `,"value":[1,2]`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = access("var1", "get", `,"path":"/a"`)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	// datetime, duration and enum variables
+	t.Run("Datetime, duration and enum variables", func(t *testing.T) {
+		create := func(body string) int {
+			req, _ := http.NewRequest("POST", server.URL+"/api/projects/1/tables/1/variables", bytes.NewBufferString(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, _ := http.DefaultClient.Do(req)
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, http.StatusOK, create(`{"name":"event_ends_at","type":"datetime","value":"2026-12-24T18:00:00+01:00"}`))
+		assert.Equal(t, http.StatusOK, create(`{"name":"cooldown","type":"duration","value":"90s"}`))
+		assert.Equal(t, http.StatusOK, create(`{"name":"difficulty","type":"enum","options":["easy","normal","hard"],"value":""}`))
+		assert.Equal(t, http.StatusBadRequest, create(`{"name":"mode","type":"enum","value":""}`))
+		assert.Equal(t, http.StatusBadRequest, create(`{"name":"mode","type":"string","options":["a"],"value":""}`))
+
+		_, body := access("event_ends_at", "get", "")
+		assert.Equal(t, "2026-12-24T17:00:00Z", body["value"])
+		_, body = access("cooldown", "get", "")
+		assert.Equal(t, "1m30s", body["value"])
+		_, body = access("difficulty", "get", "")
+		assert.Equal(t, "easy", body["value"])
+		assert.Equal(t, []any{"easy", "normal", "hard"}, body["options"])
+
+		code, _ := access("difficulty", "set", `,"value":"hard"`)
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = access("difficulty", "set", `,"value":"impossible"`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = access("cooldown", "set", `,"value":"2h"`)
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = access("cooldown", "set", `,"value":30`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = access("event_ends_at", "set", `,"value":"tomorrow"`)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Validation constraints", func(t *testing.T) {
+
+		code, _ := send("POST", "", `{"name":"lives","type":"int","value":"3","constraints":{"min":0,"max":5}}`)
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = send("POST", "", `{"name":"nickname","type":"string","value":"bob","constraints":{"max_length":8,"pattern":"^[a-z]+$","required":true}}`)
+		assert.Equal(t, http.StatusOK, code)
+
+		// the constraints have to fit the type, and the value the constraints
+		code, body := send("POST", "", `{"name":"bad","type":"string","value":"","constraints":{"min":1}}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, []any{map[string]any{"field": "constraints", "constraint": "min", "message": "min and max only apply to int and float variables"}}, body["errors"])
+		code, _ = send("POST", "", `{"name":"bad","type":"int","value":"9","constraints":{"max":5}}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _ = access("lives", "set", `,"value":5`)
+		assert.Equal(t, http.StatusOK, code)
+		code, body = access("lives", "set", `,"value":6`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, []any{map[string]any{"field": "value", "constraint": "max", "message": "value must be at most 5"}}, body["errors"])
+		code, _ = access("lives", "incr", `,"delta":1`)
+		assert.Equal(t, http.StatusConflict, code)
+		_, body = access("lives", "incr", `,"delta":3,"clamp":true`)
+		assert.Equal(t, float64(5), body["value"])
+
+		code, body = access("nickname", "set", `,"value":"Bobby Tables"`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Len(t, body["errors"], 2)
+		code, body = access("nickname", "set", `,"value":""`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, body["errors"], map[string]any{"field": "value", "constraint": "required", "message": "value is required"})
+
+		code, _ = send("PUT", "/lives/constraints", `{"max":4}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = send("PUT", "/lives/constraints", `{"min":1,"max":10}`)
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = access("lives", "set", `,"value":10`)
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = send("PUT", "/missing/constraints", `{}`)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("Change variable type", func(t *testing.T) {
+
+		code, _ := send("POST", "", `{"name":"retries","type":"string","value":"3"}`)
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = send("POST", "", `{"name":"motd","type":"string","value":"welcome"}`)
+		assert.Equal(t, http.StatusOK, code)
+
+		// a dry run reports the outcome without changing anything
+		code, body := send("PUT", "/retries", `{"new_type":"int","dry_run":true}`)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, true, body["dry_run"])
+		assert.Equal(t, float64(3), body["value"])
+		assert.Equal(t, "converted", body["source"])
+		_, body = send("PUT", "/retries", `{"new_type":"string","dry_run":true}`)
+		assert.Equal(t, "3", body["old_value"])
+
+		_, body = send("PUT", "/retries", `{"new_type":"float"}`)
+		assert.Equal(t, "ok", body["status"])
+		assert.Equal(t, float64(3), body["value"])
+		code, body = send("PUT", "/retries", `{"new_type":"bool"}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, `cannot convert "3" from float to bool; send a new value or force`, body["error"])
+
+		code, body = send("PUT", "/motd", `{"new_type":"int","dry_run":true}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, true, body["dry_run"])
+		_, body = send("PUT", "/motd", `{"new_type":"int","value":"7"}`)
+		assert.Equal(t, float64(7), body["value"])
+		assert.Equal(t, "value", body["source"])
+		code, _ = send("PUT", "/motd", `{"new_type":"bool","value":"maybe"}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		_, body = send("PUT", "/motd", `{"new_type":"enum","options":["a","b"],"force":true}`)
+		assert.Equal(t, "a", body["value"])
+		assert.Equal(t, "force", body["source"])
+
+		// constraints that don't fit the new type are dropped
+		code, _ = send("PUT", "/retries/constraints", `{"max":5}`)
+		assert.Equal(t, http.StatusOK, code)
+		_, body = send("PUT", "/retries", `{"new_type":"string"}`)
+		assert.Equal(t, true, body["constraints_dropped"])
+		assert.Equal(t, "3", body["value"])
+
+		code, _ = send("PUT", "/missing", `{"new_type":"int"}`)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
 	// Set variable with wrong type
 	t.Run("Set variable with wrong type", func(t *testing.T) {
 		body := `{"variable":"var1","value":"hi","table":1,"token":"` + projectToken + `","action":"set"}`
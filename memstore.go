@@ -0,0 +1,1212 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in memory, for tests and
+// ephemeral deployments. It follows the rules the SQLite schema enforces:
+// unique names, cascading deletes and well-formed structured values.
+type MemoryStore struct {
+	mu   sync.Mutex
+	d    memData
+	inTx bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{d: memData{ids: map[string]int{}, hookOwners: map[int]int{}}}
+}
+
+// memData holds the rows of a MemoryStore, each kind ordered by id.
+type memData struct {
+	ids        map[string]int
+	users      []memUser
+	projects   []memProject
+	tables     []memTable
+	variables  []memVariable
+	history    []memHistory
+	tokens     []memToken
+	webhooks   []Webhook
+	hookOwners map[int]int
+	deliveries []WebhookDelivery
+	sessions   []memSession
+	invites    []memInvite
+
+	// owned are the kinds a transaction has copied to change; the others
+	// are still shared with the data it started from. It's nil outside a
+	// transaction, where everything is owned.
+	owned map[string]bool
+}
+
+type memUser struct {
+	id                  int
+	username            string
+	pwHash              string
+	email               string
+	emailVerified       bool
+	emailTokenHash      string
+	emailTokenExpiresAt int64
+	approved            bool
+	totpSecret          string
+	totpEnabled         bool
+	totpLastStep        int64
+	recoveryHashes      []string
+}
+
+type memProject struct {
+	id, userID        int
+	name, token       string
+	previousToken     string
+	previousExpiresAt *int64
+	retention         int
+}
+
+type memTable struct {
+	id, projectID, userID int
+	name                  string
+}
+
+type memVariable struct {
+	Variable
+	id, tableID, userID int
+	revision            int
+}
+
+type memHistory struct {
+	HistoryEntry
+	variableID, tableID int
+}
+
+type memToken struct {
+	ProjectToken
+	userID int
+	hash   string
+}
+
+type memSession struct {
+	Session
+	hash, previousHash string
+}
+
+type memInvite struct {
+	hash              string
+	expiresAt, usedAt int64
+	usedBy            int
+}
+
+// writes copies the rows of kinds before a transaction changes them, unless
+// it already has. Nothing writes through the pointers and slices inside a
+// row, so copying the rows themselves is enough.
+func (d *memData) writes(kinds ...string) {
+	for _, kind := range kinds {
+		if d.owned == nil || d.owned[kind] {
+			continue
+		}
+		d.owned[kind] = true
+		switch kind {
+		case "ids":
+			d.ids = maps.Clone(d.ids)
+		case "users":
+			d.users = slices.Clone(d.users)
+		case "projects":
+			d.projects = slices.Clone(d.projects)
+		case "tables":
+			d.tables = slices.Clone(d.tables)
+		case "variables":
+			d.variables = slices.Clone(d.variables)
+		case "history":
+			d.history = slices.Clone(d.history)
+		case "tokens":
+			d.tokens = slices.Clone(d.tokens)
+		case "webhooks":
+			d.webhooks = slices.Clone(d.webhooks)
+			d.hookOwners = maps.Clone(d.hookOwners)
+		case "deliveries":
+			d.deliveries = slices.Clone(d.deliveries)
+		case "sessions":
+			d.sessions = slices.Clone(d.sessions)
+		case "invites":
+			d.invites = slices.Clone(d.invites)
+		default:
+			panic("memstore: unknown kind " + kind)
+		}
+	}
+}
+
+func (d *memData) nextID(kind string) int {
+	d.writes("ids")
+	d.ids[kind]++
+	return d.ids[kind]
+}
+
+// Tx runs fn on a view of the data that copies each kind of row the first
+// time fn changes it, and replaces the data only if fn succeeds. Other
+// callers wait until it's done. A nested transaction copies again what it
+// changes, so failing leaves the outer one as it was.
+func (s *MemoryStore) Tx(fn func(tx Store) error) error {
+	if !s.inTx {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	tx := &MemoryStore{d: s.d, inTx: true}
+	tx.d.owned = map[string]bool{}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	owned := s.d.owned
+	s.d = tx.d
+	if owned != nil {
+		maps.Copy(owned, tx.d.owned)
+	}
+	s.d.owned = owned
+	return nil
+}
+
+// lock locks the store for a method that changes the rows of kinds; in a
+// transaction they are copied first.
+func (s *MemoryStore) lock(kinds ...string) func() {
+	s.mu.Lock()
+	s.d.writes(kinds...)
+	return s.mu.Unlock
+}
+
+// Users
+func (s *MemoryStore) CreateUser(username, pwHash string) error {
+	defer s.lock("users")()
+	for _, u := range s.d.users {
+		if u.username == username {
+			return ErrExists
+		}
+	}
+	s.d.users = append(s.d.users, memUser{id: s.d.nextID("users"), username: username, pwHash: pwHash, approved: true})
+	return nil
+}
+
+func (s *MemoryStore) GetUserByUsername(username string) (id int, pwHash string, err error) {
+	defer s.lock()()
+	for _, u := range s.d.users {
+		if u.username == username {
+			return u.id, u.pwHash, nil
+		}
+	}
+	return 0, "", ErrNotFound
+}
+
+func (s *MemoryStore) user(userID int) *memUser {
+	for i := range s.d.users {
+		if u := &s.d.users[i]; u.id == userID {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetUser(userID int) (User, error) {
+	defer s.lock()()
+	u := s.user(userID)
+	if u == nil {
+		return User{}, ErrNotFound
+	}
+	return u.public(), nil
+}
+
+func (u memUser) public() User {
+	return User{
+		ID:            u.id,
+		Username:      u.username,
+		Email:         u.email,
+		EmailVerified: u.emailVerified,
+		Approved:      u.approved,
+		TOTPEnabled:   u.totpEnabled,
+		PasswordHash:  u.pwHash,
+	}
+}
+
+func (s *MemoryStore) RenameUser(userID int, username string) error {
+	defer s.lock("users")()
+	for _, other := range s.d.users {
+		if other.username == username && other.id != userID {
+			return ErrExists
+		}
+	}
+	u := s.user(userID)
+	if u == nil {
+		return ErrNotFound
+	}
+	u.username = username
+	return nil
+}
+
+func (s *MemoryStore) SetUserPassword(userID int, pwHash string) error {
+	defer s.lock("users")()
+	u := s.user(userID)
+	if u == nil {
+		return ErrNotFound
+	}
+	u.pwHash = pwHash
+	return nil
+}
+
+func (s *MemoryStore) SetUserEmail(userID int, email, verifyToken string, expiresAt int64) error {
+	defer s.lock("users")()
+	var hash string
+	if email != "" {
+		hash = hashToken(verifyToken)
+		for _, other := range s.d.users {
+			if other.id != userID && ((other.email == email && other.emailVerified) || other.emailTokenHash == hash) {
+				return ErrExists
+			}
+		}
+	} else {
+		expiresAt = 0
+	}
+	u := s.user(userID)
+	if u == nil {
+		return ErrNotFound
+	}
+	u.email, u.emailVerified = email, false
+	u.emailTokenHash, u.emailTokenExpiresAt = hash, expiresAt
+	return nil
+}
+
+func (s *MemoryStore) VerifyUserEmail(verifyToken string) (userID int, err error) {
+	defer s.lock("users")()
+	hash, now := hashToken(verifyToken), time.Now().Unix()
+	for i := range s.d.users {
+		if u := &s.d.users[i]; u.emailTokenHash == hash && u.emailTokenExpiresAt > now {
+			for _, other := range s.d.users {
+				if other.id != u.id && other.email == u.email && other.emailVerified {
+					return 0, ErrExists
+				}
+			}
+			u.emailVerified = true
+			u.emailTokenHash, u.emailTokenExpiresAt = "", 0
+			return u.id, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (s *MemoryStore) DeleteUser(userID int) error {
+	defer s.lock("users", "sessions", "invites")()
+	if s.user(userID) == nil {
+		return ErrNotFound
+	}
+	s.d.users = slices.DeleteFunc(s.d.users, func(u memUser) bool { return u.id == userID })
+	var projects []int
+	for _, p := range s.d.projects {
+		if p.userID == userID {
+			projects = append(projects, p.id)
+		}
+	}
+	s.deleteProjects(projects)
+	s.d.sessions = slices.DeleteFunc(s.d.sessions, func(ses memSession) bool { return ses.UserID == userID })
+	for i := range s.d.invites {
+		if s.d.invites[i].usedBy == userID {
+			s.d.invites[i].usedBy = 0
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetUserApproved(userID int, approved bool) error {
+	defer s.lock("users")()
+	u := s.user(userID)
+	if u == nil {
+		return ErrNotFound
+	}
+	u.approved = approved
+	return nil
+}
+
+func (s *MemoryStore) ListPendingUsers() ([]User, error) {
+	defer s.lock()()
+	var users []User
+	for _, u := range s.d.users {
+		if !u.approved {
+			users = append(users, u.public())
+		}
+	}
+	return users, nil
+}
+
+// Projects
+func (s *MemoryStore) project(projID, userID int) *memProject {
+	for i := range s.d.projects {
+		if p := &s.d.projects[i]; p.id == projID && p.userID == userID {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) tokenTaken(token string) bool {
+	for _, p := range s.d.projects {
+		if p.token == token {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) CreateProject(userID int, name, token string) (int, error) {
+	defer s.lock("projects")()
+	if s.tokenTaken(token) {
+		return 0, ErrExists
+	}
+	id := s.d.nextID("projects")
+	s.d.projects = append(s.d.projects, memProject{id: id, userID: userID, name: name, token: token, retention: 50})
+	return id, nil
+}
+
+func (s *MemoryStore) ListProjects(userID int) ([]Project, error) {
+	defer s.lock()()
+	var projects []Project
+	for _, p := range s.d.projects {
+		if p.userID == userID {
+			projects = append(projects, Project{ID: p.id, Name: p.name})
+		}
+	}
+	return projects, nil
+}
+
+func (s *MemoryStore) GetProject(projID, userID int) (map[string]any, error) {
+	s.mu.Lock()
+	p := s.project(projID, userID)
+	if p == nil {
+		s.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	name, token, previousExpiresAt := p.name, p.token, p.previousExpiresAt
+	s.mu.Unlock()
+	return projectDetails(s, projID, userID, name, token, previousExpiresAt)
+}
+
+func (s *MemoryStore) GetProjectByToken(token string) (id, userID int, sunset int64, err error) {
+	defer s.lock()()
+	for _, p := range s.d.projects {
+		if p.token == token {
+			return p.id, p.userID, 0, nil
+		}
+	}
+	now := time.Now().Unix()
+	for _, p := range s.d.projects {
+		if p.previousToken == token && p.previousExpiresAt != nil && *p.previousExpiresAt > now {
+			return p.id, p.userID, *p.previousExpiresAt, nil
+		}
+	}
+	return 0, 0, 0, ErrNotFound
+}
+
+func (s *MemoryStore) RotateProjectToken(projID int, token string, graceUntil int64, userID int) error {
+	defer s.lock("projects")()
+	p := s.project(projID, userID)
+	if p == nil {
+		return ErrNotFound
+	}
+	if s.tokenTaken(token) {
+		return ErrExists
+	}
+	now := time.Now().Unix()
+	if graceUntil > now && p.previousExpiresAt != nil && *p.previousExpiresAt > now {
+		return ErrTokenInGrace
+	}
+	p.previousToken, p.previousExpiresAt, p.token = p.token, &graceUntil, token
+	return nil
+}
+
+func (s *MemoryStore) RenameProject(projID int, name string, userID int) error {
+	defer s.lock("projects")()
+	if p := s.project(projID, userID); p != nil {
+		p.name = name
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteProject(projID int, userID int) error {
+	defer s.lock()()
+	if s.project(projID, userID) != nil {
+		s.deleteProjects([]int{projID})
+	}
+	return nil
+}
+
+// deleteProjects deletes projects with the rows that depend on them.
+func (s *MemoryStore) deleteProjects(ids []int) {
+	s.d.writes("projects", "tokens")
+	s.d.projects = slices.DeleteFunc(s.d.projects, func(p memProject) bool { return slices.Contains(ids, p.id) })
+	var tables []int
+	for _, t := range s.d.tables {
+		if slices.Contains(ids, t.projectID) {
+			tables = append(tables, t.id)
+		}
+	}
+	s.deleteTables(tables)
+	s.deleteWebhooks(func(h Webhook) bool { return slices.Contains(ids, h.ProjectID) })
+	s.d.tokens = slices.DeleteFunc(s.d.tokens, func(t memToken) bool { return slices.Contains(ids, t.ProjectID) })
+}
+
+func (s *MemoryStore) SetHistoryRetention(projID int, retention int, userID int) error {
+	defer s.lock("projects")()
+	if p := s.project(projID, userID); p != nil {
+		p.retention = retention
+	}
+	return nil
+}
+
+// Tables
+func (s *MemoryStore) table(tableID int) *memTable {
+	for i := range s.d.tables {
+		if t := &s.d.tables[i]; t.id == tableID {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) tableNameTaken(projectID, userID int, name string) bool {
+	for _, t := range s.d.tables {
+		if t.projectID == projectID && t.userID == userID && t.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) CreateTable(projectID int, name string, userID int) (int, error) {
+	defer s.lock("tables")()
+	if s.project(projectID, userID) == nil {
+		return 0, ErrNotFound
+	}
+	if s.tableNameTaken(projectID, userID, name) {
+		return 0, ErrExists
+	}
+	id := s.d.nextID("tables")
+	s.d.tables = append(s.d.tables, memTable{id, projectID, userID, name})
+	return id, nil
+}
+
+func (s *MemoryStore) GetTableID(projectID int, name string, userID int) (int, error) {
+	defer s.lock()()
+	for _, t := range s.d.tables {
+		if t.projectID == projectID && t.name == name && t.userID == userID {
+			return t.id, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (s *MemoryStore) GetTableProjectID(tableID int) (int, error) {
+	defer s.lock()()
+	if t := s.table(tableID); t != nil {
+		return t.projectID, nil
+	}
+	return 0, ErrNotFound
+}
+
+func (s *MemoryStore) ListTables(projectID int, userID int) ([]Table, error) {
+	defer s.lock()()
+	var tables []Table
+	for _, t := range s.d.tables {
+		if t.projectID == projectID && t.userID == userID {
+			tables = append(tables, Table{ID: t.id, Name: t.name})
+		}
+	}
+	slices.SortFunc(tables, func(a, b Table) int { return strings.Compare(a.Name, b.Name) })
+	return tables, nil
+}
+
+func (s *MemoryStore) RenameTable(tableID int, name string, userID int) error {
+	defer s.lock("tables")()
+	t := s.table(tableID)
+	if t == nil || t.userID != userID || t.name == name {
+		return nil
+	}
+	if s.tableNameTaken(t.projectID, userID, name) {
+		return ErrExists
+	}
+	t.name = name
+	return nil
+}
+
+func (s *MemoryStore) DeleteTable(tableID int, userID int) error {
+	defer s.lock()()
+	if t := s.table(tableID); t != nil && t.userID == userID {
+		s.deleteTables([]int{tableID})
+	}
+	return nil
+}
+
+// deleteTables deletes tables with the rows that depend on them.
+func (s *MemoryStore) deleteTables(ids []int) {
+	s.d.writes("tables", "variables", "history")
+	s.d.tables = slices.DeleteFunc(s.d.tables, func(t memTable) bool { return slices.Contains(ids, t.id) })
+	s.d.variables = slices.DeleteFunc(s.d.variables, func(v memVariable) bool { return slices.Contains(ids, v.tableID) })
+	s.d.history = slices.DeleteFunc(s.d.history, func(h memHistory) bool { return slices.Contains(ids, h.tableID) })
+	s.deleteWebhooks(func(h Webhook) bool { return slices.Contains(ids, h.TableID) })
+}
+
+// Variables
+func (s *MemoryStore) variable(tableID int, name string) *memVariable {
+	for i := range s.d.variables {
+		if v := &s.d.variables[i]; v.tableID == tableID && v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) userVariable(tableID int, name string, userID int) *memVariable {
+	if v := s.variable(tableID, name); v != nil && v.userID == userID {
+		return v
+	}
+	return nil
+}
+
+// checkStored is the CHECK of the variables table: a known type, and for
+// structured types valid JSON of the right shape.
+func checkStored(typ, value string) error {
+	if !slices.Contains(variableTypes, typ) {
+		return errInvalidValue
+	}
+	if isStructured(typ) {
+		if v, err := parseJSONValue(value); err != nil || !hasShape(typ, v) {
+			return errInvalidValue
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateVariable(tableID int, name, value, typ string, options []string, c Constraints, userID int) error {
+	value, err := prepareVariable(value, typ, options, c)
+	if err != nil {
+		return err
+	}
+	defer s.lock("variables")()
+	if t := s.table(tableID); t == nil || t.userID != userID {
+		return ErrNotFound
+	}
+	if s.variable(tableID, name) != nil {
+		return ErrExists
+	}
+	if err := checkStored(typ, value); err != nil {
+		return err
+	}
+	s.d.variables = append(s.d.variables, memVariable{
+		Variable: Variable{Name: name, Type: typ, Value: value, Options: slices.Clone(options), Constraints: c},
+		id:       s.d.nextID("variables"),
+		tableID:  tableID,
+		userID:   userID,
+	})
+	return nil
+}
+
+func (s *MemoryStore) ListVariables(tableID int, userID int) ([]Variable, error) {
+	defer s.lock()()
+	var variables []Variable
+	for _, v := range s.d.variables {
+		if v.tableID == tableID && v.userID == userID {
+			variable := v.Variable
+			variable.Options = slices.Clone(v.Options)
+			variables = append(variables, variable)
+		}
+	}
+	slices.SortFunc(variables, func(a, b Variable) int { return strings.Compare(a.Name, b.Name) })
+	return variables, nil
+}
+
+func (s *MemoryStore) GetVariable(tableID int, name string) (value, typ string, revision int, err error) {
+	defer s.lock()()
+	if v := s.variable(tableID, name); v != nil {
+		return v.Value, v.Type, v.revision, nil
+	}
+	return "", "", 0, ErrNotFound
+}
+
+func (s *MemoryStore) GetUserVariable(tableID int, name string, userID int) (value, typ string, err error) {
+	defer s.lock()()
+	if v := s.userVariable(tableID, name, userID); v != nil {
+		return v.Value, v.Type, nil
+	}
+	return "", "", ErrNotFound
+}
+
+func (s *MemoryStore) GetVariableType(tableID int, name string) (string, error) {
+	defer s.lock()()
+	if v := s.variable(tableID, name); v != nil {
+		return v.Type, nil
+	}
+	return "", ErrNotFound
+}
+
+func (s *MemoryStore) GetVariableRules(tableID int, name string) (options []string, c Constraints, err error) {
+	defer s.lock()()
+	if v := s.variable(tableID, name); v != nil {
+		return slices.Clone(v.Options), v.Constraints, nil
+	}
+	return nil, c, ErrNotFound
+}
+
+func (s *MemoryStore) SetVariable(tableID int, name, value string) (revision int, err error) {
+	defer s.lock("variables")()
+	v := s.variable(tableID, name)
+	if v == nil {
+		return 0, ErrNotFound
+	}
+	if err := checkStored(v.Type, value); err != nil {
+		return 0, err
+	}
+	v.Value = value
+	v.revision++
+	return v.revision, nil
+}
+
+func (s *MemoryStore) CompareAndSetVariable(tableID int, name, value string, expected int) (revision int, err error) {
+	defer s.lock("variables")()
+	v := s.variable(tableID, name)
+	if v == nil || v.revision != expected {
+		return 0, ErrNotFound
+	}
+	if err := checkStored(v.Type, value); err != nil {
+		return 0, err
+	}
+	v.Value = value
+	v.revision++
+	return v.revision, nil
+}
+
+func (s *MemoryStore) IncrementVariable(tableID int, name, typ string, delta float64, min, max *float64, clamp bool) (value string, revision int, err error) {
+	defer s.lock("variables")()
+	v := s.variable(tableID, name)
+	if v == nil || v.Type != typ {
+		return "", 0, ErrNotFound
+	}
+	value, ok := incrementValue(v.Value, typ, delta, min, max, clamp)
+	if !ok {
+		return "", 0, ErrNotFound
+	}
+	v.Value = value
+	v.revision++
+	return v.Value, v.revision, nil
+}
+
+func (s *MemoryStore) ChangeVariableType(tableID int, name, typ, value string, options []string, c Constraints, userID int) (revision int, err error) {
+	defer s.lock("variables")()
+	v := s.userVariable(tableID, name, userID)
+	if v == nil {
+		return 0, ErrNotFound
+	}
+	if err := checkStored(typ, value); err != nil {
+		return 0, err
+	}
+	v.Type, v.Value, v.Options, v.Constraints = typ, value, slices.Clone(options), c
+	v.revision++
+	return v.revision, nil
+}
+
+func (s *MemoryStore) SetVariableConstraints(tableID int, name string, c Constraints, userID int) error {
+	defer s.lock("variables")()
+	v := s.userVariable(tableID, name, userID)
+	if v == nil {
+		return ErrNotFound
+	}
+	v.Constraints = c
+	return nil
+}
+
+func (s *MemoryStore) DeleteVariable(tableID int, name string, userID int) error {
+	defer s.lock("variables", "history")()
+	v := s.userVariable(tableID, name, userID)
+	if v == nil {
+		return ErrNotFound
+	}
+	id := v.id
+	s.d.history = slices.DeleteFunc(s.d.history, func(h memHistory) bool { return h.variableID == id })
+	s.d.variables = slices.DeleteFunc(s.d.variables, func(v memVariable) bool {
+		return v.tableID == tableID && v.Name == name
+	})
+	return nil
+}
+
+// History
+func (s *MemoryStore) RecordVariableHistory(tableID int, name, value, typ string, revision int, actor string) error {
+	defer s.lock("history")()
+	t := s.table(tableID)
+	v := s.variable(tableID, name)
+	if t == nil || v == nil {
+		return ErrNotFound
+	}
+	s.d.history = append(s.d.history, memHistory{
+		HistoryEntry: HistoryEntry{
+			ID:        s.d.nextID("variable_history"),
+			Value:     value,
+			Type:      typ,
+			Revision:  revision,
+			Actor:     actor,
+			CreatedAt: time.Now().Unix(),
+		},
+		variableID: v.id,
+		tableID:    tableID,
+	})
+
+	retention := 0
+	for _, p := range s.d.projects {
+		if p.id == t.projectID {
+			retention = p.retention
+		}
+	}
+	kept := 0
+	for i := len(s.d.history) - 1; i >= 0; i-- {
+		if h := s.d.history[i]; h.variableID == v.id {
+			if kept == retention {
+				s.d.history = slices.Delete(s.d.history, i, i+1)
+				continue
+			}
+			kept++
+		}
+	}
+	return nil
+}
+
+// userHistory returns the versions of a variable of the user, newest first.
+func (s *MemoryStore) userHistory(tableID int, name string, userID int) []HistoryEntry {
+	v := s.userVariable(tableID, name, userID)
+	if v == nil {
+		return nil
+	}
+	var entries []HistoryEntry
+	for i := len(s.d.history) - 1; i >= 0; i-- {
+		if h := s.d.history[i]; h.variableID == v.id {
+			entries = append(entries, h.HistoryEntry)
+		}
+	}
+	return entries
+}
+
+func (s *MemoryStore) ListVariableHistory(tableID int, name string, userID int, limit, offset int) ([]HistoryEntry, int, error) {
+	defer s.lock()()
+	all := s.userHistory(tableID, name, userID)
+	entries := []HistoryEntry{}
+	if offset < len(all) {
+		entries = append(entries, all[offset:min(offset+limit, len(all))]...)
+	}
+	return entries, len(all), nil
+}
+
+func (s *MemoryStore) GetHistoryEntry(historyID, tableID int, name string, userID int) (HistoryEntry, error) {
+	defer s.lock()()
+	for _, e := range s.userHistory(tableID, name, userID) {
+		if e.ID == historyID {
+			return e, nil
+		}
+	}
+	return HistoryEntry{}, ErrNotFound
+}
+
+// Project tokens
+func (s *MemoryStore) CreateProjectToken(t ProjectToken, token string, userID int) (int, error) {
+	defer s.lock("tokens")()
+	if s.project(t.ProjectID, userID) == nil {
+		return 0, ErrNotFound
+	}
+	hash := hashToken(token)
+	for _, other := range s.d.tokens {
+		if other.hash == hash {
+			return 0, ErrExists
+		}
+	}
+	t.ID = s.d.nextID("project_tokens")
+	t.Tables = slices.Clone(t.Tables)
+	t.LastUsedAt = nil
+	t.CreatedAt = time.Now().Unix()
+	s.d.tokens = append(s.d.tokens, memToken{t, userID, hash})
+	return t.ID, nil
+}
+
+func (s *MemoryStore) ListProjectTokens(projectID int, userID int) ([]ProjectToken, error) {
+	defer s.lock()()
+	tokens := []ProjectToken{}
+	for _, t := range s.d.tokens {
+		if t.ProjectID == projectID && t.userID == userID {
+			tokens = append(tokens, t.ProjectToken)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *MemoryStore) RevokeProjectToken(tokenID, projectID int, userID int) error {
+	defer s.lock("tokens")()
+	n := len(s.d.tokens)
+	s.d.tokens = slices.DeleteFunc(s.d.tokens, func(t memToken) bool {
+		return t.ID == tokenID && t.ProjectID == projectID && t.userID == userID
+	})
+	if len(s.d.tokens) == n {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetProjectTokenByValue(token string) (t ProjectToken, userID int, err error) {
+	defer s.lock()()
+	now := time.Now().Unix()
+	hash := hashToken(token)
+	for i, stored := range s.d.tokens {
+		if stored.hash != hash || (stored.ExpiresAt != nil && *stored.ExpiresAt <= now) {
+			continue
+		}
+		// last use is kept to the minute so reads don't all turn into
+		// writes; it's only bookkeeping and never fails the lookup
+		if stored.LastUsedAt == nil || *stored.LastUsedAt < now-60 {
+			s.d.writes("tokens")
+			s.d.tokens[i].LastUsedAt = &now
+		}
+		return stored.ProjectToken, stored.userID, nil
+	}
+	return t, 0, ErrNotFound
+}
+
+// Webhooks
+func (s *MemoryStore) CreateWebhook(projectID, tableID int, url, secret string, userID int) (int, error) {
+	defer s.lock("webhooks")()
+	if s.project(projectID, userID) == nil {
+		return 0, ErrNotFound
+	}
+	id := s.d.nextID("webhooks")
+	s.d.webhooks = append(s.d.webhooks, Webhook{ID: id, ProjectID: projectID, TableID: tableID, URL: url, Secret: secret})
+	s.d.hookOwners[id] = userID
+	return id, nil
+}
+
+func (s *MemoryStore) ListWebhooks(projectID int, userID int) ([]Webhook, error) {
+	defer s.lock()()
+	webhooks := []Webhook{}
+	for _, h := range s.d.webhooks {
+		if h.ProjectID == projectID && s.d.hookOwners[h.ID] == userID {
+			h.Secret = ""
+			webhooks = append(webhooks, h)
+		}
+	}
+	return webhooks, nil
+}
+
+func (s *MemoryStore) DeleteWebhook(webhookID, projectID int, userID int) error {
+	defer s.lock()()
+	s.deleteWebhooks(func(h Webhook) bool {
+		return h.ID == webhookID && h.ProjectID == projectID && s.d.hookOwners[h.ID] == userID
+	})
+	return nil
+}
+
+// deleteWebhooks deletes the webhooks matching del with their deliveries.
+func (s *MemoryStore) deleteWebhooks(del func(h Webhook) bool) {
+	s.d.writes("webhooks", "deliveries")
+	var ids []int
+	s.d.webhooks = slices.DeleteFunc(s.d.webhooks, func(h Webhook) bool {
+		if del(h) {
+			ids = append(ids, h.ID)
+			delete(s.d.hookOwners, h.ID)
+			return true
+		}
+		return false
+	})
+	s.d.deliveries = slices.DeleteFunc(s.d.deliveries, func(d WebhookDelivery) bool {
+		return slices.Contains(ids, d.WebhookID)
+	})
+}
+
+func (s *MemoryStore) webhook(id int) *Webhook {
+	for i := range s.d.webhooks {
+		if s.d.webhooks[i].ID == id {
+			return &s.d.webhooks[i]
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) WebhooksForEvent(projectID, tableID int) ([]Webhook, error) {
+	defer s.lock()()
+	var webhooks []Webhook
+	for _, h := range s.d.webhooks {
+		if h.ProjectID == projectID && (h.TableID == 0 || h.TableID == tableID) {
+			webhooks = append(webhooks, h)
+		}
+	}
+	return webhooks, nil
+}
+
+func (s *MemoryStore) EnqueueWebhookDelivery(webhookID int, event, payload string, now int64) error {
+	defer s.lock("deliveries")()
+	if s.webhook(webhookID) == nil {
+		return ErrNotFound
+	}
+	s.d.deliveries = append(s.d.deliveries, WebhookDelivery{
+		ID:            s.d.nextID("webhook_deliveries"),
+		WebhookID:     webhookID,
+		Event:         event,
+		Payload:       payload,
+		Status:        "pending",
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+	return nil
+}
+
+func (s *MemoryStore) DueWebhookDeliveries(now int64, limit int) ([]WebhookDelivery, error) {
+	defer s.lock()()
+	var deliveries []WebhookDelivery
+	for _, d := range s.d.deliveries {
+		if len(deliveries) == limit {
+			break
+		}
+		if d.Status != "pending" || d.NextAttemptAt > now {
+			continue
+		}
+		h := s.webhook(d.WebhookID)
+		deliveries = append(deliveries, WebhookDelivery{
+			ID:        d.ID,
+			WebhookID: d.WebhookID,
+			Event:     d.Event,
+			Payload:   d.Payload,
+			Status:    d.Status,
+			Attempts:  d.Attempts,
+			URL:       h.URL,
+			Secret:    h.Secret,
+		})
+	}
+	return deliveries, nil
+}
+
+func (s *MemoryStore) UpdateWebhookDelivery(d WebhookDelivery) error {
+	defer s.lock("deliveries")()
+	if !slices.Contains([]string{"pending", "delivered", "failed"}, d.Status) {
+		return errInvalidValue
+	}
+	for i := range s.d.deliveries {
+		if stored := &s.d.deliveries[i]; stored.ID == d.ID {
+			stored.Status, stored.Attempts, stored.NextAttemptAt = d.Status, d.Attempts, d.NextAttemptAt
+			stored.ResponseCode, stored.LastError = d.ResponseCode, d.LastError
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListWebhookDeliveries(webhookID int, userID int, limit int) ([]WebhookDelivery, error) {
+	defer s.lock()()
+	deliveries := []WebhookDelivery{}
+	if s.webhook(webhookID) == nil || s.d.hookOwners[webhookID] != userID {
+		return deliveries, nil
+	}
+	for i := len(s.d.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if d := s.d.deliveries[i]; d.WebhookID == webhookID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+// Sessions
+func (s *MemoryStore) CreateSession(userID int, refreshToken string, expiresAt int64) (int, error) {
+	defer s.lock("sessions")()
+	if !slices.ContainsFunc(s.d.users, func(u memUser) bool { return u.id == userID }) {
+		return 0, ErrNotFound
+	}
+	hash := hashToken(refreshToken)
+	for _, other := range s.d.sessions {
+		if other.hash == hash {
+			return 0, ErrExists
+		}
+	}
+	now := time.Now().Unix()
+	id := s.d.nextID("sessions")
+	s.d.sessions = append(s.d.sessions, memSession{
+		Session: Session{ID: id, UserID: userID, CreatedAt: now, RotatedAt: now, ExpiresAt: expiresAt},
+		hash:    hash,
+	})
+	return id, nil
+}
+
+func (s *MemoryStore) GetSessionByRefreshToken(refreshToken string) (Session, error) {
+	defer s.lock()()
+	now := time.Now().Unix()
+	hash := hashToken(refreshToken)
+	for _, ses := range s.d.sessions {
+		if ses.ExpiresAt <= now {
+			continue
+		}
+		if ses.hash == hash || ses.previousHash == hash {
+			ses.Reused = ses.hash != hash
+			return ses.Session, nil
+		}
+	}
+	return Session{}, ErrNotFound
+}
+
+func (s *MemoryStore) RotateSession(sessionID int, oldToken, newToken string, expiresAt int64) error {
+	defer s.lock("sessions")()
+	oldHash, hash := hashToken(oldToken), hashToken(newToken)
+	for _, other := range s.d.sessions {
+		if other.hash == hash {
+			return ErrExists
+		}
+	}
+	for i := range s.d.sessions {
+		if ses := &s.d.sessions[i]; ses.ID == sessionID && ses.hash == oldHash {
+			ses.previousHash, ses.hash = ses.hash, hash
+			ses.RotatedAt = time.Now().Unix()
+			ses.ExpiresAt = expiresAt
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) GetSession(sessionID, userID int) (Session, error) {
+	defer s.lock()()
+	now := time.Now().Unix()
+	for _, ses := range s.d.sessions {
+		if ses.ID == sessionID && ses.UserID == userID && ses.ExpiresAt > now {
+			return ses.Session, nil
+		}
+	}
+	return Session{}, ErrNotFound
+}
+
+func (s *MemoryStore) DeleteSession(sessionID, userID int) error {
+	defer s.lock("sessions")()
+	n := len(s.d.sessions)
+	s.d.sessions = slices.DeleteFunc(s.d.sessions, func(ses memSession) bool {
+		return ses.ID == sessionID && ses.UserID == userID
+	})
+	if len(s.d.sessions) == n {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteUserSessions(userID int) error {
+	defer s.lock("sessions")()
+	s.d.sessions = slices.DeleteFunc(s.d.sessions, func(ses memSession) bool { return ses.UserID == userID })
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpiredSessions(now int64) error {
+	defer s.lock("sessions")()
+	s.d.sessions = slices.DeleteFunc(s.d.sessions, func(ses memSession) bool { return ses.ExpiresAt <= now })
+	return nil
+}
+
+// Invites
+func (s *MemoryStore) CreateInvite(code string, expiresAt int64) error {
+	defer s.lock("invites")()
+	hash := hashToken(code)
+	for _, inv := range s.d.invites {
+		if inv.hash == hash {
+			return ErrExists
+		}
+	}
+	s.d.invites = append(s.d.invites, memInvite{hash: hash, expiresAt: expiresAt})
+	return nil
+}
+
+func (s *MemoryStore) UseInvite(code string, userID int) error {
+	defer s.lock("invites")()
+	if s.user(userID) == nil {
+		return ErrNotFound
+	}
+	hash, now := hashToken(code), time.Now().Unix()
+	for i := range s.d.invites {
+		if inv := &s.d.invites[i]; inv.hash == hash && inv.usedAt == 0 && inv.expiresAt > now {
+			inv.usedBy, inv.usedAt = userID, now
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Two-factor authentication
+func (s *MemoryStore) GetTOTP(userID int) (TOTP, error) {
+	defer s.lock()()
+	u := s.user(userID)
+	if u == nil {
+		return TOTP{}, ErrNotFound
+	}
+	return TOTP{
+		Secret:        u.totpSecret,
+		Enabled:       u.totpEnabled,
+		LastStep:      u.totpLastStep,
+		RecoveryCodes: len(u.recoveryHashes),
+	}, nil
+}
+
+func (s *MemoryStore) SetTOTPSecret(userID int, secret string) error {
+	defer s.lock("users")()
+	u := s.user(userID)
+	if u == nil {
+		return ErrNotFound
+	}
+	u.totpSecret, u.totpEnabled = secret, false
+	return nil
+}
+
+func (s *MemoryStore) EnableTOTP(userID int) error {
+	defer s.lock("users")()
+	u := s.user(userID)
+	if u == nil {
+		return ErrNotFound
+	}
+	u.totpEnabled = true
+	return nil
+}
+
+func (s *MemoryStore) DisableTOTP(userID int) error {
+	defer s.lock("users")()
+	u := s.user(userID)
+	if u == nil {
+		return ErrNotFound
+	}
+	u.totpSecret, u.totpEnabled, u.totpLastStep, u.recoveryHashes = "", false, 0, nil
+	return nil
+}
+
+func (s *MemoryStore) UseTOTPStep(userID int, step int64) error {
+	defer s.lock("users")()
+	u := s.user(userID)
+	if u == nil || u.totpLastStep >= step {
+		return ErrNotFound
+	}
+	u.totpLastStep = step
+	return nil
+}
+
+func (s *MemoryStore) SetRecoveryCodes(userID int, codes []string) error {
+	defer s.lock("users")()
+	u := s.user(userID)
+	if u == nil {
+		return ErrNotFound
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashToken(code)
+	}
+	u.recoveryHashes = hashes
+	return nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(userID int, code string) error {
+	defer s.lock("users")()
+	u := s.user(userID)
+	if u == nil {
+		return ErrNotFound
+	}
+	hash := hashToken(code)
+	if !slices.Contains(u.recoveryHashes, hash) {
+		return ErrNotFound
+	}
+	// a new slice, as transactions share the old one
+	u.recoveryHashes = slices.DeleteFunc(slices.Clone(u.recoveryHashes), func(h string) bool { return h == hash })
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// migration is one numbered step of the schema. Steps are only ever
+// appended; a released step is never changed, so every database that ran
+// it ended up in the same state.
+//
+// Databases from before schema_migrations existed may already be anywhere
+// between steps, which is why the early steps only create what's missing.
+type migration struct {
+	version int
+	name    string
+	up      func(tx DBTX) error
+}
+
+var migrations = []migration{
+	{1, "create users, projects, tables and variables", execAll(
+		`CREATE TABLE IF NOT EXISTS users (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            username TEXT NOT NULL UNIQUE,
+            password_hash TEXT NOT NULL
+        );`,
+		`CREATE TABLE IF NOT EXISTS projects (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            token TEXT NOT NULL UNIQUE,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+		`CREATE TABLE IF NOT EXISTS tables (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            project_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            FOREIGN KEY(project_id) REFERENCES projects(id) ON DELETE CASCADE,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+            UNIQUE(project_id, user_id, name)
+        );`,
+		`CREATE TABLE IF NOT EXISTS variables (
+            name TEXT NOT NULL PRIMARY KEY,
+            table_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            value TEXT,
+            type TEXT NOT NULL CHECK (type IN ('string','int','float','bool')),
+            FOREIGN KEY(table_id) REFERENCES tables(id) ON DELETE CASCADE,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+            UNIQUE(table_id, user_id, name)
+        );`,
+	)},
+	{2, "create webhooks", execAll(
+		`CREATE TABLE IF NOT EXISTS webhooks (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            project_id INTEGER NOT NULL,
+            table_id INTEGER,
+            user_id INTEGER NOT NULL,
+            url TEXT NOT NULL,
+            secret TEXT NOT NULL,
+            FOREIGN KEY(project_id) REFERENCES projects(id) ON DELETE CASCADE,
+            FOREIGN KEY(table_id) REFERENCES tables(id) ON DELETE CASCADE,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            webhook_id INTEGER NOT NULL,
+            event TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending','delivered','failed')),
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt_at INTEGER NOT NULL,
+            response_code INTEGER NOT NULL DEFAULT 0,
+            last_error TEXT NOT NULL DEFAULT '',
+            created_at INTEGER NOT NULL,
+            FOREIGN KEY(webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+        );`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);`,
+	)},
+	{3, "add variable revisions", func(tx DBTX) error {
+		return addColumnIfMissing(tx, "variables", "revision", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{4, "create variable history", func(tx DBTX) error {
+		err := execAll(
+			`CREATE TABLE IF NOT EXISTS variable_history (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            table_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            value TEXT,
+            type TEXT NOT NULL,
+            revision INTEGER NOT NULL,
+            actor TEXT NOT NULL,
+            created_at INTEGER NOT NULL,
+            FOREIGN KEY(table_id) REFERENCES tables(id) ON DELETE CASCADE
+        );`,
+			`CREATE INDEX IF NOT EXISTS variable_history_variable ON variable_history(table_id, name, id);`,
+		)(tx)
+		if err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "projects", "history_retention", "INTEGER NOT NULL DEFAULT 50")
+	}},
+	{5, "create project tokens", execAll(
+		`CREATE TABLE IF NOT EXISTS project_tokens (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            project_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            token_hash TEXT NOT NULL UNIQUE,
+            read_only INTEGER NOT NULL DEFAULT 0,
+            tables TEXT,
+            expires_at INTEGER,
+            last_used_at INTEGER,
+            created_at INTEGER NOT NULL,
+            FOREIGN KEY(project_id) REFERENCES projects(id) ON DELETE CASCADE,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+	)},
+	{6, "add previous project tokens", func(tx DBTX) error {
+		if err := addColumnIfMissing(tx, "projects", "previous_token", "TEXT"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(tx, "projects", "previous_token_expires_at", "INTEGER"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS projects_previous_token ON projects(previous_token);`)
+		return err
+	}},
+	// brings in the structured, datetime, duration and enum types, options,
+	// constraints and the surrogate key; variablesTable has to stay as it is
+	// now unless a later step rebuilds the table again
+	{7, "rebuild variables", func(tx DBTX) error {
+		return rebuildTable(tx, "variables", variablesTable)
+	}},
+	{8, "create sessions", execAll(
+		`CREATE TABLE IF NOT EXISTS sessions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            token_hash TEXT NOT NULL UNIQUE,
+            previous_token_hash TEXT,
+            created_at INTEGER NOT NULL,
+            rotated_at INTEGER NOT NULL,
+            expires_at INTEGER NOT NULL,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+		`CREATE INDEX IF NOT EXISTS sessions_previous_token ON sessions(previous_token_hash);`,
+		`CREATE INDEX IF NOT EXISTS sessions_user ON sessions(user_id);`,
+		`CREATE INDEX IF NOT EXISTS sessions_expires ON sessions(expires_at);`,
+	)},
+	{9, "add user emails", func(tx DBTX) error {
+		for _, c := range [][2]string{
+			{"email", "TEXT"},
+			{"email_verified", "INTEGER NOT NULL DEFAULT 0"},
+			{"email_token_hash", "TEXT"},
+			{"email_token_expires_at", "INTEGER"},
+		} {
+			if err := addColumnIfMissing(tx, "users", c[0], c[1]); err != nil {
+				return err
+			}
+		}
+		return execAll(
+			`CREATE UNIQUE INDEX IF NOT EXISTS users_email ON users(email);`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS users_email_token ON users(email_token_hash);`,
+		)(tx)
+	}},
+	{10, "add registration approval and invites", func(tx DBTX) error {
+		if err := addColumnIfMissing(tx, "users", "approved", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+			return err
+		}
+		return execAll(
+			`CREATE TABLE IF NOT EXISTS invites (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            code_hash TEXT NOT NULL UNIQUE,
+            created_at INTEGER NOT NULL,
+            expires_at INTEGER NOT NULL,
+            used_by INTEGER,
+            used_at INTEGER,
+            FOREIGN KEY(used_by) REFERENCES users(id) ON DELETE SET NULL
+        );`,
+		)(tx)
+	}},
+	{11, "add two-factor authentication", func(tx DBTX) error {
+		for _, c := range [][2]string{
+			{"totp_secret", "TEXT"},
+			{"totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+			{"totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		} {
+			if err := addColumnIfMissing(tx, "users", c[0], c[1]); err != nil {
+				return err
+			}
+		}
+		return execAll(
+			`CREATE TABLE IF NOT EXISTS recovery_codes (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            code_hash TEXT NOT NULL,
+            UNIQUE(user_id, code_hash),
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+		)(tx)
+	}},
+	// Versions belong to the variable they were recorded for and go with
+	// it. Those of variables deleted before this step are dropped; there is
+	// no telling which of them came before a variable was recreated.
+	{12, "key variable history by variable", func(tx DBTX) error {
+		err := addColumnIfMissing(tx, "variable_history", "variable_id",
+			"INTEGER REFERENCES variables(id) ON DELETE CASCADE")
+		if err != nil {
+			return err
+		}
+		return execAll(
+			`UPDATE variable_history SET variable_id = (
+            SELECT v.id FROM variables v
+            WHERE v.table_id = variable_history.table_id AND v.name = variable_history.name
+        ) WHERE variable_id IS NULL;`,
+			`DELETE FROM variable_history WHERE variable_id IS NULL;`,
+			`DROP INDEX IF EXISTS variable_history_variable;`,
+			`CREATE INDEX IF NOT EXISTS variable_history_variable_id ON variable_history(variable_id, id);`,
+		)(tx)
+	}},
+	// An unverified email proves nothing, so it mustn't keep the owner of
+	// the address from claiming it.
+	{13, "only keep verified emails unique", execAll(
+		`DROP INDEX IF EXISTS users_email;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS users_verified_email ON users(email) WHERE email_verified = 1;`,
+	)},
+}
+
+// execAll returns a migration step running stmts in order.
+func execAll(stmts ...string) func(tx DBTX) error {
+	return func(tx DBTX) error {
+		for _, s := range stmts {
+			if _, err := tx.Exec(s); err != nil {
+				return fmt.Errorf("%w\nstmt: %s", err, s)
+			}
+		}
+		return nil
+	}
+}
+
+const schemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at INTEGER NOT NULL
+        );`
+
+// migrate applies the steps the database hasn't run yet, each in its own
+// transaction. A database that ran steps beyond the given ones belongs to a
+// newer binary and is refused.
+func migrate(db *sql.DB, steps []migration) error {
+	// foreign keys are off while tables are rebuilt, as SQLite recommends;
+	// that's a per-connection setting, so pin one
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, schemaMigrationsTable); err != nil {
+		return err
+	}
+	var version int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(steps) {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d)", version, len(steps))
+	}
+	if version == len(steps) {
+		return nil
+	}
+
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+
+	return applyMigrations(ctx, conn, steps[version:],
+		`INSERT INTO schema_migrations(version, name, applied_at) VALUES(?, ?, ?)`)
+}
+
+// applyMigrations runs steps on conn, each in its own transaction along with
+// record, which inserts the step's version, name and time into
+// schema_migrations.
+func applyMigrations(ctx context.Context, conn *sql.Conn, steps []migration, record string) error {
+	for _, m := range steps {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(record, m.version, m.name, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrationStatus is a migration step and when it was applied, if it was.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *int64
+}
+
+// MigrationStatuses lists the steps of this binary along with any applied
+// by a newer one, in order. It doesn't change the database.
+func MigrationStatuses(db *sql.DB) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(db,
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`)
+	if err != nil {
+		return nil, err
+	}
+	return migrationStatuses(migrations, applied), nil
+}
+
+// migrationStatuses merges steps with the applied ones.
+func migrationStatuses(steps []migration, applied map[int]MigrationStatus) []MigrationStatus {
+	statuses := make([]MigrationStatus, len(steps))
+	for i, m := range steps {
+		statuses[i] = MigrationStatus{Version: m.version, Name: m.name}
+		if s, ok := applied[m.version]; ok {
+			statuses[i].AppliedAt = s.AppliedAt
+			delete(applied, m.version)
+		}
+	}
+	// whatever is left was applied by a newer binary
+	for _, s := range applied {
+		statuses = append(statuses, s)
+	}
+	slices.SortFunc(statuses, func(a, b MigrationStatus) int { return a.Version - b.Version })
+	return statuses
+}
+
+// appliedMigrations returns the steps recorded in schema_migrations by
+// version; none if tracked, which counts the schema_migrations tables,
+// finds none.
+func appliedMigrations(db *sql.DB, tracked string) (map[int]MigrationStatus, error) {
+	applied := map[int]MigrationStatus{}
+	var n int
+	err := db.QueryRow(tracked).Scan(&n)
+	if err != nil || n == 0 {
+		return applied, err
+	}
+
+	rows, err := db.Query(`SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s MigrationStatus
+		var at int64
+		if err := rows.Scan(&s.Version, &s.Name, &at); err != nil {
+			return nil, err
+		}
+		s.AppliedAt = &at
+		applied[s.Version] = s
+	}
+	return applied, rows.Err()
+}
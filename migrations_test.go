@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	for _, steps := range [][]migration{migrations, pgMigrations} {
+		for i, m := range steps {
+			assert.Equal(t, i+1, m.version, m.name)
+		}
+	}
+}
+
+func TestPostgresErrors(t *testing.T) {
+	assert.ErrorIs(t, pgCheckError(&pq.Error{Code: "23514"}), errInvalidValue)
+	assert.ErrorIs(t, pgCheckError(&pq.Error{Code: "23505"}), ErrExists)
+	assert.ErrorIs(t, pgCheckError(&pq.Error{Code: "23503"}), ErrNotFound)
+	other := &pq.Error{Code: "42P01"}
+	assert.Equal(t, other, pgCheckError(other))
+	assert.Equal(t, "dbname=app search_path=s", withSearchPath("dbname=app", "s"))
+	assert.Equal(t, "postgres://localhost/app?search_path=s&sslmode=disable", withSearchPath("postgres://localhost/app?sslmode=disable", "s"))
+}
+
+// fixtureDB copies app.db, a database from the first release, to a
+// temporary file.
+func fixtureDB(t *testing.T) string {
+	legacy, err := os.ReadFile("app.db")
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "app.db")
+	assert.NoError(t, os.WriteFile(path, legacy, 0o600))
+	return path
+}
+
+func TestMigrateFixture(t *testing.T) {
+	db := OpenDB(fixtureDB(t))
+	defer db.Close()
+
+	statuses, err := MigrationStatuses(db)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, len(migrations))
+	for _, s := range statuses {
+		assert.Nil(t, s.AppliedAt, s.Name)
+	}
+
+	// stop halfway, as an older binary would have
+	assert.NoError(t, migrate(db, migrations[:3]))
+	var revisions int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('variables') WHERE name = 'revision'`).Scan(&revisions))
+	assert.Equal(t, 1, revisions)
+	_, err = db.Exec(`INSERT INTO variables(name, table_id, user_id, value, type) VALUES('Added', 1, 1, '7', 'int')`)
+	assert.NoError(t, err)
+
+	assert.NoError(t, migrate(db, migrations))
+	assert.NoError(t, migrate(db, migrations))
+	statuses, err = MigrationStatuses(db)
+	assert.NoError(t, err)
+	for _, s := range statuses {
+		assert.NotNil(t, s.AppliedAt, s.Name)
+	}
+
+	store := NewSQLStore(db)
+	vars, err := store.ListVariables(1, 1)
+	assert.NoError(t, err)
+	values := map[string]string{}
+	for _, v := range vars {
+		values[v.Name] = v.Value
+	}
+	assert.Equal(t, map[string]string{"Variable": "", "Variable1": "", "Variable2": "", "Added": "7"}, values)
+
+	// everything added along the way is there
+	_, _, _, err = store.GetProjectByToken("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.CreateWebhook(1, 1, "https://example.com", "secret", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, store.SetHistoryRetention(1, 10, 1))
+}
+
+func TestMigrateRefusesNewerDatabase(t *testing.T) {
+	db := OpenDB(fixtureDB(t))
+	defer db.Close()
+
+	assert.NoError(t, migrate(db, migrations))
+	_, err := db.Exec(`INSERT INTO schema_migrations(version, name, applied_at) VALUES(?, 'from the future', 0)`, len(migrations)+1)
+	assert.NoError(t, err)
+
+	err = migrate(db, migrations)
+	assert.ErrorContains(t, err, "newer than this binary")
+
+	statuses, err := MigrationStatuses(db)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, len(migrations)+1)
+	assert.Equal(t, "from the future", statuses[len(migrations)].Name)
+}
@@ -2,55 +2,219 @@ package main
 
 import (
 	"database/sql"
-	"errors"
+	"encoding/json"
+	"log"
+	"time"
 )
 
-// ErrNotFound is returned when a row isn't found.
-var ErrNotFound = errors.New("not found")
+// DBTX is implemented by both *sql.DB and *sql.Tx, so helpers taking it can
+// run inside or outside a transaction.
+type DBTX interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// SQLStore is the Store kept in a SQLite database set up by InitDB.
+type SQLStore struct {
+	db DBTX
+}
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) Tx(fn func(tx Store) error) error {
+	return s.tx(func(tx *SQLStore) error { return fn(tx) })
+}
 
-// User
-func CreateUser(db *sql.DB, username, pwHash string) error {
-	_, err := db.Exec(`INSERT INTO users(username,password_hash) VALUES(?,?)`, username, pwHash)
+func (s *SQLStore) tx(fn func(tx *SQLStore) error) error {
+	db, ok := s.db.(*sql.DB)
+	if !ok {
+		// already in a transaction
+		return savepoint(s.db, func() error { return fn(s) })
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(&SQLStore{db: tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// savepoint runs fn within a savepoint of the transaction tx and rolls back
+// to it if fn fails, undoing only fn's changes. On Postgres that also clears
+// the error state a failed statement leaves the transaction in. SQLite and
+// Postgres both resolve a name to its latest savepoint, so nesting works.
+func savepoint(tx DBTX, fn func() error) error {
+	if _, err := tx.Exec(`SAVEPOINT nested`); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if _, rbErr := tx.Exec(`ROLLBACK TO SAVEPOINT nested`); rbErr != nil {
+			return rbErr
+		}
+		if _, rbErr := tx.Exec(`RELEASE SAVEPOINT nested`); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+	_, err := tx.Exec(`RELEASE SAVEPOINT nested`)
 	return err
 }
-func GetUserByUsername(db *sql.DB, username string) (id int, pwHash string, err error) {
-	err = db.QueryRow(`SELECT id,password_hash FROM users WHERE username = ?`, username).Scan(&id, &pwHash)
+
+// Users
+func (s *SQLStore) CreateUser(username, pwHash string) error {
+	_, err := s.db.Exec(`INSERT INTO users(username,password_hash) VALUES(?,?)`, username, pwHash)
+	return checkError(err)
+}
+func (s *SQLStore) GetUserByUsername(username string) (id int, pwHash string, err error) {
+	err = s.db.QueryRow(`SELECT id,password_hash FROM users WHERE username = ?`, username).Scan(&id, &pwHash)
 	if err == sql.ErrNoRows {
 		return 0, "", ErrNotFound
 	}
 	return
 }
 
-// Project
-func CreateProject(db *sql.DB, userID int, name, token string) (int, error) {
-	res, err := db.Exec(
+func (s *SQLStore) GetUser(userID int) (User, error) {
+	var u User
+	var email sql.NullString
+	err := s.db.QueryRow(
+		`SELECT id,username,email,email_verified,approved,totp_enabled,password_hash FROM users WHERE id = ?`, userID,
+	).Scan(&u.ID, &u.Username, &email, &u.EmailVerified, &u.Approved, &u.TOTPEnabled, &u.PasswordHash)
+	if err == sql.ErrNoRows {
+		return u, ErrNotFound
+	}
+	u.Email = email.String
+	return u, err
+}
+
+func (s *SQLStore) RenameUser(userID int, username string) error {
+	res, err := s.db.Exec(`UPDATE users SET username = ? WHERE id = ?`, username, userID)
+	if err != nil {
+		return checkError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) SetUserPassword(userID int, pwHash string) error {
+	res, err := s.db.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, pwHash, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) SetUserEmail(userID int, email, verifyToken string, expiresAt int64) error {
+	var address, hash, expires any
+	if email != "" {
+		address, hash, expires = email, hashToken(verifyToken), expiresAt
+	}
+	return s.tx(func(tx *SQLStore) error {
+		var taken int
+		err := tx.db.QueryRow(
+			`SELECT COUNT(*) FROM users WHERE email = ? AND email_verified = 1 AND id <> ?`, address, userID,
+		).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrExists
+		}
+		return tx.updateUser(
+			`UPDATE users SET email = ?, email_verified = 0, email_token_hash = ?,
+             email_token_expires_at = ? WHERE id = ?`,
+			address, hash, expires, userID,
+		)
+	})
+}
+
+func (s *SQLStore) VerifyUserEmail(verifyToken string) (userID int, err error) {
+	err = s.db.QueryRow(
+		`UPDATE users SET email_verified = 1, email_token_hash = NULL, email_token_expires_at = NULL
+         WHERE email_token_hash = ? AND email_token_expires_at > ?
+         RETURNING id`,
+		hashToken(verifyToken), time.Now().Unix(),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return userID, checkError(err)
+}
+
+func (s *SQLStore) DeleteUser(userID int) error {
+	res, err := s.db.Exec(`DELETE FROM users WHERE id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) SetUserApproved(userID int, approved bool) error {
+	res, err := s.db.Exec(`UPDATE users SET approved = ? WHERE id = ?`, approved, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) ListPendingUsers() ([]User, error) {
+	rows, err := s.db.Query(
+		`SELECT id,username,email,email_verified,password_hash FROM users WHERE approved = 0 ORDER BY id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var u User
+		var email sql.NullString
+		if err := rows.Scan(&u.ID, &u.Username, &email, &u.EmailVerified, &u.PasswordHash); err != nil {
+			return nil, err
+		}
+		u.Email = email.String
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Projects
+func (s *SQLStore) CreateProject(userID int, name, token string) (int, error) {
+	res, err := s.db.Exec(
 		`INSERT INTO projects(user_id,name,token) VALUES(?,?,?)`,
 		userID, name, token,
 	)
 	if err != nil {
-		return 0, err
+		return 0, checkError(err)
 	}
 	pid, _ := res.LastInsertId()
 	return int(pid), nil
 }
 
-func ListProjects(db *sql.DB, userID int) ([]struct {
-	ID   int
-	Name string
-}, error) {
-	rows, err := db.Query(`SELECT id, name FROM projects WHERE user_id = ?`, userID)
+func (s *SQLStore) ListProjects(userID int) ([]Project, error) {
+	rows, err := s.db.Query(`SELECT id, name FROM projects WHERE user_id = ? ORDER BY id`, userID)
 	if err != nil {
 		return nil, err
 	}
-	var projects []struct {
-		ID   int
-		Name string
-	}
+	var projects []Project
 	for rows.Next() {
-		var project struct {
-			ID   int
-			Name string
-		}
+		var project Project
 		if err := rows.Scan(&project.ID, &project.Name); err != nil {
 			return nil, err
 		}
@@ -59,60 +223,74 @@ func ListProjects(db *sql.DB, userID int) ([]struct {
 	return projects, nil
 }
 
-func GetProjectByToken(db *sql.DB, token string) (id, userID int, err error) {
-	err = db.QueryRow(`SELECT id,user_id FROM projects WHERE token = ?`, token).Scan(&id, &userID)
+func (s *SQLStore) GetProjectByToken(token string) (id, userID int, sunset int64, err error) {
+	err = s.db.QueryRow(`SELECT id,user_id FROM projects WHERE token = ?`, token).Scan(&id, &userID)
 	if err == sql.ErrNoRows {
-		return 0, 0, ErrNotFound
+		err = s.db.QueryRow(
+			`SELECT id,user_id,previous_token_expires_at FROM projects
+             WHERE previous_token = ? AND previous_token_expires_at > ?`,
+			token, time.Now().Unix(),
+		).Scan(&id, &userID, &sunset)
+	}
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, ErrNotFound
 	}
 	return
 }
-func GetProject(db *sql.DB, projID, userID int) (map[string]any, error) {
+
+func (s *SQLStore) RotateProjectToken(projID int, token string, graceUntil int64, userID int) error {
+	now := time.Now().Unix()
+	return s.tx(func(tx *SQLStore) error {
+		var previousExpiresAt *int64
+		err := tx.db.QueryRow(
+			`SELECT previous_token_expires_at FROM projects WHERE id = ? AND user_id = ?`,
+			projID, userID,
+		).Scan(&previousExpiresAt)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if graceUntil > now && previousExpiresAt != nil && *previousExpiresAt > now {
+			return ErrTokenInGrace
+		}
+		_, err = tx.db.Exec(
+			`UPDATE projects SET previous_token = token, previous_token_expires_at = ?, token = ?
+             WHERE id = ? AND user_id = ?`,
+			graceUntil, token, projID, userID,
+		)
+		return checkError(err)
+	})
+}
+func (s *SQLStore) GetProject(projID, userID int) (map[string]any, error) {
 	var name string
 	var token string
-	err := db.QueryRow(
-		`SELECT name, token FROM projects WHERE id = ? AND user_id = ?`,
+	var previousExpiresAt *int64
+	err := s.db.QueryRow(
+		`SELECT name, token, previous_token_expires_at FROM projects WHERE id = ? AND user_id = ?`,
 		projID, userID,
-	).Scan(&name, &token)
+	).Scan(&name, &token, &previousExpiresAt)
 	if err == sql.ErrNoRows {
 		return nil, ErrNotFound
-	}
-	tables, err := ListTables(db, projID, userID)
-	if err != nil {
+	} else if err != nil {
 		return nil, err
 	}
-
-	type TableWithVariables struct {
-		ID        int
-		Name      string
-		Variables []struct {
-			Name  string
-			Type  string
-			Value string
-		}
-	}
-	var tablesWithVariables []TableWithVariables
-	// For each table, get the variables
-	for _, table := range tables {
-		variables, _ := ListVariables(db, table.ID, userID)
-		tablesWithVariables = append(tablesWithVariables, TableWithVariables{ID: table.ID, Name: table.Name, Variables: variables})
-	}
-
-	return map[string]any{"name": name, "token": token, "tables": tablesWithVariables}, err
+	return projectDetails(s, projID, userID, name, token, previousExpiresAt)
 }
 
-func RenameProject(db *sql.DB, projID int, name string, userID int) error {
-	_, err := db.Exec(`UPDATE projects SET name = ? WHERE id = ? AND user_id = ?`, name, projID, userID)
+func (s *SQLStore) RenameProject(projID int, name string, userID int) error {
+	_, err := s.db.Exec(`UPDATE projects SET name = ? WHERE id = ? AND user_id = ?`, name, projID, userID)
 	return err
 }
 
-func DeleteProject(db *sql.DB, projID int, userID int) error {
-	_, err := db.Exec(`DELETE FROM projects WHERE id = ? AND user_id = ?`, projID, userID)
+func (s *SQLStore) DeleteProject(projID int, userID int) error {
+	_, err := s.db.Exec(`DELETE FROM projects WHERE id = ? AND user_id = ?`, projID, userID)
 	return err
 }
 
-// Table
-func CreateTable(db *sql.DB, projectID int, name string, userID int) (int, error) {
-	res, err := db.Exec(
+// Tables
+func (s *SQLStore) CreateTable(projectID int, name string, userID int) (int, error) {
+	res, err := s.db.Exec(
 		`INSERT INTO tables(project_id,user_id,name)
          SELECT ?,?,?
          FROM projects WHERE id = ? AND user_id = ?`,
@@ -120,14 +298,17 @@ func CreateTable(db *sql.DB, projectID int, name string, userID int) (int, error
 		projectID, userID,
 	)
 	if err != nil {
-		return 0, err
+		return 0, checkError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrNotFound
 	}
 	tid, _ := res.LastInsertId()
 	return int(tid), nil
 }
-func GetTableID(db *sql.DB, projectID int, name string, userID int) (int, error) {
+func (s *SQLStore) GetTableID(projectID int, name string, userID int) (int, error) {
 	var id int
-	err := db.QueryRow(
+	err := s.db.QueryRow(
 		`SELECT id FROM tables WHERE project_id = ? AND name = ? AND user_id = ?`,
 		projectID, name, userID,
 	).Scan(&id)
@@ -137,34 +318,34 @@ func GetTableID(db *sql.DB, projectID int, name string, userID int) (int, error)
 	return id, err
 }
 
-func DeleteTable(db *sql.DB, tableID int, userID int) error {
-	_, err := db.Exec(`DELETE FROM tables WHERE id = ? AND user_id = ?`, tableID, userID)
-	return err
+func (s *SQLStore) GetTableProjectID(tableID int) (int, error) {
+	var projectID int
+	err := s.db.QueryRow(`SELECT project_id FROM tables WHERE id = ?`, tableID).Scan(&projectID)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return projectID, err
 }
 
-func RenameTable(db *sql.DB, tableID int, name string, userID int) error {
-	_, err := db.Exec(`UPDATE tables SET name = ? WHERE id = ? AND user_id = ?`, name, tableID, userID)
+func (s *SQLStore) DeleteTable(tableID int, userID int) error {
+	_, err := s.db.Exec(`DELETE FROM tables WHERE id = ? AND user_id = ?`, tableID, userID)
 	return err
 }
 
-func ListTables(db *sql.DB, projectID int, userID int) ([]struct {
-	ID   int
-	Name string
-}, error) {
-	rows, err := db.Query(`SELECT id, name FROM tables WHERE project_id = ? AND user_id = ?`, projectID, userID)
+func (s *SQLStore) RenameTable(tableID int, name string, userID int) error {
+	_, err := s.db.Exec(`UPDATE tables SET name = ? WHERE id = ? AND user_id = ?`, name, tableID, userID)
+	return checkError(err)
+}
+
+func (s *SQLStore) ListTables(projectID int, userID int) ([]Table, error) {
+	rows, err := s.db.Query(`SELECT id, name FROM tables WHERE project_id = ? AND user_id = ? ORDER BY name`, projectID, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	var tables []struct {
-		ID   int
-		Name string
-	}
+	var tables []Table
 	for rows.Next() {
-		var table struct {
-			ID   int
-			Name string
-		}
+		var table Table
 		if err := rows.Scan(&table.ID, &table.Name); err != nil {
 			return nil, err
 		}
@@ -173,36 +354,78 @@ func ListTables(db *sql.DB, projectID int, userID int) ([]struct {
 	return tables, nil
 }
 
-// Variable
-func CreateVariable(db *sql.DB, tableID int, name, value, typ string, userID int) error {
-	_, err := db.Exec(
-		`INSERT INTO variables(table_id,user_id,name,value,type) VALUES(?,?,?,?,?)`,
-		tableID, userID, name, value, typ,
+// Variables
+func (s *SQLStore) CreateVariable(tableID int, name, value, typ string, options []string, c Constraints, userID int) error {
+	value, err := prepareVariable(value, typ, options, c)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(
+		`INSERT INTO variables(table_id,user_id,name,value,type,options,constraints)
+         SELECT id,?,?,?,?,?,? FROM tables WHERE id = ? AND user_id = ?`,
+		userID, name, value, typ, encodeOptions(options), encodeConstraints(c),
+		tableID, userID,
 	)
-	return err
+	if err != nil {
+		return checkError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// encodeOptions returns how the allowed values of an enum are stored.
+func encodeOptions(options []string) any {
+	if options == nil {
+		return nil
+	}
+	b, _ := json.Marshal(options)
+	return string(b)
+}
+
+func encodeConstraints(c Constraints) any {
+	if c.isZero() {
+		return nil
+	}
+	b, _ := json.Marshal(c)
+	return string(b)
 }
 
-func ListVariables(db *sql.DB, tableID int, userID int) ([]struct {
-	Name  string
-	Type  string
-	Value string
-}, error) {
-	rows, err := db.Query(`SELECT name, type, value FROM variables WHERE table_id = ? AND user_id = ?`, tableID, userID)
+func decodeConstraints(stored sql.NullString) (Constraints, error) {
+	var c Constraints
+	if !stored.Valid {
+		return c, nil
+	}
+	err := json.Unmarshal([]byte(stored.String), &c)
+	return c, err
+}
+
+func decodeOptions(stored sql.NullString) ([]string, error) {
+	if !stored.Valid {
+		return nil, nil
+	}
+	var options []string
+	err := json.Unmarshal([]byte(stored.String), &options)
+	return options, err
+}
+
+func (s *SQLStore) ListVariables(tableID int, userID int) ([]Variable, error) {
+	rows, err := s.db.Query(`SELECT name, type, value, options, constraints FROM variables WHERE table_id = ? AND user_id = ? ORDER BY name`, tableID, userID)
 	if err != nil {
 		return nil, err
 	}
-	var variables []struct {
-		Name  string
-		Type  string
-		Value string
-	}
+	var variables []Variable
 	for rows.Next() {
-		var variable struct {
-			Name  string
-			Type  string
-			Value string
+		var variable Variable
+		var options, constraints sql.NullString
+		if err := rows.Scan(&variable.Name, &variable.Type, &variable.Value, &options, &constraints); err != nil {
+			return nil, err
+		}
+		if variable.Options, err = decodeOptions(options); err != nil {
+			return nil, err
 		}
-		if err := rows.Scan(&variable.Name, &variable.Type, &variable.Value); err != nil {
+		if variable.Constraints, err = decodeConstraints(constraints); err != nil {
 			return nil, err
 		}
 		variables = append(variables, variable)
@@ -210,42 +433,160 @@ func ListVariables(db *sql.DB, tableID int, userID int) ([]struct {
 	return variables, nil
 }
 
-func DeleteVariable(db *sql.DB, tableID int, name string, userID int) error {
-	_, err := db.Exec(`DELETE FROM variables WHERE table_id = ? AND name = ? AND user_id = ?`, tableID, name, userID)
-	return err
+func (s *SQLStore) GetVariableRules(tableID int, name string) (options []string, c Constraints, err error) {
+	var storedOptions, storedConstraints sql.NullString
+	err = s.db.QueryRow(
+		`SELECT options, constraints FROM variables WHERE name = ? AND table_id = ?`,
+		name, tableID,
+	).Scan(&storedOptions, &storedConstraints)
+	if err == sql.ErrNoRows {
+		return nil, c, ErrNotFound
+	} else if err != nil {
+		return nil, c, err
+	}
+	if options, err = decodeOptions(storedOptions); err != nil {
+		return nil, c, err
+	}
+	c, err = decodeConstraints(storedConstraints)
+	return options, c, err
 }
 
-func UpdateVariable(db *sql.DB, tableID int, name, typ string, userID int) error {
-	_, err := db.Exec(
-		`UPDATE variables SET type = ? WHERE table_id = ? AND name = ? AND user_id = ?`,
-		typ, tableID, name, userID,
+func (s *SQLStore) SetVariableConstraints(tableID int, name string, c Constraints, userID int) error {
+	res, err := s.db.Exec(
+		`UPDATE variables SET constraints = ? WHERE table_id = ? AND name = ? AND user_id = ?`,
+		encodeConstraints(c), tableID, name, userID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteVariable(tableID int, name string, userID int) error {
+	res, err := s.db.Exec(`DELETE FROM variables WHERE table_id = ? AND name = ? AND user_id = ?`, tableID, name, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
-func GetVariable(db *sql.DB, tableID int, name string) (value, typ string, err error) {
-	err = db.QueryRow(
-		`SELECT value, type FROM variables WHERE name = ? AND table_id = ?`,
+func (s *SQLStore) ChangeVariableType(tableID int, name, typ, value string, options []string, c Constraints, userID int) (revision int, err error) {
+	err = s.db.QueryRow(
+		`UPDATE variables SET type = ?, value = ?, options = ?, constraints = ?, revision = revision + 1
+         WHERE table_id = ? AND name = ? AND user_id = ? RETURNING revision`,
+		typ, value, encodeOptions(options), encodeConstraints(c), tableID, name, userID,
+	).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return revision, checkError(err)
+}
+
+func (s *SQLStore) GetVariable(tableID int, name string) (value, typ string, revision int, err error) {
+	err = s.db.QueryRow(
+		`SELECT value, type, revision FROM variables WHERE name = ? AND table_id = ?`,
 		name, tableID,
+	).Scan(&value, &typ, &revision)
+	if err == sql.ErrNoRows {
+		return "", "", 0, ErrNotFound
+	}
+
+	return value, typ, revision, err
+}
+
+func (s *SQLStore) GetUserVariable(tableID int, name string, userID int) (value, typ string, err error) {
+	err = s.db.QueryRow(
+		`SELECT value, type FROM variables WHERE name = ? AND table_id = ? AND user_id = ?`,
+		name, tableID, userID,
 	).Scan(&value, &typ)
 	if err == sql.ErrNoRows {
 		return "", "", ErrNotFound
 	}
-
 	return value, typ, err
 }
-func SetVariable(db *sql.DB, tableID int, name, value string) error {
-	_, err := db.Exec(
-		`UPDATE variables SET value = ? WHERE name = ? AND table_id = ?`,
+
+func (s *SQLStore) SetVariable(tableID int, name, value string) (revision int, err error) {
+	err = s.db.QueryRow(
+		`UPDATE variables SET value = ?, revision = revision + 1 WHERE name = ? AND table_id = ? RETURNING revision`,
 		value, name, tableID,
-	)
+	).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
 
-	return err
+	return revision, checkError(err)
+}
+
+func (s *SQLStore) CompareAndSetVariable(tableID int, name, value string, expected int) (revision int, err error) {
+	err = s.db.QueryRow(
+		`UPDATE variables SET value = ?, revision = revision + 1 WHERE name = ? AND table_id = ? AND revision = ? RETURNING revision`,
+		value, name, tableID, expected,
+	).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+
+	return revision, checkError(err)
 }
 
-func GetVariableType(db *sql.DB, tableID int, name string) (string, error) {
+// IncrementVariable runs as a single statement, so concurrent increments
+// can't lose updates.
+func (s *SQLStore) IncrementVariable(tableID int, name, typ string, delta float64, min, max *float64, clamp bool) (value string, revision int, err error) {
+	// keep int variables integral by passing whole numbers as integers
+	num := func(f float64) any {
+		if typ == "int" {
+			return int64(f)
+		}
+		return f
+	}
+
+	cast := "CAST(value AS REAL)"
+	if typ == "int" {
+		cast = "CAST(value AS INTEGER)"
+	}
+
+	expr := cast + " + ?"
+	exprArgs := []any{num(delta)}
+	where := "name = ? AND table_id = ? AND type = ?"
+	whereArgs := []any{name, tableID, typ}
+	if min != nil {
+		if clamp {
+			expr = "MAX(" + expr + ", ?)"
+			exprArgs = append(exprArgs, num(*min))
+		} else {
+			where += " AND " + cast + " + ? >= ?"
+			whereArgs = append(whereArgs, num(delta), num(*min))
+		}
+	}
+	if max != nil {
+		if clamp {
+			expr = "MIN(" + expr + ", ?)"
+			exprArgs = append(exprArgs, num(*max))
+		} else {
+			where += " AND " + cast + " + ? <= ?"
+			whereArgs = append(whereArgs, num(delta), num(*max))
+		}
+	}
+
+	err = s.db.QueryRow(
+		`UPDATE variables SET value = `+expr+`, revision = revision + 1 WHERE `+where+` RETURNING value, revision`,
+		append(exprArgs, whereArgs...)...,
+	).Scan(&value, &revision)
+	if err == sql.ErrNoRows {
+		return "", 0, ErrNotFound
+	}
+	return value, revision, err
+}
+
+func (s *SQLStore) GetVariableType(tableID int, name string) (string, error) {
 	var typ string
-	err := db.QueryRow(
+	err := s.db.QueryRow(
 		`SELECT type FROM variables WHERE name = ? AND table_id = ?`,
 		name, tableID,
 	).Scan(&typ)
@@ -255,3 +596,505 @@ func GetVariableType(db *sql.DB, tableID int, name string) (string, error) {
 
 	return typ, err
 }
+
+func (s *SQLStore) CreateWebhook(projectID, tableID int, url, secret string, userID int) (int, error) {
+	var table any
+	if tableID != 0 {
+		table = tableID
+	}
+	res, err := s.db.Exec(
+		`INSERT INTO webhooks(project_id,table_id,user_id,url,secret)
+         SELECT ?,?,?,?,?
+         FROM projects WHERE id = ? AND user_id = ?`,
+		projectID, table, userID, url, secret,
+		projectID, userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrNotFound
+	}
+	id, _ := res.LastInsertId()
+	return int(id), nil
+}
+
+func (s *SQLStore) ListWebhooks(projectID int, userID int) ([]Webhook, error) {
+	rows, err := s.db.Query(
+		`SELECT id, project_id, COALESCE(table_id, 0), url FROM webhooks WHERE project_id = ? AND user_id = ?`,
+		projectID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var h Webhook
+		if err := rows.Scan(&h.ID, &h.ProjectID, &h.TableID, &h.URL); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, h)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *SQLStore) DeleteWebhook(webhookID, projectID int, userID int) error {
+	_, err := s.db.Exec(
+		`DELETE FROM webhooks WHERE id = ? AND project_id = ? AND user_id = ?`,
+		webhookID, projectID, userID,
+	)
+	return err
+}
+
+func (s *SQLStore) WebhooksForEvent(projectID, tableID int) ([]Webhook, error) {
+	rows, err := s.db.Query(
+		`SELECT id, project_id, COALESCE(table_id, 0), url, secret FROM webhooks
+         WHERE project_id = ? AND (table_id IS NULL OR table_id = ?)`,
+		projectID, tableID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var h Webhook
+		if err := rows.Scan(&h.ID, &h.ProjectID, &h.TableID, &h.URL, &h.Secret); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, h)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *SQLStore) EnqueueWebhookDelivery(webhookID int, event, payload string, now int64) error {
+	_, err := s.db.Exec(
+		`INSERT INTO webhook_deliveries(webhook_id,event,payload,next_attempt_at,created_at) VALUES(?,?,?,?,?)`,
+		webhookID, event, payload, now, now,
+	)
+	return checkError(err)
+}
+
+func (s *SQLStore) DueWebhookDeliveries(now int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(
+		`SELECT d.id, d.webhook_id, d.event, d.payload, d.attempts, w.url, w.secret
+         FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+         WHERE d.status = 'pending' AND d.next_attempt_at <= ?
+         ORDER BY d.id LIMIT ?`,
+		now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		d.Status = "pending"
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *SQLStore) UpdateWebhookDelivery(d WebhookDelivery) error {
+	_, err := s.db.Exec(
+		`UPDATE webhook_deliveries
+         SET status = ?, attempts = ?, next_attempt_at = ?, response_code = ?, last_error = ?
+         WHERE id = ?`,
+		d.Status, d.Attempts, d.NextAttemptAt, d.ResponseCode, d.LastError, d.ID,
+	)
+	return checkError(err)
+}
+
+func (s *SQLStore) ListWebhookDeliveries(webhookID int, userID int, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(
+		`SELECT d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at,
+                d.response_code, d.last_error, d.created_at
+         FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+         WHERE d.webhook_id = ? AND w.user_id = ?
+         ORDER BY d.id DESC LIMIT ?`,
+		webhookID, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.ResponseCode, &d.LastError, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *SQLStore) RecordVariableHistory(tableID int, name, value, typ string, revision int, actor string) error {
+	var variableID int
+	err := s.db.QueryRow(`SELECT id FROM variables WHERE table_id = ? AND name = ?`, tableID, name).Scan(&variableID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO variable_history(variable_id,table_id,name,value,type,revision,actor,created_at) VALUES(?,?,?,?,?,?,?,?)`,
+		variableID, tableID, name, value, typ, revision, actor, time.Now().Unix(),
+	)
+	if err != nil {
+		return checkError(err)
+	}
+
+	_, err = s.db.Exec(
+		`DELETE FROM variable_history WHERE variable_id = ?1 AND id NOT IN (
+            SELECT id FROM variable_history WHERE variable_id = ?1
+            ORDER BY id DESC
+            LIMIT (SELECT p.history_retention FROM tables t JOIN projects p ON p.id = t.project_id WHERE t.id = ?2)
+        )`,
+		variableID, tableID,
+	)
+	return err
+}
+
+func (s *SQLStore) ListVariableHistory(tableID int, name string, userID int, limit, offset int) ([]HistoryEntry, int, error) {
+	var total int
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM variable_history h JOIN variables v ON v.id = h.variable_id
+         WHERE v.table_id = ? AND v.name = ? AND v.user_id = ?`,
+		tableID, name, userID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(
+		`SELECT h.id, COALESCE(h.value, ''), h.type, h.revision, h.actor, h.created_at
+         FROM variable_history h JOIN variables v ON v.id = h.variable_id
+         WHERE v.table_id = ? AND v.name = ? AND v.user_id = ?
+         ORDER BY h.id DESC LIMIT ? OFFSET ?`,
+		tableID, name, userID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(&e.ID, &e.Value, &e.Type, &e.Revision, &e.Actor, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
+
+func (s *SQLStore) GetHistoryEntry(historyID, tableID int, name string, userID int) (HistoryEntry, error) {
+	var e HistoryEntry
+	err := s.db.QueryRow(
+		`SELECT h.id, COALESCE(h.value, ''), h.type, h.revision, h.actor, h.created_at
+         FROM variable_history h JOIN variables v ON v.id = h.variable_id
+         WHERE h.id = ? AND v.table_id = ? AND v.name = ? AND v.user_id = ?`,
+		historyID, tableID, name, userID,
+	).Scan(&e.ID, &e.Value, &e.Type, &e.Revision, &e.Actor, &e.CreatedAt)
+	if err == sql.ErrNoRows {
+		return e, ErrNotFound
+	}
+	return e, err
+}
+
+func (s *SQLStore) SetHistoryRetention(projID int, retention int, userID int) error {
+	_, err := s.db.Exec(`UPDATE projects SET history_retention = ? WHERE id = ? AND user_id = ?`, retention, projID, userID)
+	return err
+}
+
+func (s *SQLStore) CreateProjectToken(t ProjectToken, token string, userID int) (int, error) {
+	var tables any
+	if t.Tables != nil {
+		b, _ := json.Marshal(t.Tables)
+		tables = string(b)
+	}
+	res, err := s.db.Exec(
+		`INSERT INTO project_tokens(project_id,user_id,name,token_hash,read_only,tables,expires_at,created_at)
+         SELECT ?,?,?,?,?,?,?,?
+         FROM projects WHERE id = ? AND user_id = ?`,
+		t.ProjectID, userID, t.Name, hashToken(token), t.ReadOnly, tables, t.ExpiresAt, time.Now().Unix(),
+		t.ProjectID, userID,
+	)
+	if err != nil {
+		return 0, checkError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrNotFound
+	}
+	id, _ := res.LastInsertId()
+	return int(id), nil
+}
+
+const projectTokenColumns = `id, project_id, name, read_only, tables, expires_at, last_used_at, created_at`
+
+// scanProjectToken scans projectTokenColumns, followed by any extra columns
+// into extra.
+func scanProjectToken(row interface{ Scan(...any) error }, extra ...any) (ProjectToken, error) {
+	var t ProjectToken
+	var tables sql.NullString
+	dest := append([]any{&t.ID, &t.ProjectID, &t.Name, &t.ReadOnly, &tables, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt}, extra...)
+	err := row.Scan(dest...)
+	if err == nil && tables.Valid {
+		err = json.Unmarshal([]byte(tables.String), &t.Tables)
+	}
+	return t, err
+}
+
+func (s *SQLStore) ListProjectTokens(projectID int, userID int) ([]ProjectToken, error) {
+	rows, err := s.db.Query(
+		`SELECT `+projectTokenColumns+` FROM project_tokens WHERE project_id = ? AND user_id = ? ORDER BY id`,
+		projectID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []ProjectToken{}
+	for rows.Next() {
+		t, err := scanProjectToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *SQLStore) RevokeProjectToken(tokenID, projectID int, userID int) error {
+	res, err := s.db.Exec(
+		`DELETE FROM project_tokens WHERE id = ? AND project_id = ? AND user_id = ?`,
+		tokenID, projectID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) GetProjectTokenByValue(token string) (t ProjectToken, userID int, err error) {
+	now := time.Now().Unix()
+	row := s.db.QueryRow(
+		`SELECT `+projectTokenColumns+`, user_id FROM project_tokens
+         WHERE token_hash = ? AND (expires_at IS NULL OR expires_at > ?)`,
+		hashToken(token), now,
+	)
+	t, err = scanProjectToken(row, &userID)
+	if err == sql.ErrNoRows {
+		return t, 0, ErrNotFound
+	} else if err != nil {
+		return t, 0, err
+	}
+
+	// last use is kept to the minute so reads don't all turn into writes;
+	// it's only bookkeeping, so failing to record it doesn't fail the lookup
+	_, err = s.db.Exec(
+		`UPDATE project_tokens SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)`,
+		now, t.ID, now-60,
+	)
+	if err != nil {
+		log.Printf("project token %d: recording last use: %v", t.ID, err)
+	}
+	return t, userID, nil
+}
+
+// Sessions
+func (s *SQLStore) CreateSession(userID int, refreshToken string, expiresAt int64) (int, error) {
+	now := time.Now().Unix()
+	res, err := s.db.Exec(
+		`INSERT INTO sessions(user_id,token_hash,created_at,rotated_at,expires_at) VALUES(?,?,?,?,?)`,
+		userID, hashToken(refreshToken), now, now, expiresAt,
+	)
+	if err != nil {
+		return 0, checkError(err)
+	}
+	id, _ := res.LastInsertId()
+	return int(id), nil
+}
+
+const sessionColumns = `id, user_id, created_at, rotated_at, expires_at`
+
+func scanSession(row interface{ Scan(...any) error }, extra ...any) (Session, error) {
+	var ses Session
+	err := row.Scan(append([]any{&ses.ID, &ses.UserID, &ses.CreatedAt, &ses.RotatedAt, &ses.ExpiresAt}, extra...)...)
+	if err == sql.ErrNoRows {
+		return ses, ErrNotFound
+	}
+	return ses, err
+}
+
+func (s *SQLStore) GetSessionByRefreshToken(refreshToken string) (Session, error) {
+	hash := hashToken(refreshToken)
+	row := s.db.QueryRow(
+		`SELECT `+sessionColumns+`, token_hash <> ? FROM sessions
+         WHERE (token_hash = ? OR previous_token_hash = ?) AND expires_at > ?`,
+		hash, hash, hash, time.Now().Unix(),
+	)
+	var reused bool
+	ses, err := scanSession(row, &reused)
+	ses.Reused = reused
+	return ses, err
+}
+
+func (s *SQLStore) RotateSession(sessionID int, oldToken, newToken string, expiresAt int64) error {
+	res, err := s.db.Exec(
+		`UPDATE sessions SET previous_token_hash = token_hash, token_hash = ?, rotated_at = ?, expires_at = ?
+         WHERE id = ? AND token_hash = ?`,
+		hashToken(newToken), time.Now().Unix(), expiresAt, sessionID, hashToken(oldToken),
+	)
+	if err != nil {
+		return checkError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) GetSession(sessionID, userID int) (Session, error) {
+	return scanSession(s.db.QueryRow(
+		`SELECT `+sessionColumns+` FROM sessions WHERE id = ? AND user_id = ? AND expires_at > ?`,
+		sessionID, userID, time.Now().Unix(),
+	))
+}
+
+func (s *SQLStore) DeleteSession(sessionID, userID int) error {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE id = ? AND user_id = ?`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteUserSessions(userID int) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	return err
+}
+
+func (s *SQLStore) DeleteExpiredSessions(now int64) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now)
+	return err
+}
+
+// Invites
+func (s *SQLStore) CreateInvite(code string, expiresAt int64) error {
+	_, err := s.db.Exec(
+		`INSERT INTO invites(code_hash,created_at,expires_at) VALUES(?,?,?)`,
+		hashToken(code), time.Now().Unix(), expiresAt,
+	)
+	return checkError(err)
+}
+
+func (s *SQLStore) UseInvite(code string, userID int) error {
+	now := time.Now().Unix()
+	res, err := s.db.Exec(
+		`UPDATE invites SET used_by = ?, used_at = ?
+         WHERE code_hash = ? AND used_at IS NULL AND expires_at > ?`,
+		userID, now, hashToken(code), now,
+	)
+	if err != nil {
+		return checkError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Two-factor authentication
+func (s *SQLStore) GetTOTP(userID int) (TOTP, error) {
+	var t TOTP
+	var secret sql.NullString
+	err := s.db.QueryRow(
+		`SELECT totp_secret, totp_enabled, totp_last_step,
+             (SELECT COUNT(*) FROM recovery_codes WHERE user_id = users.id)
+         FROM users WHERE id = ?`, userID,
+	).Scan(&secret, &t.Enabled, &t.LastStep, &t.RecoveryCodes)
+	if err == sql.ErrNoRows {
+		return t, ErrNotFound
+	}
+	t.Secret = secret.String
+	return t, err
+}
+
+func (s *SQLStore) SetTOTPSecret(userID int, secret string) error {
+	return s.updateUser(`UPDATE users SET totp_secret = ?, totp_enabled = 0 WHERE id = ?`, secret, userID)
+}
+
+func (s *SQLStore) EnableTOTP(userID int) error {
+	return s.updateUser(`UPDATE users SET totp_enabled = 1 WHERE id = ?`, userID)
+}
+
+func (s *SQLStore) DisableTOTP(userID int) error {
+	return s.tx(func(tx *SQLStore) error {
+		err := tx.updateUser(
+			`UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE id = ?`, userID,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.db.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID)
+		return err
+	})
+}
+
+func (s *SQLStore) UseTOTPStep(userID int, step int64) error {
+	return s.updateUser(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, userID, step)
+}
+
+func (s *SQLStore) SetRecoveryCodes(userID int, codes []string) error {
+	return s.tx(func(tx *SQLStore) error {
+		if _, err := tx.db.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+			return err
+		}
+		for _, code := range codes {
+			_, err := tx.db.Exec(
+				`INSERT INTO recovery_codes(user_id,code_hash) VALUES(?,?)`, userID, hashToken(code),
+			)
+			if err != nil {
+				return checkError(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLStore) UseRecoveryCode(userID int, code string) error {
+	return s.updateUser(`DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?`, userID, hashToken(code))
+}
+
+// updateUser runs a statement on one user, returning ErrNotFound if it
+// changes nothing.
+func (s *SQLStore) updateUser(query string, args ...any) error {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return checkError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
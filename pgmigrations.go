@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// pgMigrations are the schema steps of PostgresStore. Postgres support
+// started with the schema SQLite had reached by then, so the first step
+// creates all of it; later steps follow the same rules as migrations.
+var pgMigrations = []migration{
+	{1, "create schema", execAll(
+		// json_shape is the jsonb_typeof of value, or NULL when value isn't
+		// JSON, so that CHECKs can tell without failing the statement
+		`CREATE OR REPLACE FUNCTION json_shape(value TEXT) RETURNS TEXT AS $$
+        BEGIN
+            RETURN jsonb_typeof(value::jsonb);
+        EXCEPTION WHEN others THEN
+            RETURN NULL;
+        END;
+        $$ LANGUAGE plpgsql IMMUTABLE;`,
+		`CREATE TABLE users (
+            id SERIAL PRIMARY KEY,
+            username TEXT NOT NULL UNIQUE,
+            password_hash TEXT NOT NULL
+        );`,
+		`CREATE TABLE projects (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            token TEXT NOT NULL UNIQUE,
+            previous_token TEXT,
+            previous_token_expires_at BIGINT,
+            history_retention INTEGER NOT NULL DEFAULT 50
+        );`,
+		`CREATE INDEX projects_previous_token ON projects(previous_token);`,
+		`CREATE TABLE tables (
+            id SERIAL PRIMARY KEY,
+            project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            UNIQUE(project_id, user_id, name)
+        );`,
+		`CREATE TABLE variables (
+            id SERIAL PRIMARY KEY,
+            table_id INTEGER NOT NULL REFERENCES tables(id) ON DELETE CASCADE,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            value TEXT,
+            type TEXT NOT NULL CHECK (type IN ('string','int','float','bool','json','list','map','datetime','duration','enum')),
+            revision INTEGER NOT NULL DEFAULT 0,
+            options TEXT,
+            constraints TEXT,
+            CHECK (CASE type
+                WHEN 'json' THEN json_shape(value) IS NOT NULL
+                WHEN 'list' THEN COALESCE(json_shape(value) = 'array', FALSE)
+                WHEN 'map' THEN COALESCE(json_shape(value) = 'object', FALSE)
+                ELSE TRUE END),
+            UNIQUE(table_id, name)
+        );`,
+		`CREATE TABLE variable_history (
+            id SERIAL PRIMARY KEY,
+            table_id INTEGER NOT NULL REFERENCES tables(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            value TEXT,
+            type TEXT NOT NULL,
+            revision INTEGER NOT NULL,
+            actor TEXT NOT NULL,
+            created_at BIGINT NOT NULL
+        );`,
+		`CREATE INDEX variable_history_variable ON variable_history(table_id, name, id);`,
+		`CREATE TABLE project_tokens (
+            id SERIAL PRIMARY KEY,
+            project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            token_hash TEXT NOT NULL UNIQUE,
+            read_only BOOLEAN NOT NULL DEFAULT FALSE,
+            tables TEXT,
+            expires_at BIGINT,
+            last_used_at BIGINT,
+            created_at BIGINT NOT NULL
+        );`,
+		`CREATE TABLE webhooks (
+            id SERIAL PRIMARY KEY,
+            project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+            table_id INTEGER REFERENCES tables(id) ON DELETE CASCADE,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            url TEXT NOT NULL,
+            secret TEXT NOT NULL
+        );`,
+		`CREATE TABLE webhook_deliveries (
+            id SERIAL PRIMARY KEY,
+            webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+            event TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending','delivered','failed')),
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt_at BIGINT NOT NULL,
+            response_code INTEGER NOT NULL DEFAULT 0,
+            last_error TEXT NOT NULL DEFAULT '',
+            created_at BIGINT NOT NULL
+        );`,
+		`CREATE INDEX webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);`,
+	)},
+	{2, "create sessions", execAll(
+		`CREATE TABLE sessions (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            token_hash TEXT NOT NULL UNIQUE,
+            previous_token_hash TEXT,
+            created_at BIGINT NOT NULL,
+            rotated_at BIGINT NOT NULL,
+            expires_at BIGINT NOT NULL
+        );`,
+		`CREATE INDEX sessions_previous_token ON sessions(previous_token_hash);`,
+		`CREATE INDEX sessions_user ON sessions(user_id);`,
+		`CREATE INDEX sessions_expires ON sessions(expires_at);`,
+	)},
+	{3, "add user emails", execAll(
+		`ALTER TABLE users
+            ADD COLUMN email TEXT UNIQUE,
+            ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+            ADD COLUMN email_token_hash TEXT UNIQUE,
+            ADD COLUMN email_token_expires_at BIGINT;`,
+	)},
+	{4, "add registration approval and invites", execAll(
+		`ALTER TABLE users ADD COLUMN approved BOOLEAN NOT NULL DEFAULT TRUE;`,
+		`CREATE TABLE invites (
+            id SERIAL PRIMARY KEY,
+            code_hash TEXT NOT NULL UNIQUE,
+            created_at BIGINT NOT NULL,
+            expires_at BIGINT NOT NULL,
+            used_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            used_at BIGINT
+        );`,
+	)},
+	{5, "add two-factor authentication", execAll(
+		`ALTER TABLE users
+            ADD COLUMN totp_secret TEXT,
+            ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+            ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;`,
+		`CREATE TABLE recovery_codes (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            code_hash TEXT NOT NULL,
+            UNIQUE(user_id, code_hash)
+        );`,
+	)},
+	{6, "key variable history by variable", execAll(
+		`ALTER TABLE variable_history
+            ADD COLUMN variable_id INTEGER REFERENCES variables(id) ON DELETE CASCADE;`,
+		`UPDATE variable_history h SET variable_id = v.id
+         FROM variables v WHERE v.table_id = h.table_id AND v.name = h.name;`,
+		`DELETE FROM variable_history WHERE variable_id IS NULL;`,
+		`ALTER TABLE variable_history ALTER COLUMN variable_id SET NOT NULL;`,
+		`DROP INDEX variable_history_variable;`,
+		`CREATE INDEX variable_history_variable_id ON variable_history(variable_id, id);`,
+	)},
+	{7, "only keep verified emails unique", execAll(
+		`ALTER TABLE users DROP CONSTRAINT users_email_key;`,
+		`CREATE UNIQUE INDEX users_verified_email ON users(email) WHERE email_verified;`,
+	)},
+}
+
+const pgSchemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at BIGINT NOT NULL
+        );`
+
+// pgMigrationLock is the advisory lock instances hold while migrating, so
+// that ones starting together don't run the same step twice.
+const pgMigrationLock = 7_262_017
+
+// migratePostgres is migrate for PostgresStore.
+func migratePostgres(db *sql.DB, steps []migration) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, pgMigrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, pgMigrationLock)
+
+	if _, err := conn.ExecContext(ctx, pgSchemaMigrationsTable); err != nil {
+		return err
+	}
+	var version int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(steps) {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d)", version, len(steps))
+	}
+
+	return applyMigrations(ctx, conn, steps[version:],
+		`INSERT INTO schema_migrations(version, name, applied_at) VALUES($1, $2, $3)`)
+}
+
+// PostgresMigrationStatuses is MigrationStatuses for PostgresStore.
+func PostgresMigrationStatuses(db *sql.DB) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(db,
+		`SELECT COUNT(*) FROM information_schema.tables
+         WHERE table_schema = current_schema() AND table_name = 'schema_migrations'`)
+	if err != nil {
+		return nil, err
+	}
+	return migrationStatuses(pgMigrations, applied), nil
+}
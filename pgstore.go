@@ -0,0 +1,1052 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStore is the Store kept in a Postgres database set up by
+// InitPostgres. Any number of instances can share one database.
+type PostgresStore struct {
+	db DBTX
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// OpenPostgres opens the Postgres database at dsn, a URL or key=value
+// connection string.
+func OpenPostgres(dsn string) *sql.DB {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	return db
+}
+
+// InitPostgres opens the Postgres database at dsn and migrates it to the
+// current schema. It refuses databases migrated by a newer binary.
+func InitPostgres(dsn string) *sql.DB {
+	db := OpenPostgres(dsn)
+	if err := migratePostgres(db, pgMigrations); err != nil {
+		log.Fatalf("migration error: %v", err)
+	}
+	return db
+}
+
+// pgCheckError is checkError for Postgres.
+func pgCheckError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "check_violation":
+			return errInvalidValue
+		case "unique_violation":
+			return ErrExists
+		case "foreign_key_violation":
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
+func (s *PostgresStore) Tx(fn func(tx Store) error) error {
+	return s.tx(func(tx *PostgresStore) error { return fn(tx) })
+}
+
+func (s *PostgresStore) tx(fn func(tx *PostgresStore) error) error {
+	db, ok := s.db.(*sql.DB)
+	if !ok {
+		// already in a transaction
+		return savepoint(s.db, func() error { return fn(s) })
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(&PostgresStore{db: tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Users
+func (s *PostgresStore) CreateUser(username, pwHash string) error {
+	_, err := s.db.Exec(`INSERT INTO users(username,password_hash) VALUES($1,$2)`, username, pwHash)
+	return pgCheckError(err)
+}
+
+func (s *PostgresStore) GetUserByUsername(username string) (id int, pwHash string, err error) {
+	err = s.db.QueryRow(`SELECT id,password_hash FROM users WHERE username = $1`, username).Scan(&id, &pwHash)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrNotFound
+	}
+	return
+}
+
+func (s *PostgresStore) GetUser(userID int) (User, error) {
+	var u User
+	var email sql.NullString
+	err := s.db.QueryRow(
+		`SELECT id,username,email,email_verified,approved,totp_enabled,password_hash FROM users WHERE id = $1`, userID,
+	).Scan(&u.ID, &u.Username, &email, &u.EmailVerified, &u.Approved, &u.TOTPEnabled, &u.PasswordHash)
+	if err == sql.ErrNoRows {
+		return u, ErrNotFound
+	}
+	u.Email = email.String
+	return u, err
+}
+
+func (s *PostgresStore) RenameUser(userID int, username string) error {
+	res, err := s.db.Exec(`UPDATE users SET username = $1 WHERE id = $2`, username, userID)
+	if err != nil {
+		return pgCheckError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetUserPassword(userID int, pwHash string) error {
+	res, err := s.db.Exec(`UPDATE users SET password_hash = $1 WHERE id = $2`, pwHash, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetUserEmail(userID int, email, verifyToken string, expiresAt int64) error {
+	var address, hash, expires any
+	if email != "" {
+		address, hash, expires = email, hashToken(verifyToken), expiresAt
+	}
+	return s.tx(func(tx *PostgresStore) error {
+		var taken int
+		err := tx.db.QueryRow(
+			`SELECT COUNT(*) FROM users WHERE email = $1 AND email_verified AND id <> $2`, address, userID,
+		).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrExists
+		}
+		return tx.updateUser(
+			`UPDATE users SET email = $1, email_verified = FALSE, email_token_hash = $2,
+             email_token_expires_at = $3 WHERE id = $4`,
+			address, hash, expires, userID,
+		)
+	})
+}
+
+func (s *PostgresStore) VerifyUserEmail(verifyToken string) (userID int, err error) {
+	err = s.db.QueryRow(
+		`UPDATE users SET email_verified = TRUE, email_token_hash = NULL, email_token_expires_at = NULL
+         WHERE email_token_hash = $1 AND email_token_expires_at > $2
+         RETURNING id`,
+		hashToken(verifyToken), time.Now().Unix(),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return userID, pgCheckError(err)
+}
+
+func (s *PostgresStore) DeleteUser(userID int) error {
+	res, err := s.db.Exec(`DELETE FROM users WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetUserApproved(userID int, approved bool) error {
+	res, err := s.db.Exec(`UPDATE users SET approved = $1 WHERE id = $2`, approved, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) ListPendingUsers() ([]User, error) {
+	rows, err := s.db.Query(
+		`SELECT id,username,email,email_verified,password_hash FROM users WHERE approved = FALSE ORDER BY id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var u User
+		var email sql.NullString
+		if err := rows.Scan(&u.ID, &u.Username, &email, &u.EmailVerified, &u.PasswordHash); err != nil {
+			return nil, err
+		}
+		u.Email = email.String
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Projects
+func (s *PostgresStore) CreateProject(userID int, name, token string) (int, error) {
+	var id int
+	err := s.db.QueryRow(
+		`INSERT INTO projects(user_id,name,token) VALUES($1,$2,$3) RETURNING id`,
+		userID, name, token,
+	).Scan(&id)
+	return id, pgCheckError(err)
+}
+
+func (s *PostgresStore) ListProjects(userID int) ([]Project, error) {
+	rows, err := s.db.Query(`SELECT id, name FROM projects WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []Project
+	for rows.Next() {
+		var project Project
+		if err := rows.Scan(&project.ID, &project.Name); err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+	return projects, rows.Err()
+}
+
+func (s *PostgresStore) GetProject(projID, userID int) (map[string]any, error) {
+	var name, token string
+	var previousExpiresAt *int64
+	err := s.db.QueryRow(
+		`SELECT name, token, previous_token_expires_at FROM projects WHERE id = $1 AND user_id = $2`,
+		projID, userID,
+	).Scan(&name, &token, &previousExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return projectDetails(s, projID, userID, name, token, previousExpiresAt)
+}
+
+func (s *PostgresStore) GetProjectByToken(token string) (id, userID int, sunset int64, err error) {
+	err = s.db.QueryRow(`SELECT id,user_id FROM projects WHERE token = $1`, token).Scan(&id, &userID)
+	if err == sql.ErrNoRows {
+		err = s.db.QueryRow(
+			`SELECT id,user_id,previous_token_expires_at FROM projects
+             WHERE previous_token = $1 AND previous_token_expires_at > $2`,
+			token, time.Now().Unix(),
+		).Scan(&id, &userID, &sunset)
+	}
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, ErrNotFound
+	}
+	return
+}
+
+func (s *PostgresStore) RotateProjectToken(projID int, token string, graceUntil int64, userID int) error {
+	now := time.Now().Unix()
+	return s.tx(func(tx *PostgresStore) error {
+		var previousExpiresAt *int64
+		err := tx.db.QueryRow(
+			`SELECT previous_token_expires_at FROM projects WHERE id = $1 AND user_id = $2 FOR UPDATE`,
+			projID, userID,
+		).Scan(&previousExpiresAt)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if graceUntil > now && previousExpiresAt != nil && *previousExpiresAt > now {
+			return ErrTokenInGrace
+		}
+		_, err = tx.db.Exec(
+			`UPDATE projects SET previous_token = token, previous_token_expires_at = $1, token = $2
+             WHERE id = $3 AND user_id = $4`,
+			graceUntil, token, projID, userID,
+		)
+		return pgCheckError(err)
+	})
+}
+
+func (s *PostgresStore) RenameProject(projID int, name string, userID int) error {
+	_, err := s.db.Exec(`UPDATE projects SET name = $1 WHERE id = $2 AND user_id = $3`, name, projID, userID)
+	return err
+}
+
+func (s *PostgresStore) DeleteProject(projID int, userID int) error {
+	_, err := s.db.Exec(`DELETE FROM projects WHERE id = $1 AND user_id = $2`, projID, userID)
+	return err
+}
+
+func (s *PostgresStore) SetHistoryRetention(projID int, retention int, userID int) error {
+	_, err := s.db.Exec(`UPDATE projects SET history_retention = $1 WHERE id = $2 AND user_id = $3`, retention, projID, userID)
+	return err
+}
+
+// Tables
+func (s *PostgresStore) CreateTable(projectID int, name string, userID int) (int, error) {
+	var id int
+	err := s.db.QueryRow(
+		`INSERT INTO tables(project_id,user_id,name)
+         SELECT id, user_id, $1::text FROM projects WHERE id = $2 AND user_id = $3
+         RETURNING id`,
+		name, projectID, userID,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return id, pgCheckError(err)
+}
+
+func (s *PostgresStore) GetTableID(projectID int, name string, userID int) (int, error) {
+	var id int
+	err := s.db.QueryRow(
+		`SELECT id FROM tables WHERE project_id = $1 AND name = $2 AND user_id = $3`,
+		projectID, name, userID,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+func (s *PostgresStore) GetTableProjectID(tableID int) (int, error) {
+	var projectID int
+	err := s.db.QueryRow(`SELECT project_id FROM tables WHERE id = $1`, tableID).Scan(&projectID)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return projectID, err
+}
+
+// Names are ordered by their bytes, as SQLite orders them, whatever the
+// database's collation.
+func (s *PostgresStore) ListTables(projectID int, userID int) ([]Table, error) {
+	rows, err := s.db.Query(
+		`SELECT id, name FROM tables WHERE project_id = $1 AND user_id = $2 ORDER BY name COLLATE "C"`,
+		projectID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []Table
+	for rows.Next() {
+		var table Table
+		if err := rows.Scan(&table.ID, &table.Name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+func (s *PostgresStore) RenameTable(tableID int, name string, userID int) error {
+	_, err := s.db.Exec(`UPDATE tables SET name = $1 WHERE id = $2 AND user_id = $3`, name, tableID, userID)
+	return pgCheckError(err)
+}
+
+func (s *PostgresStore) DeleteTable(tableID int, userID int) error {
+	_, err := s.db.Exec(`DELETE FROM tables WHERE id = $1 AND user_id = $2`, tableID, userID)
+	return err
+}
+
+// Variables
+func (s *PostgresStore) CreateVariable(tableID int, name, value, typ string, options []string, c Constraints, userID int) error {
+	value, err := prepareVariable(value, typ, options, c)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(
+		`INSERT INTO variables(table_id,user_id,name,value,type,options,constraints)
+         SELECT id, user_id, $1::text, $2::text, $3::text, $4::text, $5::text
+         FROM tables WHERE id = $6 AND user_id = $7`,
+		name, value, typ, encodeOptions(options), encodeConstraints(c),
+		tableID, userID,
+	)
+	if err != nil {
+		return pgCheckError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) ListVariables(tableID int, userID int) ([]Variable, error) {
+	rows, err := s.db.Query(
+		`SELECT name, type, COALESCE(value, ''), options, constraints FROM variables
+         WHERE table_id = $1 AND user_id = $2 ORDER BY name COLLATE "C"`,
+		tableID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variables []Variable
+	for rows.Next() {
+		var variable Variable
+		var options, constraints sql.NullString
+		if err := rows.Scan(&variable.Name, &variable.Type, &variable.Value, &options, &constraints); err != nil {
+			return nil, err
+		}
+		if variable.Options, err = decodeOptions(options); err != nil {
+			return nil, err
+		}
+		if variable.Constraints, err = decodeConstraints(constraints); err != nil {
+			return nil, err
+		}
+		variables = append(variables, variable)
+	}
+	return variables, rows.Err()
+}
+
+func (s *PostgresStore) GetVariable(tableID int, name string) (value, typ string, revision int, err error) {
+	err = s.db.QueryRow(
+		`SELECT COALESCE(value, ''), type, revision FROM variables WHERE name = $1 AND table_id = $2`,
+		name, tableID,
+	).Scan(&value, &typ, &revision)
+	if err == sql.ErrNoRows {
+		return "", "", 0, ErrNotFound
+	}
+	return value, typ, revision, err
+}
+
+func (s *PostgresStore) GetUserVariable(tableID int, name string, userID int) (value, typ string, err error) {
+	err = s.db.QueryRow(
+		`SELECT COALESCE(value, ''), type FROM variables WHERE name = $1 AND table_id = $2 AND user_id = $3`,
+		name, tableID, userID,
+	).Scan(&value, &typ)
+	if err == sql.ErrNoRows {
+		return "", "", ErrNotFound
+	}
+	return value, typ, err
+}
+
+func (s *PostgresStore) GetVariableType(tableID int, name string) (string, error) {
+	var typ string
+	err := s.db.QueryRow(`SELECT type FROM variables WHERE name = $1 AND table_id = $2`, name, tableID).Scan(&typ)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return typ, err
+}
+
+func (s *PostgresStore) GetVariableRules(tableID int, name string) (options []string, c Constraints, err error) {
+	var storedOptions, storedConstraints sql.NullString
+	err = s.db.QueryRow(
+		`SELECT options, constraints FROM variables WHERE name = $1 AND table_id = $2`,
+		name, tableID,
+	).Scan(&storedOptions, &storedConstraints)
+	if err == sql.ErrNoRows {
+		return nil, c, ErrNotFound
+	} else if err != nil {
+		return nil, c, err
+	}
+	if options, err = decodeOptions(storedOptions); err != nil {
+		return nil, c, err
+	}
+	c, err = decodeConstraints(storedConstraints)
+	return options, c, err
+}
+
+func (s *PostgresStore) SetVariable(tableID int, name, value string) (revision int, err error) {
+	err = s.db.QueryRow(
+		`UPDATE variables SET value = $1, revision = revision + 1 WHERE name = $2 AND table_id = $3 RETURNING revision`,
+		value, name, tableID,
+	).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return revision, pgCheckError(err)
+}
+
+func (s *PostgresStore) CompareAndSetVariable(tableID int, name, value string, expected int) (revision int, err error) {
+	err = s.db.QueryRow(
+		`UPDATE variables SET value = $1, revision = revision + 1
+         WHERE name = $2 AND table_id = $3 AND revision = $4 RETURNING revision`,
+		value, name, tableID, expected,
+	).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return revision, pgCheckError(err)
+}
+
+// IncrementVariable locks the row while it computes the new value, so
+// concurrent increments can't lose updates.
+func (s *PostgresStore) IncrementVariable(tableID int, name, typ string, delta float64, min, max *float64, clamp bool) (value string, revision int, err error) {
+	err = s.tx(func(tx *PostgresStore) error {
+		var id int
+		var stored string
+		err := tx.db.QueryRow(
+			`SELECT id, COALESCE(value, '') FROM variables WHERE name = $1 AND table_id = $2 AND type = $3 FOR UPDATE`,
+			name, tableID, typ,
+		).Scan(&id, &stored)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+
+		var ok bool
+		if value, ok = incrementValue(stored, typ, delta, min, max, clamp); !ok {
+			return ErrNotFound
+		}
+		return tx.db.QueryRow(
+			`UPDATE variables SET value = $1, revision = revision + 1 WHERE id = $2 RETURNING revision`,
+			value, id,
+		).Scan(&revision)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return value, revision, nil
+}
+
+func (s *PostgresStore) ChangeVariableType(tableID int, name, typ, value string, options []string, c Constraints, userID int) (revision int, err error) {
+	err = s.db.QueryRow(
+		`UPDATE variables SET type = $1, value = $2, options = $3, constraints = $4, revision = revision + 1
+         WHERE table_id = $5 AND name = $6 AND user_id = $7 RETURNING revision`,
+		typ, value, encodeOptions(options), encodeConstraints(c), tableID, name, userID,
+	).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return revision, pgCheckError(err)
+}
+
+func (s *PostgresStore) SetVariableConstraints(tableID int, name string, c Constraints, userID int) error {
+	res, err := s.db.Exec(
+		`UPDATE variables SET constraints = $1 WHERE table_id = $2 AND name = $3 AND user_id = $4`,
+		encodeConstraints(c), tableID, name, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeleteVariable(tableID int, name string, userID int) error {
+	res, err := s.db.Exec(`DELETE FROM variables WHERE table_id = $1 AND name = $2 AND user_id = $3`, tableID, name, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// History
+func (s *PostgresStore) RecordVariableHistory(tableID int, name, value, typ string, revision int, actor string) error {
+	var variableID int
+	err := s.db.QueryRow(`SELECT id FROM variables WHERE table_id = $1 AND name = $2`, tableID, name).Scan(&variableID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO variable_history(variable_id,table_id,name,value,type,revision,actor,created_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8)`,
+		variableID, tableID, name, value, typ, revision, actor, time.Now().Unix(),
+	)
+	if err != nil {
+		return pgCheckError(err)
+	}
+
+	_, err = s.db.Exec(
+		`DELETE FROM variable_history WHERE variable_id = $1 AND id NOT IN (
+            SELECT id FROM variable_history WHERE variable_id = $1
+            ORDER BY id DESC
+            LIMIT (SELECT p.history_retention FROM tables t JOIN projects p ON p.id = t.project_id WHERE t.id = $2)
+        )`,
+		variableID, tableID,
+	)
+	return err
+}
+
+func (s *PostgresStore) ListVariableHistory(tableID int, name string, userID int, limit, offset int) ([]HistoryEntry, int, error) {
+	var total int
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM variable_history h JOIN variables v ON v.id = h.variable_id
+         WHERE v.table_id = $1 AND v.name = $2 AND v.user_id = $3`,
+		tableID, name, userID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(
+		`SELECT h.id, COALESCE(h.value, ''), h.type, h.revision, h.actor, h.created_at
+         FROM variable_history h JOIN variables v ON v.id = h.variable_id
+         WHERE v.table_id = $1 AND v.name = $2 AND v.user_id = $3
+         ORDER BY h.id DESC LIMIT $4 OFFSET $5`,
+		tableID, name, userID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(&e.ID, &e.Value, &e.Type, &e.Revision, &e.Actor, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
+
+func (s *PostgresStore) GetHistoryEntry(historyID, tableID int, name string, userID int) (HistoryEntry, error) {
+	var e HistoryEntry
+	err := s.db.QueryRow(
+		`SELECT h.id, COALESCE(h.value, ''), h.type, h.revision, h.actor, h.created_at
+         FROM variable_history h JOIN variables v ON v.id = h.variable_id
+         WHERE h.id = $1 AND v.table_id = $2 AND v.name = $3 AND v.user_id = $4`,
+		historyID, tableID, name, userID,
+	).Scan(&e.ID, &e.Value, &e.Type, &e.Revision, &e.Actor, &e.CreatedAt)
+	if err == sql.ErrNoRows {
+		return e, ErrNotFound
+	}
+	return e, err
+}
+
+// Project tokens
+func (s *PostgresStore) CreateProjectToken(t ProjectToken, token string, userID int) (int, error) {
+	var tables any
+	if t.Tables != nil {
+		b, _ := json.Marshal(t.Tables)
+		tables = string(b)
+	}
+	var id int
+	err := s.db.QueryRow(
+		`INSERT INTO project_tokens(project_id,user_id,name,token_hash,read_only,tables,expires_at,created_at)
+         SELECT id, user_id, $1::text, $2::text, $3::boolean, $4::text, $5::bigint, $6::bigint
+         FROM projects WHERE id = $7 AND user_id = $8
+         RETURNING id`,
+		t.Name, hashToken(token), t.ReadOnly, tables, t.ExpiresAt, time.Now().Unix(),
+		t.ProjectID, userID,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return id, pgCheckError(err)
+}
+
+func (s *PostgresStore) ListProjectTokens(projectID int, userID int) ([]ProjectToken, error) {
+	rows, err := s.db.Query(
+		`SELECT `+projectTokenColumns+` FROM project_tokens WHERE project_id = $1 AND user_id = $2 ORDER BY id`,
+		projectID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []ProjectToken{}
+	for rows.Next() {
+		t, err := scanProjectToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *PostgresStore) RevokeProjectToken(tokenID, projectID int, userID int) error {
+	res, err := s.db.Exec(
+		`DELETE FROM project_tokens WHERE id = $1 AND project_id = $2 AND user_id = $3`,
+		tokenID, projectID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetProjectTokenByValue(token string) (t ProjectToken, userID int, err error) {
+	now := time.Now().Unix()
+	row := s.db.QueryRow(
+		`SELECT `+projectTokenColumns+`, user_id FROM project_tokens
+         WHERE token_hash = $1 AND (expires_at IS NULL OR expires_at > $2)`,
+		hashToken(token), now,
+	)
+	t, err = scanProjectToken(row, &userID)
+	if err == sql.ErrNoRows {
+		return t, 0, ErrNotFound
+	} else if err != nil {
+		return t, 0, err
+	}
+
+	// last use is kept to the minute so reads don't all turn into writes;
+	// it's only bookkeeping, so failing to record it doesn't fail the lookup
+	_, err = s.db.Exec(
+		`UPDATE project_tokens SET last_used_at = $1 WHERE id = $2 AND (last_used_at IS NULL OR last_used_at < $3)`,
+		now, t.ID, now-60,
+	)
+	if err != nil {
+		log.Printf("project token %d: recording last use: %v", t.ID, err)
+	}
+	return t, userID, nil
+}
+
+// Webhooks
+func (s *PostgresStore) CreateWebhook(projectID, tableID int, url, secret string, userID int) (int, error) {
+	var table any
+	if tableID != 0 {
+		table = tableID
+	}
+	var id int
+	err := s.db.QueryRow(
+		`INSERT INTO webhooks(project_id,table_id,user_id,url,secret)
+         SELECT id, $1::integer, user_id, $2::text, $3::text
+         FROM projects WHERE id = $4 AND user_id = $5
+         RETURNING id`,
+		table, url, secret,
+		projectID, userID,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return id, pgCheckError(err)
+}
+
+func (s *PostgresStore) ListWebhooks(projectID int, userID int) ([]Webhook, error) {
+	rows, err := s.db.Query(
+		`SELECT id, project_id, COALESCE(table_id, 0), url FROM webhooks
+         WHERE project_id = $1 AND user_id = $2 ORDER BY id`,
+		projectID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var h Webhook
+		if err := rows.Scan(&h.ID, &h.ProjectID, &h.TableID, &h.URL); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, h)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *PostgresStore) DeleteWebhook(webhookID, projectID int, userID int) error {
+	_, err := s.db.Exec(
+		`DELETE FROM webhooks WHERE id = $1 AND project_id = $2 AND user_id = $3`,
+		webhookID, projectID, userID,
+	)
+	return err
+}
+
+func (s *PostgresStore) WebhooksForEvent(projectID, tableID int) ([]Webhook, error) {
+	rows, err := s.db.Query(
+		`SELECT id, project_id, COALESCE(table_id, 0), url, secret FROM webhooks
+         WHERE project_id = $1 AND (table_id IS NULL OR table_id = $2) ORDER BY id`,
+		projectID, tableID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var h Webhook
+		if err := rows.Scan(&h.ID, &h.ProjectID, &h.TableID, &h.URL, &h.Secret); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, h)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *PostgresStore) EnqueueWebhookDelivery(webhookID int, event, payload string, now int64) error {
+	_, err := s.db.Exec(
+		`INSERT INTO webhook_deliveries(webhook_id,event,payload,next_attempt_at,created_at) VALUES($1,$2,$3,$4,$5)`,
+		webhookID, event, payload, now, now,
+	)
+	return pgCheckError(err)
+}
+
+// webhookLease is how long a delivery handed out by DueWebhookDeliveries is
+// held back from other instances. It has to outlast a batch of attempts.
+const webhookLease = 5 * time.Minute
+
+// DueWebhookDeliveries also pushes the next attempt of the deliveries it
+// returns back by webhookLease, so that other instances polling at the same
+// time skip them. If the attempt never gets recorded, the delivery comes due
+// again once the lease is over.
+func (s *PostgresStore) DueWebhookDeliveries(now int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(
+		`WITH due AS (
+             SELECT id FROM webhook_deliveries
+             WHERE status = 'pending' AND next_attempt_at <= $1
+             ORDER BY id LIMIT $2
+             FOR UPDATE SKIP LOCKED
+         )
+         UPDATE webhook_deliveries d SET next_attempt_at = $3
+         FROM due, webhooks w
+         WHERE d.id = due.id AND w.id = d.webhook_id
+         RETURNING d.id, d.webhook_id, d.event, d.payload, d.attempts, w.url, w.secret`,
+		now, limit, now+int64(webhookLease/time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		d.Status = "pending"
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// UPDATE ... RETURNING doesn't keep the order of the CTE
+	slices.SortFunc(deliveries, func(a, b WebhookDelivery) int { return a.ID - b.ID })
+	return deliveries, nil
+}
+
+func (s *PostgresStore) UpdateWebhookDelivery(d WebhookDelivery) error {
+	_, err := s.db.Exec(
+		`UPDATE webhook_deliveries
+         SET status = $1, attempts = $2, next_attempt_at = $3, response_code = $4, last_error = $5
+         WHERE id = $6`,
+		d.Status, d.Attempts, d.NextAttemptAt, d.ResponseCode, d.LastError, d.ID,
+	)
+	return pgCheckError(err)
+}
+
+func (s *PostgresStore) ListWebhookDeliveries(webhookID int, userID int, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(
+		`SELECT d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at,
+                d.response_code, d.last_error, d.created_at
+         FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+         WHERE d.webhook_id = $1 AND w.user_id = $2
+         ORDER BY d.id DESC LIMIT $3`,
+		webhookID, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.ResponseCode, &d.LastError, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Sessions
+func (s *PostgresStore) CreateSession(userID int, refreshToken string, expiresAt int64) (int, error) {
+	now := time.Now().Unix()
+	var id int
+	err := s.db.QueryRow(
+		`INSERT INTO sessions(user_id,token_hash,created_at,rotated_at,expires_at) VALUES($1,$2,$3,$4,$5) RETURNING id`,
+		userID, hashToken(refreshToken), now, now, expiresAt,
+	).Scan(&id)
+	return id, pgCheckError(err)
+}
+
+func (s *PostgresStore) GetSessionByRefreshToken(refreshToken string) (Session, error) {
+	row := s.db.QueryRow(
+		`SELECT `+sessionColumns+`, token_hash <> $1 FROM sessions
+         WHERE (token_hash = $1 OR previous_token_hash = $1) AND expires_at > $2`,
+		hashToken(refreshToken), time.Now().Unix(),
+	)
+	var reused bool
+	ses, err := scanSession(row, &reused)
+	ses.Reused = reused
+	return ses, err
+}
+
+func (s *PostgresStore) RotateSession(sessionID int, oldToken, newToken string, expiresAt int64) error {
+	res, err := s.db.Exec(
+		`UPDATE sessions SET previous_token_hash = token_hash, token_hash = $1, rotated_at = $2, expires_at = $3
+         WHERE id = $4 AND token_hash = $5`,
+		hashToken(newToken), time.Now().Unix(), expiresAt, sessionID, hashToken(oldToken),
+	)
+	if err != nil {
+		return pgCheckError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetSession(sessionID, userID int) (Session, error) {
+	return scanSession(s.db.QueryRow(
+		`SELECT `+sessionColumns+` FROM sessions WHERE id = $1 AND user_id = $2 AND expires_at > $3`,
+		sessionID, userID, time.Now().Unix(),
+	))
+}
+
+func (s *PostgresStore) DeleteSession(sessionID, userID int) error {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE id = $1 AND user_id = $2`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeleteUserSessions(userID int) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE user_id = $1`, userID)
+	return err
+}
+
+func (s *PostgresStore) DeleteExpiredSessions(now int64) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= $1`, now)
+	return err
+}
+
+// Invites
+func (s *PostgresStore) CreateInvite(code string, expiresAt int64) error {
+	_, err := s.db.Exec(
+		`INSERT INTO invites(code_hash,created_at,expires_at) VALUES($1,$2,$3)`,
+		hashToken(code), time.Now().Unix(), expiresAt,
+	)
+	return pgCheckError(err)
+}
+
+func (s *PostgresStore) UseInvite(code string, userID int) error {
+	now := time.Now().Unix()
+	res, err := s.db.Exec(
+		`UPDATE invites SET used_by = $1, used_at = $2
+         WHERE code_hash = $3 AND used_at IS NULL AND expires_at > $2`,
+		userID, now, hashToken(code),
+	)
+	if err != nil {
+		return pgCheckError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Two-factor authentication
+func (s *PostgresStore) GetTOTP(userID int) (TOTP, error) {
+	var t TOTP
+	var secret sql.NullString
+	err := s.db.QueryRow(
+		`SELECT totp_secret, totp_enabled, totp_last_step,
+             (SELECT COUNT(*) FROM recovery_codes WHERE user_id = users.id)
+         FROM users WHERE id = $1`, userID,
+	).Scan(&secret, &t.Enabled, &t.LastStep, &t.RecoveryCodes)
+	if err == sql.ErrNoRows {
+		return t, ErrNotFound
+	}
+	t.Secret = secret.String
+	return t, err
+}
+
+func (s *PostgresStore) SetTOTPSecret(userID int, secret string) error {
+	return s.updateUser(`UPDATE users SET totp_secret = $1, totp_enabled = FALSE WHERE id = $2`, secret, userID)
+}
+
+func (s *PostgresStore) EnableTOTP(userID int) error {
+	return s.updateUser(`UPDATE users SET totp_enabled = TRUE WHERE id = $1`, userID)
+}
+
+func (s *PostgresStore) DisableTOTP(userID int) error {
+	return s.tx(func(tx *PostgresStore) error {
+		err := tx.updateUser(
+			`UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0 WHERE id = $1`, userID,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.db.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+		return err
+	})
+}
+
+func (s *PostgresStore) UseTOTPStep(userID int, step int64) error {
+	return s.updateUser(`UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1`, step, userID)
+}
+
+func (s *PostgresStore) SetRecoveryCodes(userID int, codes []string) error {
+	return s.tx(func(tx *PostgresStore) error {
+		if _, err := tx.db.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		for _, code := range codes {
+			_, err := tx.db.Exec(
+				`INSERT INTO recovery_codes(user_id,code_hash) VALUES($1,$2)`, userID, hashToken(code),
+			)
+			if err != nil {
+				return pgCheckError(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresStore) UseRecoveryCode(userID int, code string) error {
+	return s.updateUser(`DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2`, userID, hashToken(code))
+}
+
+// updateUser runs a statement on one user, returning ErrNotFound if it
+// changes nothing.
+func (s *PostgresStore) updateUser(query string, args ...any) error {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return pgCheckError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxPasswordBytes is the most bcrypt hashes; it refuses longer passwords.
+const maxPasswordBytes = 72
+
+// accountPolicy is what usernames and passwords have to be like, and who
+// may register, as Config sets it up.
+type accountPolicy struct {
+	username     *regexp.Regexp
+	minLength    int
+	minClasses   int
+	breached     map[string]bool
+	registration string
+}
+
+func newAccountPolicy(cfg Config) accountPolicy {
+	return accountPolicy{
+		username:     regexp.MustCompile(cfg.UsernamePattern),
+		minLength:    cfg.PasswordMinLength,
+		minClasses:   cfg.PasswordMinClasses,
+		breached:     cfg.breached,
+		registration: cfg.Registration,
+	}
+}
+
+// checkUsername returns why a user can't be called username, if they can't.
+func (p accountPolicy) checkUsername(username string) error {
+	if !p.username.MatchString(username) {
+		return fmt.Errorf("username must match %s", p.username)
+	}
+	return nil
+}
+
+// checkPassword returns why the user can't have password, if they can't.
+func (p accountPolicy) checkPassword(username, password string) error {
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+	if utf8.RuneCountInString(password) < p.minLength {
+		return fmt.Errorf("password must be at least %d characters", p.minLength)
+	}
+	if passwordClasses(password) < p.minClasses {
+		return fmt.Errorf("password must mix at least %d of lower case letters, upper case letters, digits and symbols", p.minClasses)
+	}
+	lower := strings.ToLower(password)
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return errors.New("password must not contain the username")
+	}
+	if p.breached[lower] {
+		return errors.New("password is known from a data breach; choose another")
+	}
+	return nil
+}
+
+// passwordClasses counts the kinds of characters in password.
+func passwordClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountPolicy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PasswordMinClasses = 3
+	cfg.breached = map[string]bool{"passw0rd!": true}
+	policy := newAccountPolicy(cfg)
+
+	for _, name := range []string{"alice", "bob.smith", "user_42"} {
+		assert.NoError(t, policy.checkUsername(name), name)
+	}
+	for _, name := range []string{"", "al", ".alice", "alice smith", "<script>", strings.Repeat("a", 33)} {
+		assert.Error(t, policy.checkUsername(name), name)
+	}
+
+	assert.NoError(t, policy.checkPassword("alice", "Correct horse"))
+	assert.NoError(t, policy.checkPassword("alice", "pässwörd-42"))
+	for _, pw := range []string{
+		"Sh0rt",                       // too short
+		"correct horse",               // two classes
+		"my Alice password",           // has the username
+		"PASSW0RD!",                   // breached, whatever the case
+		strings.Repeat("Aa1", 25),     // longer than bcrypt takes
+		strings.Repeat("ü", 36) + "A", // 73 bytes
+	} {
+		assert.Error(t, policy.checkPassword("alice", pw), pw)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	forEachStore(t, testRegistration)
+}
+
+func testRegistration(t *testing.T, store Store) {
+	cfg := DefaultConfig()
+	post := func(api *testAPI, path, body string) int {
+		return api.send("POST", path, "", body, nil)
+	}
+	mount := func(cfg Config) *testAPI {
+		return newTestAPI(t, store, cfg, LogMailer{})
+	}
+
+	open := mount(cfg)
+	assert.Equal(t, http.StatusBadRequest, post(open, "/api/register", `{"username":"","password":"correct horse"}`))
+	assert.Equal(t, http.StatusBadRequest, post(open, "/api/register", `{"username":"alice","password":""}`))
+	assert.Equal(t, http.StatusBadRequest, post(open, "/api/register", `{"username":"alice","password":"`+strings.Repeat("x", 73)+`"}`))
+	assert.Equal(t, http.StatusCreated, post(open, "/api/register", `{"username":"alice","password":"correct horse"}`))
+	assert.Equal(t, http.StatusConflict, post(open, "/api/register", `{"username":"alice","password":"correct horse"}`))
+
+	// with invites, a code gets one user in
+	cfg.Registration = registrationInvite
+	invite := mount(cfg)
+	assert.NoError(t, store.CreateInvite("welcome", 1<<40))
+	assert.Equal(t, http.StatusForbidden, post(invite, "/api/register", `{"username":"bob","password":"correct horse"}`))
+	assert.Equal(t, http.StatusForbidden, post(invite, "/api/register", `{"username":"bob","password":"correct horse","invite_code":"wrong"}`))
+	_, _, err := store.GetUserByUsername("bob")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, http.StatusCreated, post(invite, "/api/register", `{"username":"bob","password":"correct horse","invite_code":"welcome"}`))
+	assert.Equal(t, http.StatusForbidden, post(invite, "/api/register", `{"username":"carol","password":"correct horse","invite_code":"welcome"}`))
+
+	// with approval, users can't log in until approved
+	cfg.Registration = registrationApproval
+	approval := mount(cfg)
+	assert.Equal(t, http.StatusAccepted, post(approval, "/api/register", `{"username":"carol","password":"correct horse"}`))
+	assert.Equal(t, http.StatusForbidden, post(approval, "/api/login", `{"username":"carol","password":"correct horse"}`))
+	assert.Equal(t, http.StatusUnauthorized, post(approval, "/api/login", `{"username":"carol","password":"wrong"}`))
+	carol, _, _ := store.GetUserByUsername("carol")
+	assert.NoError(t, store.SetUserApproved(carol, true))
+	assert.Equal(t, http.StatusOK, post(approval, "/api/login", `{"username":"carol","password":"correct horse"}`))
+	assert.Equal(t, http.StatusOK, post(approval, "/api/login", `{"username":"alice","password":"correct horse"}`))
+}
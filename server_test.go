@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeDrainsRequests(t *testing.T) {
+	t.Cleanup(func() {
+		sockets.Lock()
+		sockets.closed = false
+		sockets.Unlock()
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, srv, 5*time.Second) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	responded := make(chan result, 1)
+	go func() {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get("http://" + addr); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			responded <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		responded <- result{string(b), err}
+	}()
+
+	<-started
+	cancel()
+	// new connections are refused while the request in flight finishes
+	assert.Eventually(t, func() bool {
+		_, err := net.Dial("tcp", addr)
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+
+	r := <-responded
+	assert.NoError(t, r.err)
+	assert.Equal(t, "done", r.body)
+	assert.NoError(t, <-served)
+}
+
+func TestHubCloseSubscriptions(t *testing.T) {
+	h := NewHub()
+	sub := h.Subscribe(1, 0)
+	h.CloseSubscriptions()
+	_, ok := <-sub.C
+	assert.False(t, ok)
+	assert.Equal(t, errHubClosed, sub.Err)
+
+	late := h.Subscribe(1, 0)
+	_, ok = <-late.C
+	assert.False(t, ok)
+	assert.Equal(t, errHubClosed, late.Err)
+	h.Unsubscribe(late)
+}
+
+// writeTestCert writes a new self-signed certificate for name and its key.
+func writeTestCert(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	if certFile != "" {
+		assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	}
+	if keyFile != "" {
+		assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "old.example")
+
+	r, err := newCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	commonName := func() string {
+		cert, err := r.GetCertificate(nil)
+		assert.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+	touch := func(names ...string) {
+		later := time.Now().Add(time.Minute)
+		for _, name := range names {
+			assert.NoError(t, os.Chtimes(name, later, later))
+		}
+		r.checked = time.Time{}
+	}
+	assert.Equal(t, "old.example", commonName())
+
+	// a certificate without its key yet keeps the old pair
+	writeTestCert(t, certFile, "", "new.example")
+	touch(certFile)
+	assert.Equal(t, "old.example", commonName())
+
+	writeTestCert(t, certFile, keyFile, "new.example")
+	touch(certFile, keyFile)
+	assert.Equal(t, "new.example", commonName())
+
+	_, err = newCertReloader(filepath.Join(dir, "missing.pem"), keyFile)
+	assert.Error(t, err)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// refreshReuseGrace is how long after a refresh the token it replaced is
+// merely turned away rather than taken as stolen: two tabs of the dashboard
+// may refresh with the same token at once.
+var refreshReuseGrace = 30 * time.Second
+
+// tokenIssuer signs dashboard access tokens and starts the sessions that
+// refresh them.
+type tokenIssuer struct {
+	auth       *jwtauth.JWTAuth
+	accessTTL  time.Duration
+	sessionTTL time.Duration
+}
+
+// tokenResponse is what logging in and refreshing answer with. The access
+// token goes in the Authorization header; the refresh token is only sent to
+// /api/refresh, and is replaced every time it is.
+type tokenResponse struct {
+	Token            string `json:"token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+// randomToken returns a random token, such as a refresh token.
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSession starts a session for the user and returns its first tokens.
+func (ti tokenIssuer) startSession(store Store, userID int) (tokenResponse, error) {
+	refresh := randomToken()
+	sessionID, err := store.CreateSession(userID, refresh, time.Now().Add(ti.sessionTTL).Unix())
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	return ti.issue(userID, sessionID, refresh)
+}
+
+func (ti tokenIssuer) issue(userID, sessionID int, refresh string) (tokenResponse, error) {
+	_, access, err := ti.auth.Encode(map[string]any{
+		"user_id": userID,
+		"sid":     sessionID,
+		"exp":     jwtauth.ExpireIn(ti.accessTTL),
+	})
+	return tokenResponse{
+		Token:            access,
+		ExpiresIn:        int64(ti.accessTTL / time.Second),
+		RefreshToken:     refresh,
+		RefreshExpiresIn: int64(ti.sessionTTL / time.Second),
+	}, err
+}
+
+// sessionClaims returns the user and session of a verified access token.
+// Tokens from before sessions existed have no session and aren't accepted.
+func sessionClaims(claims map[string]any) (userID, sessionID int, ok bool) {
+	uid, ok1 := claims["user_id"].(float64)
+	sid, ok2 := claims["sid"].(float64)
+	return int(uid), int(sid), ok1 && ok2
+}
+
+// RequireSession turns away access tokens whose session has ended, by
+// logging out or expiring. It goes after jwtauth.Authenticator.
+func RequireSession(store Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, claims, _ := jwtauth.FromContext(r.Context())
+			userID, sessionID, ok := sessionClaims(claims)
+			if !ok {
+				writeJSON(w, http.StatusUnauthorized, errorResp{"session ended"})
+				return
+			}
+			if _, err := store.GetSession(sessionID, userID); err == ErrNotFound {
+				writeJSON(w, http.StatusUnauthorized, errorResp{"session ended"})
+				return
+			} else if err != nil {
+				writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requirePageSession is jwtauth.Authenticator and RequireSession for the
+// dashboard pages. Instead of answering 401 it sends the browser to the
+// login page, which refreshes the session if it can and comes back.
+func requirePageSession(store Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, claims, err := jwtauth.FromContext(r.Context())
+			if err == nil && token != nil {
+				if userID, sessionID, ok := sessionClaims(claims); ok {
+					if _, err := store.GetSession(sessionID, userID); err == nil {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.Path), http.StatusFound)
+		})
+	}
+}
+
+// Refresh trades a refresh token for a new access token and refresh token.
+// A refresh token that was already traded in means it got out, so the
+// session is ended, unless that happened just now and is most likely
+// another tab refreshing at the same time; that is answered with 409.
+func Refresh(store Store, tokens tokenIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+
+		ses, err := store.GetSessionByRefreshToken(req.RefreshToken)
+		if err == ErrNotFound {
+			writeJSON(w, http.StatusUnauthorized, errorResp{"invalid refresh token"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		if ses.Reused {
+			if time.Since(time.Unix(ses.RotatedAt, 0)) <= refreshReuseGrace {
+				writeJSON(w, http.StatusConflict, errorResp{"refresh token already used"})
+				return
+			}
+			if err := store.DeleteSession(ses.ID, ses.UserID); err != nil && err != ErrNotFound {
+				writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusUnauthorized, errorResp{"refresh token reused; session ended"})
+			return
+		}
+
+		refresh := randomToken()
+		err = store.RotateSession(ses.ID, req.RefreshToken, refresh, time.Now().Add(tokens.sessionTTL).Unix())
+		if err == ErrNotFound {
+			// another refresh with the same token got there first
+			writeJSON(w, http.StatusConflict, errorResp{"refresh token already used"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		resp, err := tokens.issue(ses.UserID, ses.ID, refresh)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// Logout ends the session of the request's access token.
+func Logout(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID, sessionID, _ := sessionClaims(claims)
+		if err := store.DeleteSession(sessionID, userID); err != nil && err != ErrNotFound {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// LogoutAll ends every session of the user, on every device.
+func LogoutAll(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		if err := store.DeleteUserSessions(userID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
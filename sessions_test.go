@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessions(t *testing.T) {
+	forEachStore(t, testSessions)
+}
+
+func testSessions(t *testing.T, store Store) {
+	api := newTestAPI(t, store, DefaultConfig(), LogMailer{})
+
+	post := func(path, token, body string) (int, tokenResponse) {
+		var tokens tokenResponse
+		code := api.send("POST", path, token, body, &tokens)
+		return code, tokens
+	}
+	refresh := func(refreshToken string) (int, tokenResponse) {
+		return post("/api/refresh", "", `{"refresh_token":"`+refreshToken+`"}`)
+	}
+	projects := func(token string) int {
+		return api.send("GET", "/api/projects", token, nil, nil)
+	}
+	login := func() tokenResponse {
+		code, tokens := post("/api/login", "", `{"username":"alice","password":"correct horse"}`)
+		assert.Equal(t, http.StatusOK, code)
+		assert.NotEmpty(t, tokens.Token)
+		assert.NotEmpty(t, tokens.RefreshToken)
+		assert.Equal(t, int64(DefaultConfig().TokenTTL.Seconds()), tokens.ExpiresIn)
+		return tokens
+	}
+
+	code, _ := post("/api/register", "", `{"username":"alice","password":"correct horse"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	first := login()
+	assert.Equal(t, http.StatusOK, projects(first.Token))
+
+	// refreshing replaces the refresh token but keeps the session
+	code, second := refresh(first.RefreshToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.Equal(t, http.StatusOK, projects(first.Token))
+	assert.Equal(t, http.StatusOK, projects(second.Token))
+
+	// right after, the old refresh token is only turned away
+	code, _ = refresh(first.RefreshToken)
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, http.StatusOK, projects(second.Token))
+
+	// later it means the token was stolen, which ends the session
+	grace := refreshReuseGrace
+	refreshReuseGrace = -1
+	t.Cleanup(func() { refreshReuseGrace = grace })
+	code, _ = refresh(first.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, http.StatusUnauthorized, projects(second.Token))
+	code, _ = refresh(second.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = refresh("unknown")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// logging out ends one session, logging out everywhere all of them
+	laptop, phone := login(), login()
+	code, _ = post("/api/logout", laptop.Token, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusUnauthorized, projects(laptop.Token))
+	code, _ = refresh(laptop.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, http.StatusOK, projects(phone.Token))
+
+	tablet := login()
+	code, _ = post("/api/logout/all", phone.Token, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusUnauthorized, projects(phone.Token))
+	assert.Equal(t, http.StatusUnauthorized, projects(tablet.Token))
+
+	// tokens from before sessions can't be revoked, so they are refused
+	userID, _, _ := store.GetUserByUsername("alice")
+	_, legacy, _ := jwtauth.New("HS256", []byte(defaultJWTSecret), nil).Encode(map[string]any{
+		"user_id": userID,
+		"exp":     jwtauth.ExpireIn(DefaultConfig().SessionTTL),
+	})
+	assert.Equal(t, http.StatusUnauthorized, projects(legacy))
+
+	// pages send the browser to log in instead
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	page := func(token string) *http.Response {
+		req, _ := http.NewRequest("GET", api.URL+"/dashboard", nil)
+		req.AddCookie(&http.Cookie{Name: "jwt", Value: token})
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	resp := page(tablet.Token)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/login?next=%2Fdashboard", resp.Header.Get("Location"))
+	assert.Equal(t, http.StatusOK, page(login().Token).StatusCode)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a row isn't found.
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned when a row would duplicate a unique one.
+	ErrExists = errors.New("already exists")
+	// ErrTokenInGrace is returned when rotating a project token with a
+	// grace period while the token before is still in its own.
+	ErrTokenInGrace = errors.New("previous token still in its grace period")
+)
+
+// Store keeps users, their projects, tables and variables, and everything
+// attached to them. SQLStore keeps them in SQLite, PostgresStore in Postgres
+// and MemoryStore in memory, for tests and ephemeral deployments. All of
+// them pass the conformance tests in store_test.go.
+//
+// Methods taking a userID only see that user's rows and report others as
+// ErrNotFound or, for renames and deletes, ignore them.
+type Store interface {
+	// Tx runs fn against a Store whose changes are kept only if fn returns
+	// nil. Inside fn, Tx runs its argument within the same transaction,
+	// undoing only the argument's changes if it fails.
+	Tx(fn func(tx Store) error) error
+
+	// Users
+	CreateUser(username, pwHash string) error
+	GetUserByUsername(username string) (id int, pwHash string, err error)
+	GetUser(userID int) (User, error)
+	// RenameUser returns ErrExists if the username is taken.
+	RenameUser(userID int, username string) error
+	SetUserPassword(userID int, pwHash string) error
+	// SetUserEmail changes the user's email, which stays unverified until
+	// VerifyUserEmail is given verifyToken before expiresAt. An empty email
+	// removes it. Only verified emails are unique: it returns ErrExists if
+	// another user has verified the email, while any number of users may
+	// claim it unverified.
+	SetUserEmail(userID int, email, verifyToken string, expiresAt int64) error
+	// VerifyUserEmail marks the email verifyToken was made for as verified
+	// and returns its user. It returns ErrExists if another user verified
+	// the email first.
+	VerifyUserEmail(verifyToken string) (userID int, err error)
+	// DeleteUser deletes the user with everything they own.
+	DeleteUser(userID int) error
+	// SetUserApproved approves a user, or holds back one who registered on
+	// a server that approves registrations. Users are approved when created.
+	SetUserApproved(userID int, approved bool) error
+	// ListPendingUsers returns the users awaiting approval, oldest first.
+	ListPendingUsers() ([]User, error)
+
+	// Projects
+	CreateProject(userID int, name, token string) (int, error)
+	ListProjects(userID int) ([]Project, error)
+	// GetProject returns a project with its tables and their variables.
+	GetProject(projID, userID int) (map[string]any, error)
+	// GetProjectByToken looks up a project by its token. A token that was
+	// rotated away but is still within its grace period also matches;
+	// sunset is then the time it stops working, and 0 otherwise.
+	GetProjectByToken(token string) (id, userID int, sunset int64, err error)
+	// RotateProjectToken replaces a project's token. The old one keeps
+	// working until graceUntil; a graceUntil in the past invalidates it
+	// right away. Only one old token is kept, so a rotation with a grace
+	// period is ErrTokenInGrace while the one before is still in its own;
+	// one without ends both old tokens.
+	RotateProjectToken(projID int, token string, graceUntil int64, userID int) error
+	RenameProject(projID int, name string, userID int) error
+	// DeleteProject deletes a project with everything in it.
+	DeleteProject(projID int, userID int) error
+	SetHistoryRetention(projID int, retention int, userID int) error
+
+	// Tables
+	// CreateTable returns ErrNotFound if the project isn't the user's and
+	// ErrExists if it already has a table of that name.
+	CreateTable(projectID int, name string, userID int) (int, error)
+	GetTableID(projectID int, name string, userID int) (int, error)
+	GetTableProjectID(tableID int) (int, error)
+	// ListTables returns a project's tables ordered by name.
+	ListTables(projectID int, userID int) ([]Table, error)
+	RenameTable(tableID int, name string, userID int) error
+	// DeleteTable deletes a table with its variables, their history and
+	// the webhooks limited to it.
+	DeleteTable(tableID int, userID int) error
+
+	// Variables
+	// CreateVariable adds a variable to a table of the user. It returns
+	// errInvalidType for an unknown type, ValidationErrors when value isn't
+	// valid for typ, options (the allowed values of an enum) or c,
+	// ErrExists when the table already has a variable of that name and
+	// ErrNotFound when the table isn't the user's.
+	CreateVariable(tableID int, name, value, typ string, options []string, c Constraints, userID int) error
+	// ListVariables returns a table's variables ordered by name.
+	ListVariables(tableID int, userID int) ([]Variable, error)
+	GetVariable(tableID int, name string) (value, typ string, revision int, err error)
+	// GetUserVariable is GetVariable for a variable of the given user;
+	// other users' variables are ErrNotFound.
+	GetUserVariable(tableID int, name string, userID int) (value, typ string, err error)
+	GetVariableType(tableID int, name string) (string, error)
+	// GetVariableRules returns what a variable's values are checked
+	// against besides its type: the allowed values of an enum and its
+	// constraints.
+	GetVariableRules(tableID int, name string) (options []string, c Constraints, err error)
+	// SetVariable stores an already encoded value and returns the new
+	// revision. Structured values that aren't JSON of their type are
+	// errInvalidValue.
+	SetVariable(tableID int, name, value string) (revision int, err error)
+	// CompareAndSetVariable sets the value only if the stored revision
+	// still equals expected. It returns ErrNotFound when nothing was
+	// written.
+	CompareAndSetVariable(tableID int, name, value string, expected int) (revision int, err error)
+	// IncrementVariable adds delta to an int or float variable atomically
+	// and returns the new stored value and revision. With clamp the result
+	// is limited to the given bounds; without it an update that would leave
+	// them is ErrNotFound, as is a variable that isn't of type typ.
+	IncrementVariable(tableID int, name, typ string, delta float64, min, max *float64, clamp bool) (value string, revision int, err error)
+	// ChangeVariableType gives a variable a new type together with its
+	// value, options and constraints under that type, returning the new
+	// revision.
+	ChangeVariableType(tableID int, name, typ, value string, options []string, c Constraints, userID int) (revision int, err error)
+	// SetVariableConstraints replaces the constraints of a variable.
+	SetVariableConstraints(tableID int, name string, c Constraints, userID int) error
+	// DeleteVariable returns ErrNotFound if there was no such variable.
+	DeleteVariable(tableID int, name string, userID int) error
+
+	// History
+	// RecordVariableHistory stores a version of a variable and prunes
+	// versions beyond the retention configured on its project.
+	RecordVariableHistory(tableID int, name, value, typ string, revision int, actor string) error
+	// ListVariableHistory returns a page of a variable's versions, newest
+	// first, and the total number of stored versions.
+	ListVariableHistory(tableID int, name string, userID int, limit, offset int) ([]HistoryEntry, int, error)
+	GetHistoryEntry(historyID, tableID int, name string, userID int) (HistoryEntry, error)
+
+	// Project tokens
+	// CreateProjectToken stores the hash of token; it returns ErrNotFound
+	// if the project isn't the user's.
+	CreateProjectToken(t ProjectToken, token string, userID int) (int, error)
+	ListProjectTokens(projectID int, userID int) ([]ProjectToken, error)
+	RevokeProjectToken(tokenID, projectID int, userID int) error
+	// GetProjectTokenByValue looks up an unexpired project token and
+	// records that it was used; failing to record that doesn't fail the
+	// lookup. The owner of its project is returned alongside.
+	GetProjectTokenByValue(token string) (t ProjectToken, userID int, err error)
+
+	// Webhooks
+	// CreateWebhook returns ErrNotFound if the project doesn't belong to
+	// userID.
+	CreateWebhook(projectID, tableID int, url, secret string, userID int) (int, error)
+	ListWebhooks(projectID int, userID int) ([]Webhook, error)
+	DeleteWebhook(webhookID, projectID int, userID int) error
+	// WebhooksForEvent returns the webhooks of a project that cover
+	// tableID.
+	WebhooksForEvent(projectID, tableID int) ([]Webhook, error)
+	EnqueueWebhookDelivery(webhookID int, event, payload string, now int64) error
+	// DueWebhookDeliveries returns up to limit pending deliveries whose
+	// next attempt is due, oldest first.
+	DueWebhookDeliveries(now int64, limit int) ([]WebhookDelivery, error)
+	UpdateWebhookDelivery(d WebhookDelivery) error
+	// ListWebhookDeliveries returns the latest deliveries of a webhook,
+	// newest first.
+	ListWebhookDeliveries(webhookID int, userID int, limit int) ([]WebhookDelivery, error)
+
+	// Sessions
+	// CreateSession starts a dashboard session lasting until expiresAt and
+	// stores the hash of its refresh token.
+	CreateSession(userID int, refreshToken string, expiresAt int64) (int, error)
+	// GetSessionByRefreshToken looks up an unexpired session by its refresh
+	// token or, setting Reused, by the token that one replaced.
+	GetSessionByRefreshToken(refreshToken string) (Session, error)
+	// RotateSession replaces a session's refresh token and extends it to
+	// expiresAt. It returns ErrNotFound if the token isn't oldToken any
+	// more, so only one of two refreshes racing each other wins.
+	RotateSession(sessionID int, oldToken, newToken string, expiresAt int64) error
+	// GetSession returns an unexpired session of userID.
+	GetSession(sessionID, userID int) (Session, error)
+	DeleteSession(sessionID, userID int) error
+	DeleteUserSessions(userID int) error
+	DeleteExpiredSessions(now int64) error
+
+	// Invites
+	// CreateInvite stores the hash of a single-use invite code that works
+	// until expiresAt.
+	CreateInvite(code string, expiresAt int64) error
+	// UseInvite spends an unused, unexpired invite code on userID. It
+	// returns ErrNotFound for any other code.
+	UseInvite(code string, userID int) error
+
+	// Two-factor authentication
+	GetTOTP(userID int) (TOTP, error)
+	// SetTOTPSecret gives the user a secret to set up their authenticator
+	// with. Codes are only asked for once EnableTOTP is called.
+	SetTOTPSecret(userID int, secret string) error
+	EnableTOTP(userID int) error
+	// DisableTOTP forgets the user's secret and recovery codes.
+	DisableTOTP(userID int) error
+	// UseTOTPStep records that a code of the time step was accepted. It
+	// returns ErrNotFound if one of that step or a later one already was,
+	// so that every code works once.
+	UseTOTPStep(userID int, step int64) error
+	// SetRecoveryCodes replaces the user's recovery codes, storing their
+	// hashes.
+	SetRecoveryCodes(userID int, codes []string) error
+	// UseRecoveryCode spends one of the user's recovery codes. It returns
+	// ErrNotFound if code isn't one of them.
+	UseRecoveryCode(userID int, code string) error
+}
+
+type User struct {
+	ID            int    `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Approved      bool   `json:"-"`
+	TOTPEnabled   bool   `json:"totp_enabled"`
+	PasswordHash  string `json:"-"`
+}
+
+// TOTP is a user's two-factor authentication. Secret is set while it is
+// being set up and once Enabled.
+type TOTP struct {
+	Secret        string
+	Enabled       bool
+	LastStep      int64
+	RecoveryCodes int
+}
+
+type Project struct {
+	ID   int
+	Name string
+}
+
+type Table struct {
+	ID   int
+	Name string
+}
+
+type Variable struct {
+	Name        string
+	Type        string
+	Value       string
+	Options     []string
+	Constraints Constraints
+}
+
+type Webhook struct {
+	ID        int    `json:"id"`
+	ProjectID int    `json:"project_id"`
+	TableID   int    `json:"table_id"` // 0 for every table of the project
+	URL       string `json:"url"`
+	Secret    string `json:"-"`
+}
+
+type WebhookDelivery struct {
+	ID            int    `json:"id"`
+	WebhookID     int    `json:"webhook_id"`
+	Event         string `json:"event"`
+	Payload       string `json:"payload"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	NextAttemptAt int64  `json:"next_attempt_at"`
+	ResponseCode  int    `json:"response_code"`
+	LastError     string `json:"last_error"`
+	CreatedAt     int64  `json:"created_at"`
+
+	// only filled in by DueWebhookDeliveries
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+type HistoryEntry struct {
+	ID        int    `json:"id"`
+	Value     string `json:"value"`
+	Type      string `json:"type"`
+	Revision  int    `json:"revision"`
+	Actor     string `json:"actor"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type ProjectToken struct {
+	ID        int    `json:"id"`
+	ProjectID int    `json:"project_id"`
+	Name      string `json:"name"`
+	// ReadOnly tokens may only get, list and dump.
+	ReadOnly bool `json:"read_only"`
+	// Tables is the allow-list of table ids; nil allows every table.
+	Tables     []int  `json:"tables"`
+	ExpiresAt  *int64 `json:"expires_at"`
+	LastUsedAt *int64 `json:"last_used_at"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// Session is a dashboard login. Its refresh token changes on every refresh;
+// the one before is remembered so that a stolen token being used again can
+// be told apart from one that never existed.
+type Session struct {
+	ID        int
+	UserID    int
+	CreatedAt int64
+	RotatedAt int64
+	ExpiresAt int64
+	// Reused is set when the session was found by its previous token.
+	Reused bool
+}
+
+// hashToken returns what is stored for a project token or refresh token;
+// the token itself is only shown once, when it's created.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// prepareVariable checks a new variable's value, given as text, and returns
+// the string to store.
+func prepareVariable(value, typ string, options []string, c Constraints) (string, error) {
+	value, err := normalizeValue(typ, options, value)
+	if err == errInvalidValue {
+		return "", invalidValue(typ, options)
+	} else if err != nil {
+		return "", err
+	}
+	if err := c.validate(typ, value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// projectDetails is GetProject for a project found in s.
+func projectDetails(s Store, projID, userID int, name, token string, previousExpiresAt *int64) (map[string]any, error) {
+	tables, err := s.ListTables(projID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	type TableWithVariables struct {
+		ID        int
+		Name      string
+		Variables []Variable
+	}
+	var tablesWithVariables []TableWithVariables
+	// For each table, get the variables
+	for _, table := range tables {
+		variables, _ := s.ListVariables(table.ID, userID)
+		tablesWithVariables = append(tablesWithVariables, TableWithVariables{ID: table.ID, Name: table.Name, Variables: variables})
+	}
+
+	if previousExpiresAt != nil && *previousExpiresAt <= time.Now().Unix() {
+		previousExpiresAt = nil
+	}
+	return map[string]any{
+		"name":                      name,
+		"token":                     token,
+		"previous_token_expires_at": previousExpiresAt,
+		"tables":                    tablesWithVariables,
+	}, nil
+}
+
+// incrementValue is IncrementVariable for stores that compute the new value
+// themselves. It reads the stored value the way SQLite casts it and formats
+// the result the way SQLite turns numbers into text, so every store hands out
+// the same values. ok is false when the result would leave the bounds and
+// clamp isn't set.
+func incrementValue(stored, typ string, delta float64, min, max *float64, clamp bool) (value string, ok bool) {
+	if typ == "int" {
+		n := sqliteInteger(stored) + int64(delta)
+		if min != nil && n < int64(*min) {
+			if !clamp {
+				return "", false
+			}
+			n = int64(*min)
+		}
+		if max != nil && n > int64(*max) {
+			if !clamp {
+				return "", false
+			}
+			n = int64(*max)
+		}
+		return strconv.FormatInt(n, 10), true
+	}
+
+	f, _ := strconv.ParseFloat(strings.TrimSpace(stored), 64)
+	f += delta
+	if min != nil && f < *min {
+		if !clamp {
+			return "", false
+		}
+		f = *min
+	}
+	if max != nil && f > *max {
+		if !clamp {
+			return "", false
+		}
+		f = *max
+	}
+	return sqliteReal(f), true
+}
+
+// sqliteInteger is CAST(s AS INTEGER) for the values an int variable holds.
+func sqliteInteger(s string) int64 {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return int64(f)
+}
+
+// sqliteReal formats f as SQLite does: 15 significant digits, always with a
+// decimal point.
+func sqliteReal(f float64) string {
+	s := strconv.FormatFloat(f, 'g', 15, 64)
+	if strings.ContainsAny(s, ".IN") {
+		return s
+	}
+	if i := strings.IndexByte(s, 'e'); i >= 0 {
+		return s[:i] + ".0" + s[i:]
+	}
+	return s + ".0"
+}
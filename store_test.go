@@ -0,0 +1,805 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// storeBackends makes an empty store of each kind.
+var storeBackends = map[string]func(t *testing.T) Store{
+	"sqlite": func(t *testing.T) Store {
+		db := InitDB(fmt.Sprintf("file:store%d?mode=memory&cache=shared", time.Now().UnixNano()))
+		t.Cleanup(func() { db.Close() })
+		return NewSQLStore(db)
+	},
+	"memory": func(t *testing.T) Store {
+		return NewMemoryStore()
+	},
+}
+
+// Setting REDUSER_TEST_POSTGRES_DSN to a database the tests may create
+// schemas in runs them against Postgres as well. Every store gets a schema
+// of its own, dropped when the test is done.
+func init() {
+	dsn := os.Getenv("REDUSER_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		return
+	}
+	storeBackends["postgres"] = func(t *testing.T) Store {
+		admin := OpenPostgres(dsn)
+		t.Cleanup(func() { admin.Close() })
+		schema := fmt.Sprintf("reduser_test_%d", time.Now().UnixNano())
+		if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+		db := InitPostgres(withSearchPath(dsn, schema))
+		t.Cleanup(func() { db.Close() })
+		return NewPostgresStore(db)
+	}
+}
+
+// withSearchPath adds a search_path to a Postgres connection string, which
+// the driver passes on to the server.
+func withSearchPath(dsn, schema string) string {
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+// TestStoreConformance runs the same checks against every Store.
+func TestStoreConformance(t *testing.T) {
+	tests := map[string]func(t *testing.T, s Store){
+		"users":      testStoreUsers,
+		"projects":   testStoreProjects,
+		"tables":     testStoreTables,
+		"variables":  testStoreVariables,
+		"increments": testStoreIncrements,
+		"history":    testStoreHistory,
+		"tokens":     testStoreTokens,
+		"webhooks":   testStoreWebhooks,
+		"sessions":   testStoreSessions,
+		"accounts":   testStoreAccounts,
+		"invites":    testStoreInvites,
+		"totp":       testStoreTOTP,
+		"cascades":   testStoreCascades,
+		"tx":         testStoreTx,
+	}
+	for backend, open := range storeBackends {
+		for name, test := range tests {
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				test(t, open(t))
+			})
+		}
+	}
+}
+
+// storeUser creates a user with a project and a table.
+func storeUser(t *testing.T, s Store, name string) (userID, projectID, tableID int) {
+	assert.NoError(t, s.CreateUser(name, "hash"))
+	userID, _, err := s.GetUserByUsername(name)
+	assert.NoError(t, err)
+	projectID, err = s.CreateProject(userID, "Game", name+"-token")
+	assert.NoError(t, err)
+	tableID, err = s.CreateTable(projectID, "Config", userID)
+	assert.NoError(t, err)
+	return userID, projectID, tableID
+}
+
+func testStoreUsers(t *testing.T, s Store) {
+	assert.NoError(t, s.CreateUser("alice", "hash"))
+	assert.ErrorIs(t, s.CreateUser("alice", "other"), ErrExists)
+
+	id, hash, err := s.GetUserByUsername("alice")
+	assert.NoError(t, err)
+	assert.NotZero(t, id)
+	assert.Equal(t, "hash", hash)
+
+	_, _, err = s.GetUserByUsername("bob")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testStoreProjects(t *testing.T, s Store) {
+	alice, project, table := storeUser(t, s, "alice")
+	bob, _, _ := storeUser(t, s, "bob")
+
+	_, err := s.CreateProject(bob, "Stolen", "alice-token")
+	assert.ErrorIs(t, err, ErrExists)
+	other, err := s.CreateProject(alice, "Launcher", "launcher-token")
+	assert.NoError(t, err)
+	assert.NoError(t, s.RenameProject(other, "Tools", alice))
+	assert.NoError(t, s.RenameProject(other, "Hijacked", bob))
+
+	projects, err := s.ListProjects(alice)
+	assert.NoError(t, err)
+	assert.Equal(t, []Project{{project, "Game"}, {other, "Tools"}}, projects)
+
+	details, err := s.GetProject(project, alice)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice-token", details["token"])
+	_, err = s.GetProject(project, bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	id, userID, sunset, err := s.GetProjectByToken("alice-token")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{project, alice}, []int{id, userID})
+	assert.Zero(t, sunset)
+
+	graceUntil := time.Now().Add(time.Hour).Unix()
+	assert.ErrorIs(t, s.RotateProjectToken(project, "new-token", graceUntil, bob), ErrNotFound)
+	assert.NoError(t, s.RotateProjectToken(project, "new-token", graceUntil, alice))
+	_, _, sunset, err = s.GetProjectByToken("alice-token")
+	assert.NoError(t, err)
+	assert.Equal(t, graceUntil, sunset)
+	_, _, sunset, err = s.GetProjectByToken("new-token")
+	assert.NoError(t, err)
+	assert.Zero(t, sunset)
+
+	// the first old token is still in its grace period, so rotating again
+	// only works without one, ending both old tokens
+	assert.ErrorIs(t, s.RotateProjectToken(project, "newer-token", graceUntil, alice), ErrTokenInGrace)
+	_, _, _, err = s.GetProjectByToken("alice-token")
+	assert.NoError(t, err)
+	assert.NoError(t, s.RotateProjectToken(project, "newer-token", 0, alice))
+	for _, old := range []string{"alice-token", "new-token"} {
+		_, _, _, err = s.GetProjectByToken(old)
+		assert.ErrorIs(t, err, ErrNotFound, old)
+	}
+
+	// after that a grace period is fine again
+	assert.NoError(t, s.RotateProjectToken(project, "newest-token", graceUntil, alice))
+	_, _, sunset, _ = s.GetProjectByToken("newer-token")
+	assert.Equal(t, graceUntil, sunset)
+
+	tables, err := s.ListTables(project, alice)
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{{table, "Config"}}, tables)
+}
+
+func testStoreTables(t *testing.T, s Store) {
+	alice, project, table := storeUser(t, s, "alice")
+	bob, bobProject, _ := storeUser(t, s, "bob")
+
+	_, err := s.CreateTable(project, "Config", alice)
+	assert.ErrorIs(t, err, ErrExists)
+	_, err = s.CreateTable(project, "Intruder", bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	other, err := s.CreateTable(project, "Other", alice)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, s.RenameTable(other, "Config", alice), ErrExists)
+	assert.NoError(t, s.RenameTable(other, "Other", alice))
+	assert.NoError(t, s.RenameTable(other, "Renamed", alice))
+	assert.NoError(t, s.RenameTable(other, "Bob's", bob))
+
+	id, err := s.GetTableID(project, "Renamed", alice)
+	assert.NoError(t, err)
+	assert.Equal(t, other, id)
+	_, err = s.GetTableID(project, "Renamed", bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	projectID, err := s.GetTableProjectID(table)
+	assert.NoError(t, err)
+	assert.Equal(t, project, projectID)
+
+	assert.NoError(t, s.DeleteTable(other, bob))
+	assert.NoError(t, s.DeleteTable(other, alice))
+	_, err = s.GetTableProjectID(other)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	tables, err := s.ListTables(bobProject, alice)
+	assert.NoError(t, err)
+	assert.Empty(t, tables)
+}
+
+func testStoreVariables(t *testing.T, s Store) {
+	alice, _, table := storeUser(t, s, "alice")
+	bob, _, _ := storeUser(t, s, "bob")
+
+	maxLength := 5
+	c := Constraints{MaxLength: &maxLength}
+	assert.NoError(t, s.CreateVariable(table, "name", "hero", "string", nil, c, alice))
+	assert.NoError(t, s.CreateVariable(table, "mode", "", "enum", []string{"easy", "hard"}, Constraints{}, alice))
+	assert.NoError(t, s.CreateVariable(table, "items", "", "list", nil, Constraints{}, alice))
+	assert.ErrorIs(t, s.CreateVariable(table, "name", "", "string", nil, Constraints{}, alice), ErrExists)
+	assert.ErrorIs(t, s.CreateVariable(table, "x", "", "string", nil, Constraints{}, bob), ErrNotFound)
+	assert.ErrorIs(t, s.CreateVariable(table, "x", "", "complex", nil, Constraints{}, alice), errInvalidType)
+	var invalid ValidationErrors
+	assert.True(t, errors.As(s.CreateVariable(table, "x", "medium", "enum", []string{"easy", "hard"}, Constraints{}, alice), &invalid))
+	assert.True(t, errors.As(s.CreateVariable(table, "x", "[", "json", nil, Constraints{}, alice), &invalid))
+	assert.True(t, errors.As(s.CreateVariable(table, "x", "heroic", "string", nil, c, alice), &invalid))
+
+	vars, err := s.ListVariables(table, alice)
+	assert.NoError(t, err)
+	assert.Equal(t, []Variable{
+		{Name: "items", Type: "list", Value: "[]"},
+		{Name: "mode", Type: "enum", Value: "easy", Options: []string{"easy", "hard"}},
+		{Name: "name", Type: "string", Value: "hero", Constraints: c},
+	}, vars)
+	vars, err = s.ListVariables(table, bob)
+	assert.NoError(t, err)
+	assert.Empty(t, vars)
+
+	rev, err := s.SetVariable(table, "items", `[1, 2]`)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rev)
+	_, err = s.SetVariable(table, "items", `{"a": 1}`)
+	assert.ErrorIs(t, err, errInvalidValue)
+	_, err = s.SetVariable(table, "missing", "")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = s.CompareAndSetVariable(table, "name", "villain", 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	rev, err = s.CompareAndSetVariable(table, "name", "villain", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rev)
+
+	value, typ, rev, err := s.GetVariable(table, "name")
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"villain", "string", 1}, []any{value, typ, rev})
+	_, _, err = s.GetUserVariable(table, "name", bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+	typ, err = s.GetVariableType(table, "mode")
+	assert.NoError(t, err)
+	assert.Equal(t, "enum", typ)
+	options, rules, err := s.GetVariableRules(table, "name")
+	assert.NoError(t, err)
+	assert.Nil(t, options)
+	assert.Equal(t, c, rules)
+
+	rev, err = s.ChangeVariableType(table, "name", "map", `{}`, nil, Constraints{}, alice)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rev)
+	_, err = s.ChangeVariableType(table, "name", "list", `{}`, nil, Constraints{}, alice)
+	assert.ErrorIs(t, err, errInvalidValue)
+	_, err = s.ChangeVariableType(table, "name", "int", "1", nil, Constraints{}, bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	rev, err = s.ChangeVariableType(table, "name", "string", "hero", nil, Constraints{}, alice)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, rev)
+	assert.NoError(t, s.SetVariableConstraints(table, "name", Constraints{Required: true}, alice))
+	assert.ErrorIs(t, s.SetVariableConstraints(table, "name", Constraints{}, bob), ErrNotFound)
+	_, rules, _ = s.GetVariableRules(table, "name")
+	assert.Equal(t, Constraints{Required: true}, rules)
+
+	assert.ErrorIs(t, s.DeleteVariable(table, "name", bob), ErrNotFound)
+	assert.NoError(t, s.DeleteVariable(table, "name", alice))
+	assert.ErrorIs(t, s.DeleteVariable(table, "name", alice), ErrNotFound)
+}
+
+func testStoreIncrements(t *testing.T, s Store) {
+	alice, _, table := storeUser(t, s, "alice")
+	assert.NoError(t, s.CreateVariable(table, "coins", "5", "int", nil, Constraints{}, alice))
+	assert.NoError(t, s.CreateVariable(table, "speed", "2.5", "float", nil, Constraints{}, alice))
+
+	f := func(f float64) *float64 { return &f }
+	value, rev, err := s.IncrementVariable(table, "coins", "int", 3, nil, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "8", value)
+	assert.Equal(t, 1, rev)
+
+	_, _, err = s.IncrementVariable(table, "coins", "int", 3, nil, f(10), false)
+	assert.ErrorIs(t, err, ErrNotFound)
+	value, _, err = s.IncrementVariable(table, "coins", "int", 3, nil, f(10), true)
+	assert.NoError(t, err)
+	assert.Equal(t, "10", value)
+	value, _, err = s.IncrementVariable(table, "coins", "int", -20, f(0), nil, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "0", value)
+	_, _, err = s.IncrementVariable(table, "coins", "float", 1, nil, nil, false)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// floats come back formatted the way SQLite formats them
+	value, _, err = s.IncrementVariable(table, "speed", "float", 0.5, nil, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "3.0", value)
+	_, _ = s.SetVariable(table, "speed", "0.1")
+	value, _, err = s.IncrementVariable(table, "speed", "float", 0.2, nil, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "0.3", value)
+	value, _, err = s.IncrementVariable(table, "speed", "float", 1e20, nil, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0e+20", value)
+	value, rev, err = s.IncrementVariable(table, "speed", "float", 0, f(-1), f(1.5), true)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.5", value)
+	assert.Equal(t, 5, rev)
+}
+
+func testStoreHistory(t *testing.T, s Store) {
+	alice, project, table := storeUser(t, s, "alice")
+	bob, _, _ := storeUser(t, s, "bob")
+	assert.NoError(t, s.SetHistoryRetention(project, 3, alice))
+	assert.NoError(t, s.CreateVariable(table, "v", "0", "int", nil, Constraints{}, alice))
+	assert.NoError(t, s.CreateVariable(table, "other", "", "string", nil, Constraints{}, alice))
+	assert.ErrorIs(t, s.RecordVariableHistory(table, "missing", "x", "string", 1, "user:1"), ErrNotFound)
+
+	for rev := 1; rev <= 5; rev++ {
+		assert.NoError(t, s.RecordVariableHistory(table, "v", fmt.Sprint(rev), "int", rev, "user:1"))
+	}
+	assert.NoError(t, s.RecordVariableHistory(table, "other", "x", "string", 1, "user:1"))
+
+	entries, total, err := s.ListVariableHistory(table, "v", alice, 2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, total)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, []int{5, 4}, []int{entries[0].Revision, entries[1].Revision})
+	entries, _, _ = s.ListVariableHistory(table, "v", alice, 2, 2)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "3", entries[0].Value)
+	assert.Equal(t, "user:1", entries[0].Actor)
+
+	entries, total, err = s.ListVariableHistory(table, "v", bob, 10, 0)
+	assert.NoError(t, err)
+	assert.Zero(t, total)
+	assert.Equal(t, []HistoryEntry{}, entries)
+
+	entry, err := s.GetHistoryEntry(historyOf(t, s, table, alice)[0].ID, table, "v", alice)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, entry.Revision)
+	_, err = s.GetHistoryEntry(entry.ID, table, "v", bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.GetHistoryEntry(entry.ID, table, "other", alice)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// no history at all
+	assert.NoError(t, s.SetHistoryRetention(project, 0, alice))
+	assert.NoError(t, s.RecordVariableHistory(table, "v", "6", "int", 6, "user:1"))
+	_, total, _ = s.ListVariableHistory(table, "v", alice, 10, 0)
+	assert.Zero(t, total)
+
+	// versions go with their variable
+	assert.NoError(t, s.SetHistoryRetention(project, 3, alice))
+	assert.NoError(t, s.DeleteVariable(table, "other", alice))
+	assert.NoError(t, s.CreateVariable(table, "other", "", "string", nil, Constraints{}, alice))
+	_, total, _ = s.ListVariableHistory(table, "other", alice, 10, 0)
+	assert.Zero(t, total)
+}
+
+// historyOf lists the history of variable v in table.
+func historyOf(t *testing.T, s Store, table, userID int) []HistoryEntry {
+	entries, _, err := s.ListVariableHistory(table, "v", userID, 10, 0)
+	assert.NoError(t, err)
+	return entries
+}
+
+func testStoreTokens(t *testing.T, s Store) {
+	alice, project, table := storeUser(t, s, "alice")
+	bob, _, _ := storeUser(t, s, "bob")
+
+	_, err := s.CreateProjectToken(ProjectToken{ProjectID: project, Name: "ci"}, "secret", bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+	id, err := s.CreateProjectToken(ProjectToken{ProjectID: project, Name: "ci", ReadOnly: true, Tables: []int{table}}, "secret", alice)
+	assert.NoError(t, err)
+	_, err = s.CreateProjectToken(ProjectToken{ProjectID: project, Name: "again"}, "secret", alice)
+	assert.ErrorIs(t, err, ErrExists)
+	past := time.Now().Add(-time.Minute).Unix()
+	_, err = s.CreateProjectToken(ProjectToken{ProjectID: project, Name: "old", ExpiresAt: &past}, "expired", alice)
+	assert.NoError(t, err)
+
+	token, userID, err := s.GetProjectTokenByValue("secret")
+	assert.NoError(t, err)
+	assert.Equal(t, alice, userID)
+	assert.Equal(t, id, token.ID)
+	assert.True(t, token.ReadOnly)
+	assert.Equal(t, []int{table}, token.Tables)
+	assert.Nil(t, token.LastUsedAt)
+	_, _, err = s.GetProjectTokenByValue("expired")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	tokens, err := s.ListProjectTokens(project, alice)
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 2)
+	assert.Equal(t, "ci", tokens[0].Name)
+	assert.NotNil(t, tokens[0].LastUsedAt)
+	tokens, _ = s.ListProjectTokens(project, bob)
+	assert.Equal(t, []ProjectToken{}, tokens)
+
+	assert.ErrorIs(t, s.RevokeProjectToken(id, project, bob), ErrNotFound)
+	assert.NoError(t, s.RevokeProjectToken(id, project, alice))
+	_, _, err = s.GetProjectTokenByValue("secret")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testStoreWebhooks(t *testing.T, s Store) {
+	alice, project, table := storeUser(t, s, "alice")
+	bob, _, _ := storeUser(t, s, "bob")
+	other, _ := s.CreateTable(project, "Other", alice)
+
+	_, err := s.CreateWebhook(project, 0, "https://example.com", "s", bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+	all, err := s.CreateWebhook(project, 0, "https://example.com/all", "s1", alice)
+	assert.NoError(t, err)
+	limited, err := s.CreateWebhook(project, table, "https://example.com/config", "s2", alice)
+	assert.NoError(t, err)
+
+	hooks, err := s.ListWebhooks(project, alice)
+	assert.NoError(t, err)
+	assert.Equal(t, []Webhook{
+		{ID: all, ProjectID: project, URL: "https://example.com/all"},
+		{ID: limited, ProjectID: project, TableID: table, URL: "https://example.com/config"},
+	}, hooks)
+	hooks, _ = s.ListWebhooks(project, bob)
+	assert.Equal(t, []Webhook{}, hooks)
+
+	hooks, err = s.WebhooksForEvent(project, other)
+	assert.NoError(t, err)
+	assert.Len(t, hooks, 1)
+	assert.Equal(t, "s1", hooks[0].Secret)
+	hooks, _ = s.WebhooksForEvent(project, table)
+	assert.Len(t, hooks, 2)
+
+	assert.NoError(t, s.EnqueueWebhookDelivery(all, "set", `{"a":1}`, 100))
+	assert.NoError(t, s.EnqueueWebhookDelivery(limited, "set", `{"a":2}`, 200))
+	due, err := s.DueWebhookDeliveries(150, 10)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+	d := due[0]
+	assert.Equal(t, []any{all, "set", `{"a":1}`, "pending", "https://example.com/all", "s1"},
+		[]any{d.WebhookID, d.Event, d.Payload, d.Status, d.URL, d.Secret})
+
+	d.Status, d.Attempts, d.ResponseCode, d.LastError = "failed", 1, 500, "server error"
+	assert.NoError(t, s.UpdateWebhookDelivery(d))
+	d.Status = "lost"
+	assert.Error(t, s.UpdateWebhookDelivery(d))
+	due, _ = s.DueWebhookDeliveries(1000, 10)
+	assert.Len(t, due, 1)
+	assert.Equal(t, limited, due[0].WebhookID)
+
+	deliveries, err := s.ListWebhookDeliveries(all, alice, 10)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, []any{"failed", 1, 500, "server error", int64(100)},
+		[]any{deliveries[0].Status, deliveries[0].Attempts, deliveries[0].ResponseCode, deliveries[0].LastError, deliveries[0].CreatedAt})
+	deliveries, _ = s.ListWebhookDeliveries(all, bob, 10)
+	assert.Empty(t, deliveries)
+
+	assert.NoError(t, s.DeleteWebhook(all, project, bob))
+	assert.NoError(t, s.DeleteWebhook(all, project, alice))
+	hooks, _ = s.ListWebhooks(project, alice)
+	assert.Len(t, hooks, 1)
+	deliveries, _ = s.ListWebhookDeliveries(all, alice, 10)
+	assert.Empty(t, deliveries)
+}
+
+func testStoreSessions(t *testing.T, s Store) {
+	alice, _, _ := storeUser(t, s, "alice")
+	bob, _, _ := storeUser(t, s, "bob")
+	later := time.Now().Add(time.Hour).Unix()
+
+	_, err := s.CreateSession(alice+bob, "nobody", later)
+	assert.ErrorIs(t, err, ErrNotFound)
+	id, err := s.CreateSession(alice, "first", later)
+	assert.NoError(t, err)
+	_, err = s.CreateSession(bob, "first", later)
+	assert.ErrorIs(t, err, ErrExists)
+	expired, err := s.CreateSession(alice, "expired", time.Now().Add(-time.Minute).Unix())
+	assert.NoError(t, err)
+
+	ses, err := s.GetSessionByRefreshToken("first")
+	assert.NoError(t, err)
+	assert.Equal(t, id, ses.ID)
+	assert.Equal(t, alice, ses.UserID)
+	assert.False(t, ses.Reused)
+	_, err = s.GetSessionByRefreshToken("expired")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.GetSession(expired, alice)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// only the current token can be rotated, once
+	assert.NoError(t, s.RotateSession(id, "first", "second", later+60))
+	assert.ErrorIs(t, s.RotateSession(id, "first", "third", later), ErrNotFound)
+	ses, err = s.GetSessionByRefreshToken("second")
+	assert.NoError(t, err)
+	assert.False(t, ses.Reused)
+	assert.Equal(t, later+60, ses.ExpiresAt)
+	ses, err = s.GetSessionByRefreshToken("first")
+	assert.NoError(t, err)
+	assert.True(t, ses.Reused)
+
+	_, err = s.GetSession(id, bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+	ses, err = s.GetSession(id, alice)
+	assert.NoError(t, err)
+	assert.Equal(t, id, ses.ID)
+
+	assert.ErrorIs(t, s.DeleteSession(id, bob), ErrNotFound)
+	assert.NoError(t, s.DeleteSession(id, alice))
+	_, err = s.GetSessionByRefreshToken("second")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	a, _ := s.CreateSession(alice, "a", later)
+	b, _ := s.CreateSession(bob, "b", later)
+	assert.NoError(t, s.DeleteUserSessions(alice))
+	_, err = s.GetSession(a, alice)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.GetSession(b, bob)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.DeleteExpiredSessions(later+1))
+	_, err = s.GetSession(b, bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testStoreAccounts(t *testing.T, s Store) {
+	alice, _, table := storeUser(t, s, "alice")
+	bob, _, _ := storeUser(t, s, "bob")
+	later := time.Now().Add(time.Hour).Unix()
+
+	user, err := s.GetUser(alice)
+	assert.NoError(t, err)
+	assert.Equal(t, User{ID: alice, Username: "alice", Approved: true, PasswordHash: "hash"}, user)
+	_, err = s.GetUser(alice + bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.ErrorIs(t, s.RenameUser(alice, "bob"), ErrExists)
+	assert.NoError(t, s.RenameUser(alice, "carol"))
+	_, _, err = s.GetUserByUsername("alice")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, s.SetUserPassword(alice, "new"))
+	id, hash, err := s.GetUserByUsername("carol")
+	assert.NoError(t, err)
+	assert.Equal(t, alice, id)
+	assert.Equal(t, "new", hash)
+
+	// a new email is unverified until its token comes back, and until then
+	// others may claim it too
+	assert.NoError(t, s.SetUserEmail(alice, "a@example.com", "verify", later))
+	assert.NoError(t, s.SetUserEmail(bob, "a@example.com", "other", later))
+	_, err = s.VerifyUserEmail("unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+	user, _ = s.GetUser(alice)
+	assert.Equal(t, "a@example.com", user.Email)
+	assert.False(t, user.EmailVerified)
+	id, err = s.VerifyUserEmail("verify")
+	assert.NoError(t, err)
+	assert.Equal(t, alice, id)
+	_, err = s.VerifyUserEmail("verify")
+	assert.ErrorIs(t, err, ErrNotFound)
+	user, _ = s.GetUser(alice)
+	assert.True(t, user.EmailVerified)
+
+	// once verified it is alice's alone
+	_, err = s.VerifyUserEmail("other")
+	assert.ErrorIs(t, err, ErrExists)
+	assert.ErrorIs(t, s.SetUserEmail(bob, "a@example.com", "again", later), ErrExists)
+	assert.NoError(t, s.SetUserEmail(bob, "b@example.com", "expired", time.Now().Add(-time.Minute).Unix()))
+	_, err = s.VerifyUserEmail("expired")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// removing emails leaves nothing to collide
+	assert.NoError(t, s.SetUserEmail(alice, "", "", 0))
+	assert.NoError(t, s.SetUserEmail(bob, "", "", 0))
+	user, _ = s.GetUser(alice)
+	assert.Empty(t, user.Email)
+	assert.False(t, user.EmailVerified)
+
+	// deleting a user takes their projects and sessions along
+	session, _ := s.CreateSession(alice, "refresh", later)
+	assert.NoError(t, s.CreateVariable(table, "v", "1", "int", nil, Constraints{}, alice))
+	assert.NoError(t, s.DeleteUser(alice))
+	assert.ErrorIs(t, s.DeleteUser(alice), ErrNotFound)
+	_, err = s.GetUser(alice)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.GetSession(session, alice)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.GetTableProjectID(table)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, _, _, err = s.GetProjectByToken("alice-token")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.GetUser(bob)
+	assert.NoError(t, err)
+}
+
+func testStoreInvites(t *testing.T, s Store) {
+	alice, _, _ := storeUser(t, s, "alice")
+	bob, _, _ := storeUser(t, s, "bob")
+	later := time.Now().Add(time.Hour).Unix()
+
+	// users wait for approval only when told to
+	assert.NoError(t, s.SetUserApproved(bob, false))
+	assert.ErrorIs(t, s.SetUserApproved(alice+bob, false), ErrNotFound)
+	pending, err := s.ListPendingUsers()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "bob", pending[0].Username)
+	assert.False(t, pending[0].Approved)
+	assert.NoError(t, s.SetUserApproved(bob, true))
+	pending, _ = s.ListPendingUsers()
+	assert.Empty(t, pending)
+
+	assert.NoError(t, s.CreateInvite("code", later))
+	assert.ErrorIs(t, s.CreateInvite("code", later), ErrExists)
+	assert.NoError(t, s.CreateInvite("expired", time.Now().Add(-time.Minute).Unix()))
+	assert.ErrorIs(t, s.UseInvite("expired", alice), ErrNotFound)
+	assert.ErrorIs(t, s.UseInvite("unknown", alice), ErrNotFound)
+	assert.ErrorIs(t, s.UseInvite("code", alice+bob), ErrNotFound)
+	assert.NoError(t, s.UseInvite("code", alice))
+	assert.ErrorIs(t, s.UseInvite("code", bob), ErrNotFound)
+
+	// a used invite stays used when its user goes
+	assert.NoError(t, s.DeleteUser(alice))
+	assert.ErrorIs(t, s.UseInvite("code", bob), ErrNotFound)
+}
+
+func testStoreTOTP(t *testing.T, s Store) {
+	alice, _, _ := storeUser(t, s, "alice")
+	bob, _, _ := storeUser(t, s, "bob")
+
+	totp, err := s.GetTOTP(alice)
+	assert.NoError(t, err)
+	assert.Equal(t, TOTP{}, totp)
+	_, err = s.GetTOTP(alice + bob)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// a secret does nothing until enabled
+	assert.NoError(t, s.SetTOTPSecret(alice, "SECRET"))
+	user, _ := s.GetUser(alice)
+	assert.False(t, user.TOTPEnabled)
+	assert.NoError(t, s.Tx(func(tx Store) error {
+		if err := tx.EnableTOTP(alice); err != nil {
+			return err
+		}
+		return tx.SetRecoveryCodes(alice, []string{"one", "two"})
+	}))
+	user, _ = s.GetUser(alice)
+	assert.True(t, user.TOTPEnabled)
+	totp, _ = s.GetTOTP(alice)
+	assert.Equal(t, TOTP{Secret: "SECRET", Enabled: true, RecoveryCodes: 2}, totp)
+
+	// codes work once, and not after a later one
+	assert.NoError(t, s.UseTOTPStep(alice, 100))
+	assert.ErrorIs(t, s.UseTOTPStep(alice, 100), ErrNotFound)
+	assert.ErrorIs(t, s.UseTOTPStep(alice, 99), ErrNotFound)
+	assert.NoError(t, s.UseTOTPStep(alice, 101))
+
+	assert.ErrorIs(t, s.UseRecoveryCode(bob, "one"), ErrNotFound)
+	assert.NoError(t, s.UseRecoveryCode(alice, "one"))
+	assert.ErrorIs(t, s.UseRecoveryCode(alice, "one"), ErrNotFound)
+	totp, _ = s.GetTOTP(alice)
+	assert.Equal(t, 1, totp.RecoveryCodes)
+	assert.NoError(t, s.SetRecoveryCodes(alice, []string{"three"}))
+	assert.ErrorIs(t, s.UseRecoveryCode(alice, "two"), ErrNotFound)
+
+	// a failed transaction leaves the codes as they were
+	failed := errors.New("failed")
+	assert.ErrorIs(t, s.Tx(func(tx Store) error {
+		if err := tx.UseRecoveryCode(alice, "three"); err != nil {
+			return err
+		}
+		return failed
+	}), failed)
+	totp, _ = s.GetTOTP(alice)
+	assert.Equal(t, 1, totp.RecoveryCodes)
+
+	assert.NoError(t, s.DisableTOTP(alice))
+	totp, _ = s.GetTOTP(alice)
+	assert.Equal(t, TOTP{}, totp)
+	assert.ErrorIs(t, s.UseRecoveryCode(alice, "three"), ErrNotFound)
+	assert.ErrorIs(t, s.DisableTOTP(alice+bob), ErrNotFound)
+}
+
+func testStoreCascades(t *testing.T, s Store) {
+	alice, project, table := storeUser(t, s, "alice")
+	other, _ := s.CreateTable(project, "Other", alice)
+	for _, id := range []int{table, other} {
+		assert.NoError(t, s.CreateVariable(id, "v", "1", "int", nil, Constraints{}, alice))
+		assert.NoError(t, s.RecordVariableHistory(id, "v", "1", "int", 0, "user:1"))
+	}
+	hook, _ := s.CreateWebhook(project, table, "https://example.com", "s", alice)
+	projectHook, _ := s.CreateWebhook(project, 0, "https://example.com", "s", alice)
+	assert.NoError(t, s.EnqueueWebhookDelivery(hook, "set", "{}", 0))
+	_, err := s.CreateProjectToken(ProjectToken{ProjectID: project, Name: "ci"}, "secret", alice)
+	assert.NoError(t, err)
+
+	// a table takes its variables, history and webhooks along
+	assert.NoError(t, s.DeleteTable(table, alice))
+	_, _, _, err = s.GetVariable(table, "v")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, total, _ := s.ListVariableHistory(table, "v", alice, 10, 0)
+	assert.Zero(t, total)
+	hooks, _ := s.ListWebhooks(project, alice)
+	assert.Len(t, hooks, 1)
+	due, _ := s.DueWebhookDeliveries(0, 10)
+	assert.Empty(t, due)
+
+	// a project takes everything
+	assert.NoError(t, s.EnqueueWebhookDelivery(projectHook, "set", "{}", 0))
+	assert.NoError(t, s.DeleteProject(project, alice))
+	_, err = s.GetTableProjectID(other)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, _, _, err = s.GetVariable(other, "v")
+	assert.ErrorIs(t, err, ErrNotFound)
+	hooks, _ = s.WebhooksForEvent(project, other)
+	assert.Empty(t, hooks)
+	due, _ = s.DueWebhookDeliveries(0, 10)
+	assert.Empty(t, due)
+	_, _, err = s.GetProjectTokenByValue("secret")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, _, _, err = s.GetProjectByToken("alice-token")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testStoreTx(t *testing.T, s Store) {
+	alice, project, table := storeUser(t, s, "alice")
+	assert.NoError(t, s.CreateVariable(table, "v", "1", "int", nil, Constraints{}, alice))
+
+	failed := errors.New("failed")
+	err := s.Tx(func(tx Store) error {
+		if _, err := tx.SetVariable(table, "v", "2"); err != nil {
+			return err
+		}
+		// nested transactions are part of the outer one
+		return tx.Tx(func(tx Store) error {
+			_, err := tx.SetVariable(table, "v", "3")
+			assert.NoError(t, err)
+			return failed
+		})
+	})
+	assert.ErrorIs(t, err, failed)
+	value, _, rev, _ := s.GetVariable(table, "v")
+	assert.Equal(t, []any{"1", 0}, []any{value, rev})
+
+	// a failed nested transaction only undoes its own changes
+	err = s.Tx(func(tx Store) error {
+		assert.ErrorIs(t, tx.Tx(func(tx Store) error {
+			_, err := tx.SetVariable(table, "v", "3")
+			assert.NoError(t, err)
+			return failed
+		}), failed)
+		// Postgres would refuse this if the failure aborted the transaction
+		assert.ErrorIs(t, tx.Tx(func(tx Store) error {
+			return tx.CreateVariable(table, "v", "1", "int", nil, Constraints{}, alice)
+		}), ErrExists)
+		value, _, rev, _ := tx.GetVariable(table, "v")
+		assert.Equal(t, []any{"1", 0}, []any{value, rev})
+		return tx.CreateVariable(table, "w", "1", "int", nil, Constraints{}, alice)
+	})
+	assert.NoError(t, err)
+	value, _, rev, _ = s.GetVariable(table, "v")
+	assert.Equal(t, []any{"1", 0}, []any{value, rev})
+	assert.NoError(t, s.DeleteVariable(table, "w", alice))
+
+	err = s.Tx(func(tx Store) error {
+		value, _, _, err := tx.GetVariable(table, "v")
+		assert.Equal(t, "1", value)
+		if err != nil {
+			return err
+		}
+		_, err = tx.SetVariable(table, "v", "2")
+		return err
+	})
+	assert.NoError(t, err)
+	value, _, rev, _ = s.GetVariable(table, "v")
+	assert.Equal(t, []any{"2", 1}, []any{value, rev})
+
+	// A failed transaction leaves every kind of row it touched as it was
+	err = s.Tx(func(tx Store) error {
+		assert.NoError(t, tx.RecordVariableHistory(table, "v", "2", "int", 1, "test"))
+		assert.NoError(t, tx.DeleteVariable(table, "v", alice))
+		assert.NoError(t, tx.CreateVariable(table, "w", "1", "int", nil, Constraints{}, alice))
+		assert.NoError(t, tx.RenameTable(table, "Renamed", alice))
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+	value, _, rev, _ = s.GetVariable(table, "v")
+	assert.Equal(t, []any{"2", 1}, []any{value, rev})
+	_, _, _, err = s.GetVariable(table, "w")
+	assert.Equal(t, ErrNotFound, err)
+	_, total, _ := s.ListVariableHistory(table, "v", alice, 10, 0)
+	assert.Zero(t, total)
+	tables, _ := s.ListTables(project, alice)
+	assert.Equal(t, "Config", tables[0].Name)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// streamHeartbeat is how often an idle stream sends a comment line so that
+// proxies don't close the connection.
+const streamHeartbeat = 15 * time.Second
+
+// streamWriteWait is how long a stream waits for a client to take an event.
+// It replaces the server's write timeout, which a stream would outlive.
+const streamWriteWait = 10 * time.Second
+
+// ProjectAccessStream streams changes to a project's variables as
+// Server-Sent Events. The project token is passed in the token query
+// parameter since EventSource can't set headers; table optionally limits the
+// stream to one table, by id or name. Once the token stops working the
+// stream sends an error event and ends.
+func ProjectAccessStream(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		scope, err := authenticateToken(store, token)
+		if err == ErrNotFound {
+			writeJSON(w, http.StatusUnauthorized, errorResp{"invalid project token"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		scope.setDeprecation(w.Header())
+
+		tableID := 0
+		if t := r.URL.Query().Get("table"); t != "" {
+			var ref tableRef
+			if id, err := strconv.Atoi(t); err == nil {
+				ref.ID = id
+			} else {
+				ref.Name = t
+			}
+			tableID, err = scope.resolveTable(store, ref)
+			if err != nil {
+				code, body := accessErrorBody(err)
+				writeJSON(w, code, body)
+				return
+			}
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSON(w, http.StatusInternalServerError, errorResp{"streaming unsupported"})
+			return
+		}
+
+		sub := hub.Subscribe(scope.ProjectID, tableID)
+		defer hub.Unsubscribe(sub)
+
+		// the server's read deadline would end the request once it passes,
+		// and its write deadline is replaced by one per event
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Now().Add(streamWriteWait))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ": connected\n\n")
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		lost := watchToken(store, token, scope, r.Context().Done())
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-lost:
+				rc.SetWriteDeadline(time.Now().Add(streamWriteWait))
+				fmt.Fprint(w, "event: error\ndata: {\"error\":\"invalid project token\"}\n\n")
+				flusher.Flush()
+				return
+			case <-heartbeat.C:
+				rc.SetWriteDeadline(time.Now().Add(streamWriteWait))
+				fmt.Fprint(w, ": ping\n\n")
+			case ev, ok := <-sub.C:
+				if !ok {
+					// dropped by the hub for falling behind, or the server
+					// is shutting down
+					return
+				}
+				if !scope.allows(ev.TableID) {
+					continue
+				}
+				data, _ := json.Marshal(ev)
+				rc.SetWriteDeadline(time.Now().Add(streamWriteWait))
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, data)
+			}
+			flusher.Flush()
+		}
+	}
+}
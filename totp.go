@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP codes are those of RFC 6238 with the parameters authenticator apps
+// assume: HMAC-SHA1, six digits and a new code every 30 seconds.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many periods a code may be early or late, for clocks
+	// that are off and codes typed in slowly.
+	totpSkew = 1
+)
+
+// totpIssuer names the server in authenticator apps.
+const totpIssuer = "Reduser"
+
+// recoveryCodeCount is how many recovery codes a user gets at a time.
+const recoveryCodeCount = 10
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random secret in base32, as apps take it.
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpCode returns the code of secret for a time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", n%1_000_000), nil
+}
+
+// totpMatch returns the time step code is for, if it is within totpSkew of
+// now.
+func totpMatch(secret, code string, now time.Time) (step int64, ok bool) {
+	if len(code) != totpDigits || secret == "" {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		want, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI that authenticator apps scan as a QR code.
+func totpURI(account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+account) + "?" + q.Encode()
+}
+
+// newRecoveryCodes returns codes that each stand in for a TOTP code once,
+// for users who lost their authenticator. They look like "abcde-fghij".
+func newRecoveryCodes() []string {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	// bytes from limit up would make the first letters more likely
+	const limit = 256 - 256%len(alphabet)
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code := make([]byte, 0, 10)
+		var b [1]byte
+		for len(code) < cap(code) {
+			rand.Read(b[:])
+			if int(b[0]) < limit {
+				code = append(code, alphabet[int(b[0])%len(alphabet)])
+			}
+		}
+		codes[i] = string(code[:5]) + "-" + string(code[5:])
+	}
+	return codes
+}
+
+// normalizeRecoveryCode drops what people add or change when typing a
+// recovery code in, so it hashes the same as the one given out.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
+
+// attemptLimiter counts a user's second-factor attempts that weren't right,
+// so that someone with only the password can't go through all codes. Each
+// instance of the server counts on its own.
+type attemptLimiter struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	attempts map[int][]time.Time
+}
+
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{max: max, window: window, attempts: map[int][]time.Time{}}
+}
+
+// reserve counts an attempt of the user unless they have none left, in
+// which case it returns false. The attempt is counted before the code is
+// checked so that parallel requests can't all get past the limit; release
+// takes it back when the code couldn't be checked, and reset clears them
+// all once a code was right.
+func (l *attemptLimiter) reserve(userID int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := l.attempts[userID][:0]
+	for _, t := range l.attempts[userID] {
+		if time.Since(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.max {
+		l.attempts[userID] = recent
+		return false
+	}
+	l.attempts[userID] = append(recent, time.Now())
+	return true
+}
+
+func (l *attemptLimiter) release(userID int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := len(l.attempts[userID]); n > 1 {
+		l.attempts[userID] = l.attempts[userID][:n-1]
+	} else {
+		delete(l.attempts, userID)
+	}
+}
+
+func (l *attemptLimiter) reset(userID int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, userID)
+}
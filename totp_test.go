@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base32"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTP(t *testing.T) {
+	// the SHA-1 test vectors of RFC 6238, cut to six digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for at, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := totpCode(secret, at/totpPeriod)
+		assert.NoError(t, err)
+		assert.Equal(t, want, code, at)
+	}
+
+	now := time.Unix(1234567890, 0)
+	step, ok := totpMatch(secret, "005924", now)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1234567890/totpPeriod), step)
+	early, _ := totpCode(secret, step+1)
+	_, ok = totpMatch(secret, early, now)
+	assert.True(t, ok)
+	tooLate, _ := totpCode(secret, step-2)
+	_, ok = totpMatch(secret, tooLate, now)
+	assert.False(t, ok)
+	_, ok = totpMatch("", "005924", now)
+	assert.False(t, ok)
+
+	secret = newTOTPSecret()
+	assert.Len(t, secret, 32)
+	uri := totpURI("alice", secret)
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/Reduser:alice?"), uri)
+	assert.Contains(t, uri, "secret="+secret)
+
+	codes := newRecoveryCodes()
+	assert.Len(t, codes, recoveryCodeCount)
+	assert.Regexp(t, `^[a-z2-9]{5}-[a-z2-9]{5}$`, codes[0])
+	assert.Equal(t, normalizeRecoveryCode(codes[0]), normalizeRecoveryCode(" "+strings.ToUpper(codes[0])))
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	l := newAttemptLimiter(2, time.Hour)
+	assert.True(t, l.reserve(1))
+	assert.True(t, l.reserve(1))
+	assert.False(t, l.reserve(1))
+	assert.True(t, l.reserve(2))
+	l.release(1)
+	assert.True(t, l.reserve(1), "released attempts don't count")
+	assert.False(t, l.reserve(1))
+	l.reset(1)
+	assert.True(t, l.reserve(1))
+
+	l = newAttemptLimiter(1, -time.Second)
+	assert.True(t, l.reserve(1))
+	assert.True(t, l.reserve(1), "attempts outside the window don't count")
+
+	// parallel attempts can't get past the limit together
+	l = newAttemptLimiter(5, time.Hour)
+	var wg sync.WaitGroup
+	var passed atomic.Int32
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.reserve(1) {
+				passed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(5), passed.Load())
+}
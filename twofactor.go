@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/skip2/go-qrcode"
+)
+
+// loginChallengeTTL is how long a user has to give their second factor
+// after the password.
+const loginChallengeTTL = 5 * time.Minute
+
+// purposeLoginChallenge is the purpose of the tokens Login gives users with
+// two-factor authentication, to be traded in with a code at LoginVerify.
+const purposeLoginChallenge = "login_challenge"
+
+// Wrong codes a user may give within twoFactorWindow before being turned
+// away until it has passed.
+const (
+	twoFactorAttempts = 5
+	twoFactorWindow   = 15 * time.Minute
+)
+
+// checkSecondFactor answers and returns false unless code is a current TOTP
+// code of the user, or one of their recovery codes, which it spends.
+func checkSecondFactor(w http.ResponseWriter, store Store, attempts *attemptLimiter, userID int, code string) bool {
+	if !attempts.reserve(userID) {
+		writeJSON(w, http.StatusTooManyRequests, errorResp{"too many wrong codes; try again later"})
+		return false
+	}
+	totp, err := store.GetTOTP(userID)
+	if err != nil {
+		attempts.release(userID)
+		writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+		return false
+	}
+	if !totp.Enabled {
+		attempts.release(userID)
+		writeJSON(w, http.StatusConflict, errorResp{"two-factor authentication is off"})
+		return false
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := totpMatch(totp.Secret, code, time.Now()); ok {
+		err = store.UseTOTPStep(userID, step)
+	} else {
+		err = store.UseRecoveryCode(userID, normalizeRecoveryCode(code))
+	}
+	if err == ErrNotFound {
+		writeJSON(w, http.StatusUnauthorized, errorResp{"invalid code"})
+		return false
+	} else if err != nil {
+		attempts.release(userID)
+		writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+		return false
+	}
+	attempts.reset(userID)
+	return true
+}
+
+// LoginVerify is the second step of logging in with two-factor
+// authentication: it trades the challenge token from Login and a code for
+// the tokens of a session.
+func LoginVerify(store Store, tokens tokenIssuer, attempts *attemptLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ChallengeToken string `json:"challenge_token"`
+			Code           string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		userID, ok := tokens.purposeUser(req.ChallengeToken, purposeLoginChallenge)
+		if !ok {
+			writeJSON(w, http.StatusUnauthorized, errorResp{"invalid or expired challenge; log in again"})
+			return
+		}
+		if !checkSecondFactor(w, store, attempts, userID, req.Code) {
+			return
+		}
+		answerWithSession(w, store, tokens, userID)
+	}
+}
+
+// AccountTOTPSetup starts setting up two-factor authentication, given the
+// password. It answers with a new secret to add to an authenticator app, as
+// text and as a QR code; AccountTOTPConfirm turns it on.
+func AccountTOTPSetup(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		user, ok := checkPassword(w, store, userID, req.Password)
+		if !ok {
+			return
+		}
+		if user.TOTPEnabled {
+			writeJSON(w, http.StatusConflict, errorResp{"two-factor authentication is already on"})
+			return
+		}
+
+		secret := newTOTPSecret()
+		if err := store.SetTOTPSecret(userID, secret); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		uri := totpURI(user.Username, secret)
+		png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"secret":      secret,
+			"otpauth_uri": uri,
+			"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		})
+	}
+}
+
+// AccountTOTPConfirm turns two-factor authentication on once the user
+// shows their app makes the right codes, and answers with their recovery
+// codes. They are only ever shown here and by AccountRecoveryCodes.
+func AccountTOTPConfirm(store Store, attempts *attemptLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		totp, err := store.GetTOTP(userID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		if totp.Enabled {
+			writeJSON(w, http.StatusConflict, errorResp{"two-factor authentication is already on"})
+			return
+		}
+		if totp.Secret == "" {
+			writeJSON(w, http.StatusConflict, errorResp{"two-factor authentication isn't being set up"})
+			return
+		}
+		if !attempts.reserve(userID) {
+			writeJSON(w, http.StatusTooManyRequests, errorResp{"too many wrong codes; try again later"})
+			return
+		}
+		step, ok := totpMatch(totp.Secret, strings.TrimSpace(req.Code), time.Now())
+		if !ok {
+			writeJSON(w, http.StatusUnauthorized, errorResp{"invalid code"})
+			return
+		}
+
+		codes := newRecoveryCodes()
+		err = store.Tx(func(tx Store) error {
+			if err := tx.EnableTOTP(userID); err != nil {
+				return err
+			}
+			if err := tx.UseTOTPStep(userID, step); err != nil {
+				return err
+			}
+			return tx.SetRecoveryCodes(userID, normalizeRecoveryCodes(codes))
+		})
+		if err != nil {
+			attempts.release(userID)
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		attempts.reset(userID)
+		writeJSON(w, http.StatusOK, map[string]any{"recovery_codes": codes})
+	}
+}
+
+// AccountRecoveryCodes replaces the user's recovery codes, given the
+// password, and answers with the new ones.
+func AccountRecoveryCodes(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		user, ok := checkPassword(w, store, userID, req.Password)
+		if !ok {
+			return
+		}
+		if !user.TOTPEnabled {
+			writeJSON(w, http.StatusConflict, errorResp{"two-factor authentication is off"})
+			return
+		}
+		codes := newRecoveryCodes()
+		if err := store.SetRecoveryCodes(userID, normalizeRecoveryCodes(codes)); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"recovery_codes": codes})
+	}
+}
+
+// AccountTOTPDisable turns two-factor authentication off, given the
+// password and a code.
+func AccountTOTPDisable(store Store, attempts *attemptLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int(claims["user_id"].(float64))
+		var req struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResp{err.Error()})
+			return
+		}
+		if _, ok := checkPassword(w, store, userID, req.Password); !ok {
+			return
+		}
+		if !checkSecondFactor(w, store, attempts, userID, req.Code) {
+			return
+		}
+		if err := store.DisableTOTP(userID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+func normalizeRecoveryCodes(codes []string) []string {
+	normalized := make([]string, len(codes))
+	for i, code := range codes {
+		normalized[i] = normalizeRecoveryCode(code)
+	}
+	return normalized
+}
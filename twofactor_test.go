@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTwoFactor(t *testing.T) {
+	forEachStore(t, testTwoFactor)
+}
+
+func testTwoFactor(t *testing.T, store Store) {
+	send := newTestAPI(t, store, DefaultConfig(), LogMailer{}).send
+	type loginResponse struct {
+		tokenResponse
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
+	}
+	login := func(username string) loginResponse {
+		var resp loginResponse
+		code := send("POST", "/api/login", "", map[string]string{"username": username, "password": "correct horse"}, &resp)
+		assert.Equal(t, http.StatusOK, code)
+		return resp
+	}
+	verify := func(challenge, code string) (int, tokenResponse) {
+		var tokens tokenResponse
+		status := send("POST", "/api/login/verify", "", map[string]string{"challenge_token": challenge, "code": code}, &tokens)
+		return status, tokens
+	}
+	code := func(secret string, step int64) string {
+		c, _ := totpCode(secret, step)
+		return c
+	}
+	type recoveryResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	// enroll sets up two-factor authentication for a new user
+	enroll := func(username string) (token, secret string, recovery []string) {
+		send("POST", "/api/register", "", map[string]string{"username": username, "password": "correct horse"}, nil)
+		session := login(username)
+		var setup struct {
+			Secret string `json:"secret"`
+		}
+		send("POST", "/api/account/2fa/setup", session.Token, map[string]string{"password": "correct horse"}, &setup)
+		var codes recoveryResponse
+		assert.Equal(t, http.StatusOK, send("POST", "/api/account/2fa/confirm", session.Token,
+			map[string]string{"code": code(setup.Secret, time.Now().Unix()/totpPeriod)}, &codes))
+		return session.Token, setup.Secret, codes.RecoveryCodes
+	}
+
+	send("POST", "/api/register", "", map[string]string{"username": "alice", "password": "correct horse"}, nil)
+	session := login("alice")
+	assert.False(t, session.TwoFactorRequired)
+	assert.NotEmpty(t, session.Token)
+
+	// setting up takes the password, then a code from the app
+	var setup struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+		QRCode     string `json:"qr_code"`
+	}
+	assert.Equal(t, http.StatusConflict, send("POST", "/api/account/2fa/confirm", session.Token, map[string]string{"code": "000000"}, nil))
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/account/2fa/setup", session.Token, map[string]string{"password": "wrong"}, nil))
+	assert.Equal(t, http.StatusOK, send("POST", "/api/account/2fa/setup", session.Token, map[string]string{"password": "correct horse"}, &setup))
+	assert.Contains(t, setup.OtpauthURI, "secret="+setup.Secret)
+	assert.True(t, strings.HasPrefix(setup.QRCode, "data:image/png;base64,"))
+	step := time.Now().Unix() / totpPeriod
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/account/2fa/confirm", session.Token,
+		map[string]string{"code": code(setup.Secret, step+5)}, nil))
+	var recovery recoveryResponse
+	assert.Equal(t, http.StatusOK, send("POST", "/api/account/2fa/confirm", session.Token,
+		map[string]string{"code": code(setup.Secret, step)}, &recovery))
+	assert.Len(t, recovery.RecoveryCodes, recoveryCodeCount)
+	var user User
+	send("GET", "/api/account", session.Token, nil, &user)
+	assert.True(t, user.TOTPEnabled)
+	assert.Equal(t, http.StatusConflict, send("POST", "/api/account/2fa/setup", session.Token, map[string]string{"password": "correct horse"}, nil))
+
+	// logging in now takes a code after the password
+	challenge := login("alice")
+	assert.True(t, challenge.TwoFactorRequired)
+	assert.Empty(t, challenge.Token)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/account", challenge.ChallengeToken, nil, nil))
+	status, _ := verify(challenge.ChallengeToken, code(setup.Secret, step))
+	assert.Equal(t, http.StatusUnauthorized, status, "codes work once")
+	status, _ = verify(session.Token, code(setup.Secret, step+1))
+	assert.Equal(t, http.StatusUnauthorized, status, "access tokens aren't challenges")
+	status, tokens := verify(challenge.ChallengeToken, code(setup.Secret, step+1))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/account", tokens.Token, nil, nil))
+
+	// recovery codes work once each, however they are typed
+	status, _ = verify(challenge.ChallengeToken, " "+strings.ToUpper(recovery.RecoveryCodes[0]))
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = verify(challenge.ChallengeToken, recovery.RecoveryCodes[0])
+	assert.Equal(t, http.StatusUnauthorized, status)
+	var replaced recoveryResponse
+	assert.Equal(t, http.StatusOK, send("POST", "/api/account/2fa/recovery-codes", tokens.Token,
+		map[string]string{"password": "correct horse"}, &replaced))
+	status, _ = verify(challenge.ChallengeToken, recovery.RecoveryCodes[1])
+	assert.Equal(t, http.StatusUnauthorized, status)
+	recovery = replaced
+
+	// turning it off takes the password and a code
+	assert.Equal(t, http.StatusUnauthorized, send("DELETE", "/api/account/2fa", tokens.Token,
+		map[string]string{"password": "wrong", "code": recovery.RecoveryCodes[0]}, nil))
+	assert.Equal(t, http.StatusUnauthorized, send("DELETE", "/api/account/2fa", tokens.Token,
+		map[string]string{"password": "correct horse", "code": "000000"}, nil))
+	assert.Equal(t, http.StatusOK, send("DELETE", "/api/account/2fa", tokens.Token,
+		map[string]string{"password": "correct horse", "code": recovery.RecoveryCodes[0]}, nil))
+	assert.NotEmpty(t, login("alice").Token)
+	status, _ = verify(challenge.ChallengeToken, recovery.RecoveryCodes[1])
+	assert.Equal(t, http.StatusConflict, status)
+
+	// guessing codes runs out, even for the right one
+	bobToken, bobSecret, _ := enroll("bob")
+	bob := login("bob")
+	for range twoFactorAttempts {
+		status, _ = verify(bob.ChallengeToken, "000000")
+		assert.Equal(t, http.StatusUnauthorized, status)
+	}
+	status, _ = verify(bob.ChallengeToken, code(bobSecret, time.Now().Unix()/totpPeriod+1))
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, http.StatusTooManyRequests, send("DELETE", "/api/account/2fa", bobToken,
+		map[string]string{"password": "correct horse", "code": "000000"}, nil))
+}
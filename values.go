@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	errInvalidValue   = errors.New("invalid value")
+	errInvalidType    = errors.New("invalid variable type")
+	errInvalidPointer = errors.New("invalid path")
+	errPathNotFound   = errors.New("path not found")
+)
+
+// isStructured reports whether values of typ are JSON documents.
+func isStructured(typ string) bool {
+	return typ == "json" || typ == "list" || typ == "map"
+}
+
+// hasShape reports whether v, a decoded JSON document, fits typ: lists are
+// arrays and maps are objects.
+func hasShape(typ string, v any) bool {
+	switch typ {
+	case "list":
+		_, ok := v.([]any)
+		return ok
+	case "map":
+		_, ok := v.(map[string]any)
+		return ok
+	}
+	return true
+}
+
+// parseJSONValue decodes a single JSON document. Numbers are kept as
+// json.Number so that they're written back exactly as they came.
+func parseJSONValue(s string) (any, error) {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return v, nil
+}
+
+// marshalJSONValue encodes a structured value the way it's stored.
+func marshalJSONValue(v any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// decodeValue converts a stored value to its typed representation. Values
+// that don't parse as their type are returned as the raw string.
+func decodeValue(typ, val string) any {
+	switch typ {
+	case "int":
+		if i, err := strconv.Atoi(val); err == nil {
+			return i
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f
+		}
+	case "bool":
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	case "json", "list", "map":
+		if v, err := parseJSONValue(val); err == nil {
+			return v
+		}
+	case "datetime":
+		if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+	case "duration":
+		if d, err := time.ParseDuration(val); err == nil {
+			return d.String()
+		}
+	}
+	return val
+}
+
+// isWhole reports whether f is nil or has no fractional part.
+func isWhole(f *float64) bool {
+	return f == nil || *f == math.Trunc(*f)
+}
+
+// encodeValue checks that v matches typ and returns the string to store.
+// options are the allowed values of an enum.
+func encodeValue(typ string, options []string, v any) (string, error) {
+	if isStructured(typ) {
+		if !hasShape(typ, v) {
+			return "", errInvalidValue
+		}
+		return marshalJSONValue(v)
+	}
+
+	result := fmt.Sprintf("%v", v)
+
+	var err error
+	switch typ {
+	case "string":
+	case "int":
+		_, err = strconv.Atoi(result)
+	case "float":
+		if _, ok := v.(float64); !ok {
+			_, err = strconv.ParseFloat(result, 64)
+		}
+	case "bool":
+		if _, ok := v.(bool); !ok {
+			_, err = strconv.ParseBool(result)
+		}
+	case "datetime", "duration", "enum":
+		s, ok := v.(string)
+		if !ok {
+			return "", errInvalidValue
+		}
+		return normalizeValue(typ, options, s)
+	default:
+		return "", errInvalidType
+	}
+	if err != nil {
+		return "", errInvalidValue
+	}
+	return result, nil
+}
+
+// normalizeValue checks a value given as text, the way the dashboard sends
+// it, and returns the string to store. Structured values are compacted and
+// an empty one becomes the type's zero value, as does an empty duration or
+// enum. Datetimes are stored in UTC.
+func normalizeValue(typ string, options []string, text string) (string, error) {
+	if !slices.Contains(variableTypes, typ) {
+		return "", errInvalidType
+	}
+
+	switch typ {
+	case "json", "list", "map":
+		if strings.TrimSpace(text) == "" {
+			switch typ {
+			case "list":
+				return "[]", nil
+			case "map":
+				return "{}", nil
+			}
+			return "null", nil
+		}
+		v, err := parseJSONValue(text)
+		if err != nil || !hasShape(typ, v) {
+			return "", errInvalidValue
+		}
+		return marshalJSONValue(v)
+
+	case "datetime":
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return "", errInvalidValue
+		}
+		return t.UTC().Format(time.RFC3339Nano), nil
+
+	case "duration":
+		if text == "" {
+			return "0s", nil
+		}
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return "", errInvalidValue
+		}
+		return d.String(), nil
+
+	case "enum":
+		if text == "" && len(options) > 0 {
+			return options[0], nil
+		}
+		if !slices.Contains(options, text) {
+			return "", errInvalidValue
+		}
+	}
+	return text, nil
+}
+
+// convertValue converts a stored value of type from to type to for a type
+// change. Numbers only convert when nothing is lost, bools become 1 or 0 and
+// back, and text is parsed the way normalizeValue parses it. Values that
+// can't be converted return errInvalidValue.
+func convertValue(from, to string, options []string, stored string) (string, error) {
+	if !slices.Contains(variableTypes, to) {
+		return "", errInvalidType
+	}
+	if from == "bool" && (to == "int" || to == "float") {
+		if b, err := strconv.ParseBool(stored); err == nil {
+			if b {
+				return "1", nil
+			}
+			return "0", nil
+		}
+		return "", errInvalidValue
+	}
+
+	switch to {
+	case "string":
+		return stored, nil
+
+	case "int":
+		if i, err := strconv.ParseInt(stored, 10, 64); err == nil {
+			return strconv.FormatInt(i, 10), nil
+		}
+		if f, err := strconv.ParseFloat(stored, 64); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return strconv.FormatInt(int64(f), 10), nil
+		}
+		return "", errInvalidValue
+
+	case "float":
+		f, err := strconv.ParseFloat(stored, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return "", errInvalidValue
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+
+	case "bool":
+		b, err := strconv.ParseBool(stored)
+		if err != nil {
+			return "", errInvalidValue
+		}
+		return strconv.FormatBool(b), nil
+
+	case "json", "list", "map":
+		// text-like values become JSON strings
+		switch from {
+		case "datetime", "duration", "enum":
+			stored, _ = marshalJSONValue(stored)
+		}
+
+	case "datetime", "duration", "enum":
+		// a JSON string converts by its content
+		if isStructured(from) {
+			v, err := parseJSONValue(stored)
+			s, ok := v.(string)
+			if err != nil || !ok {
+				return "", errInvalidValue
+			}
+			stored = s
+		}
+		if stored == "" && to == "enum" {
+			return "", errInvalidValue
+		}
+	}
+	return normalizeValue(to, options, stored)
+}
+
+// zeroValue is the value of type typ that a forced type change falls back
+// to: 0, false, an empty string, list or map, null, 0s, the Unix epoch or
+// the first option.
+func zeroValue(typ string, options []string) (string, error) {
+	switch typ {
+	case "int", "float":
+		return "0", nil
+	case "bool":
+		return "false", nil
+	case "datetime":
+		return time.Unix(0, 0).UTC().Format(time.RFC3339Nano), nil
+	}
+	return normalizeValue(typ, options, "")
+}
+
+// checkOptions validates the allowed values given for a variable: enums
+// need at least one and no duplicates, other types take none.
+func checkOptions(typ string, options []string) error {
+	if typ != "enum" {
+		if len(options) > 0 {
+			return errors.New("options are only allowed for enum variables")
+		}
+		return nil
+	}
+	if len(options) == 0 {
+		return errors.New("an enum needs at least one option")
+	}
+	for i, o := range options {
+		if o == "" || slices.Contains(options[:i], o) {
+			return errors.New("enum options must be unique and non-empty")
+		}
+	}
+	return nil
+}
+
+// splitPointer parses a JSON pointer (RFC 6901) into its reference tokens.
+// The empty pointer refers to the whole document.
+func splitPointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, errInvalidPointer
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses a pointer token referring to an element of an array of
+// length n.
+func arrayIndex(token string, n int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= n || (len(token) > 1 && token[0] == '0') {
+		return 0, errPathNotFound
+	}
+	return i, nil
+}
+
+// pointerGet returns the value tokens refer to within doc.
+func pointerGet(doc any, tokens []string) (any, error) {
+	for _, t := range tokens {
+		switch node := doc.(type) {
+		case map[string]any:
+			v, ok := node[t]
+			if !ok {
+				return nil, errPathNotFound
+			}
+			doc = v
+		case []any:
+			i, err := arrayIndex(t, len(node))
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, errPathNotFound
+		}
+	}
+	return doc, nil
+}
+
+// pointerSet returns doc with the value tokens refer to replaced by v. The
+// last token may name a new key of an object, or be "-" to append to an
+// array; everything before it has to exist.
+func pointerSet(doc any, tokens []string, v any) (any, error) {
+	if len(tokens) == 0 {
+		return v, nil
+	}
+
+	t, rest := tokens[0], tokens[1:]
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[t]
+		if !ok && len(rest) > 0 {
+			return nil, errPathNotFound
+		}
+		child, err := pointerSet(child, rest, v)
+		if err != nil {
+			return nil, err
+		}
+		node[t] = child
+		return node, nil
+	case []any:
+		if t == "-" && len(rest) == 0 {
+			return append(node, v), nil
+		}
+		i, err := arrayIndex(t, len(node))
+		if err != nil {
+			return nil, err
+		}
+		if node[i], err = pointerSet(node[i], rest, v); err != nil {
+			return nil, err
+		}
+		return node, nil
+	default:
+		return nil, errPathNotFound
+	}
+}
+
+// pointerRemove returns doc without the value tokens refer to. The whole
+// document can't be removed.
+func pointerRemove(doc any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return nil, errInvalidPointer
+	}
+
+	t, rest := tokens[0], tokens[1:]
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[t]
+		if !ok {
+			return nil, errPathNotFound
+		}
+		if len(rest) == 0 {
+			delete(node, t)
+			return node, nil
+		}
+		child, err := pointerRemove(child, rest)
+		if err != nil {
+			return nil, err
+		}
+		node[t] = child
+		return node, nil
+	case []any:
+		i, err := arrayIndex(t, len(node))
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return slices.Delete(node, i, i+1), nil
+		}
+		if node[i], err = pointerRemove(node[i], rest); err != nil {
+			return nil, err
+		}
+		return node, nil
+	default:
+		return nil, errPathNotFound
+	}
+}
+
+// Constraints are guard rails stored with a variable and checked on every
+// write, on top of its type.
+type Constraints struct {
+	// Min and Max bound int and float values.
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// MaxLength (in characters) and Pattern, a regular expression that has
+	// to match somewhere in the value, apply to strings.
+	MaxLength *int   `json:"max_length,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+	// Required rejects empty strings and JSON null.
+	Required bool `json:"required,omitempty"`
+}
+
+func (c Constraints) isZero() bool {
+	return c == Constraints{}
+}
+
+// ValidationError describes one reason a value, or a constraint definition,
+// was rejected.
+type ValidationError struct {
+	Field      string `json:"field"`
+	Constraint string `json:"constraint"`
+	Message    string `json:"message"`
+}
+
+// ValidationErrors are all the reasons a value was rejected.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, v := range e {
+		msgs[i] = v.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// invalidValue is the validation error for a value that doesn't fit its
+// type, or for an enum, its options.
+func invalidValue(typ string, options []string) ValidationErrors {
+	if typ == "enum" {
+		return ValidationErrors{{"value", "options", "value must be one of " + strings.Join(options, ", ")}}
+	}
+	return ValidationErrors{{"value", "type", "value is not a valid " + typ}}
+}
+
+// check validates the constraints themselves for a variable of type typ.
+func (c Constraints) check(typ string) error {
+	var errs ValidationErrors
+	numeric := typ == "int" || typ == "float"
+	if (c.Min != nil || c.Max != nil) && !numeric {
+		errs = append(errs, ValidationError{"constraints", "min", "min and max only apply to int and float variables"})
+	}
+	if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+		errs = append(errs, ValidationError{"constraints.max", "max", "max must not be less than min"})
+	}
+	if (c.MaxLength != nil || c.Pattern != "") && typ != "string" {
+		errs = append(errs, ValidationError{"constraints", "max_length", "max_length and pattern only apply to string variables"})
+	}
+	if c.MaxLength != nil && *c.MaxLength < 0 {
+		errs = append(errs, ValidationError{"constraints.max_length", "max_length", "max_length must not be negative"})
+	}
+	if c.Pattern != "" {
+		if _, err := regexp.Compile(c.Pattern); err != nil {
+			errs = append(errs, ValidationError{"constraints.pattern", "pattern", "invalid pattern: " + err.Error()})
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// validate checks a stored value of type typ against the constraints.
+func (c Constraints) validate(typ, stored string) error {
+	var errs ValidationErrors
+	if c.Required && (stored == "" || (isStructured(typ) && stored == "null")) {
+		errs = append(errs, ValidationError{"value", "required", "value is required"})
+	}
+
+	if c.Min != nil || c.Max != nil {
+		if n, err := strconv.ParseFloat(stored, 64); err == nil {
+			if c.Min != nil && n < *c.Min {
+				errs = append(errs, ValidationError{"value", "min", fmt.Sprintf("value must be at least %v", *c.Min)})
+			}
+			if c.Max != nil && n > *c.Max {
+				errs = append(errs, ValidationError{"value", "max", fmt.Sprintf("value must be at most %v", *c.Max)})
+			}
+		}
+	}
+
+	if c.MaxLength != nil && utf8.RuneCountInString(stored) > *c.MaxLength {
+		errs = append(errs, ValidationError{"value", "max_length", fmt.Sprintf("value must be at most %d characters long", *c.MaxLength)})
+	}
+	if c.Pattern != "" {
+		if re, err := regexp.Compile(c.Pattern); err == nil && !re.MatchString(stored) {
+			errs = append(errs, ValidationError{"value", "pattern", "value must match " + c.Pattern})
+		}
+	}
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
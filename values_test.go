@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONPointer(t *testing.T) {
+	doc := func() any {
+		v, err := parseJSONValue(`{"a/b": {"~k": [1, 2]}, "list": [{"x": 1}]}`)
+		assert.NoError(t, err)
+		return v
+	}
+
+	tokens, err := splitPointer("/a~1b/~0k/1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/b", "~k", "1"}, tokens)
+	_, err = splitPointer("a")
+	assert.ErrorIs(t, err, errInvalidPointer)
+
+	v, err := pointerGet(doc(), tokens)
+	assert.NoError(t, err)
+	assert.Equal(t, json.Number("2"), v)
+
+	for _, p := range []string{"/list/01", "/list/1", "/list/-1", "/missing/x", "/list/0/x/y"} {
+		tokens, _ := splitPointer(p)
+		_, err := pointerGet(doc(), tokens)
+		assert.ErrorIs(t, err, errPathNotFound, p)
+	}
+
+	tokens, _ = splitPointer("/list/-")
+	v, err = pointerSet(doc(), tokens, "new")
+	assert.NoError(t, err)
+	s, _ := marshalJSONValue(v)
+	assert.Equal(t, `{"a/b":{"~k":[1,2]},"list":[{"x":1},"new"]}`, s)
+
+	tokens, _ = splitPointer("/nested/key")
+	_, err = pointerSet(doc(), tokens, 1)
+	assert.ErrorIs(t, err, errPathNotFound)
+
+	tokens, _ = splitPointer("/a~1b/~0k/0")
+	v, err = pointerRemove(doc(), tokens)
+	assert.NoError(t, err)
+	s, _ = marshalJSONValue(v)
+	assert.Equal(t, `{"a/b":{"~k":[2]},"list":[{"x":1}]}`, s)
+
+	_, err = pointerRemove(doc(), nil)
+	assert.ErrorIs(t, err, errInvalidPointer)
+}
+
+func TestNormalizeValue(t *testing.T) {
+	difficulty := []string{"easy", "normal", "hard"}
+
+	for _, c := range []struct{ typ, in, out string }{
+		{"list", "", "[]"},
+		{"map", " ", "{}"},
+		{"json", "", "null"},
+		{"json", `{ "b": 1.50, "a": "<x>" }`, `{"a":"<x>","b":1.50}`},
+		{"string", " as is ", " as is "},
+		{"datetime", "2026-03-01T12:00:00+02:00", "2026-03-01T10:00:00Z"},
+		{"datetime", "2026-03-01T10:00:00.250Z", "2026-03-01T10:00:00.25Z"},
+		{"duration", "90m", "1h30m0s"},
+		{"duration", "", "0s"},
+		{"enum", "hard", "hard"},
+		{"enum", "", "easy"},
+	} {
+		out, err := normalizeValue(c.typ, difficulty, c.in)
+		assert.NoError(t, err)
+		assert.Equal(t, c.out, out)
+	}
+
+	for _, c := range []struct{ typ, in string }{
+		{"list", `{}`},
+		{"map", `[]`},
+		{"json", `{} {}`},
+		{"json", `nope`},
+		{"datetime", "2026-03-01 10:00"},
+		{"datetime", ""},
+		{"duration", "5 minutes"},
+		{"enum", "impossible"},
+	} {
+		_, err := normalizeValue(c.typ, difficulty, c.in)
+		assert.ErrorIs(t, err, errInvalidValue, c.in)
+	}
+	_, err := normalizeValue("blob", nil, "")
+	assert.ErrorIs(t, err, errInvalidType)
+}
+
+func TestCheckOptions(t *testing.T) {
+	assert.NoError(t, checkOptions("enum", []string{"a", "b"}))
+	assert.NoError(t, checkOptions("string", nil))
+	assert.Error(t, checkOptions("enum", nil))
+	assert.Error(t, checkOptions("enum", []string{"a", "a"}))
+	assert.Error(t, checkOptions("enum", []string{""}))
+	assert.Error(t, checkOptions("int", []string{"a"}))
+}
+
+func TestConstraints(t *testing.T) {
+	one, five, three := 1.0, 5.0, 3
+	c := Constraints{Min: &one, Max: &five}
+	assert.NoError(t, c.check("int"))
+	assert.Error(t, c.check("string"))
+	assert.NoError(t, c.validate("float", "4.5"))
+	assert.Equal(t, ValidationErrors{{"value", "min", "value must be at least 1"}}, c.validate("int", "0"))
+
+	assert.Error(t, Constraints{Min: &five, Max: &one}.check("int"))
+	assert.Error(t, Constraints{Pattern: "("}.check("string"))
+
+	c = Constraints{MaxLength: &three, Pattern: "^a", Required: true}
+	assert.NoError(t, c.validate("string", "abc"))
+	assert.NoError(t, c.validate("string", "aöü"))
+	assert.Len(t, c.validate("string", "bcde"), 2)
+	assert.Len(t, c.validate("string", ""), 2)
+
+	assert.Error(t, Constraints{Required: true}.validate("json", "null"))
+	assert.True(t, Constraints{}.isZero())
+}
+
+func TestConvertValue(t *testing.T) {
+	difficulty := []string{"easy", "hard"}
+
+	for _, c := range []struct{ from, to, in, out string }{
+		{"string", "int", "42", "42"},
+		{"float", "int", "3", "3"},
+		{"float", "int", "1e3", "1000"},
+		{"int", "float", "2", "2"},
+		{"bool", "int", "true", "1"},
+		{"int", "bool", "0", "false"},
+		{"int", "string", "5", "5"},
+		{"map", "string", `{"a":1}`, `{"a":1}`},
+		{"string", "map", `{ "a": 1 }`, `{"a":1}`},
+		{"list", "json", `[1]`, `[1]`},
+		{"int", "json", "5", "5"},
+		{"duration", "json", "1m0s", `"1m0s"`},
+		{"json", "duration", `"90s"`, "1m30s"},
+		{"string", "enum", "hard", "hard"},
+		{"string", "datetime", "2026-01-01T01:00:00+01:00", "2026-01-01T00:00:00Z"},
+	} {
+		out, err := convertValue(c.from, c.to, difficulty, c.in)
+		assert.NoError(t, err, c)
+		assert.Equal(t, c.out, out, c)
+	}
+
+	for _, c := range []struct{ from, to, in string }{
+		{"float", "int", "2.5"},
+		{"string", "int", "hi"},
+		{"float", "bool", "3"},
+		{"string", "map", "[1]"},
+		{"string", "json", "hello"},
+		{"json", "datetime", "5"},
+		{"string", "enum", ""},
+		{"string", "enum", "medium"},
+		{"int", "datetime", "0"},
+	} {
+		_, err := convertValue(c.from, c.to, difficulty, c.in)
+		assert.ErrorIs(t, err, errInvalidValue, c)
+	}
+	_, err := convertValue("string", "blob", nil, "")
+	assert.ErrorIs(t, err, errInvalidType)
+
+	for typ, want := range map[string]string{"int": "0", "bool": "false", "list": "[]", "datetime": "1970-01-01T00:00:00Z", "enum": "easy"} {
+		v, err := zeroValue(typ, difficulty)
+		assert.NoError(t, err)
+		assert.Equal(t, want, v)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// webhookBatchSize is how many due deliveries are loaded at once.
+const webhookBatchSize = 20
+
+// errPrivateAddress is returned for webhooks aimed at this machine or the
+// network it's in, rather than somewhere on the internet.
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// reservedPrefixes are ranges not caught by the netip.Addr methods that
+// publicAddress uses: "this network" and carrier-grade NAT.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// publicAddress reports whether ip is neither loopback, link-local, private
+// nor otherwise reserved.
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, p := range reservedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookHost resolves host and returns errPrivateAddress if any of its
+// addresses isn't public.
+func checkWebhookHost(ctx context.Context, host string) error {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !publicAddress(ip) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+// webhookPayload is the JSON body posted to a webhook.
+type webhookPayload struct {
+	VariableEvent
+	Timestamp int64 `json:"timestamp"`
+}
+
+// WebhookDispatcher posts the deliveries enqueueWebhooks stores, retrying
+// failures with exponential backoff. Deliveries live in the database, so
+// pending ones survive restarts.
+type WebhookDispatcher struct {
+	store  Store
+	client *http.Client
+
+	// RetryBase is the delay before the first retry; it doubles with every
+	// further attempt.
+	RetryBase time.Duration
+	// MaxAttempts is how often a delivery is tried before it's marked failed.
+	MaxAttempts int
+	// PollInterval is how often due retries are looked for.
+	PollInterval time.Duration
+	// AllowPrivate lets deliveries go to loopback, link-local and private
+	// addresses, which are refused otherwise.
+	AllowPrivate bool
+
+	wake chan struct{}
+}
+
+func NewWebhookDispatcher(store Store) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		store:        store,
+		RetryBase:    10 * time.Second,
+		MaxAttempts:  8,
+		PollInterval: 5 * time.Second,
+		wake:         make(chan struct{}, 1),
+	}
+
+	// The address is checked once it's resolved, as the one dialed, so a
+	// host that resolves elsewhere after the webhook was created, or a
+	// redirect, can't reach the private network either. A proxy would dial
+	// on our behalf, so none is used.
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if d.AllowPrivate {
+				return nil
+			}
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddress(addr.Addr()) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.client = &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	return d
+}
+
+// newWebhookSecret returns a random secret for signing deliveries.
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// signWebhook returns the X-Reduser-Signature header value for body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// enqueueWebhooks stores a delivery of every event for each webhook it
+// matches. It belongs in the transaction of the change the events describe,
+// so that the deliveries are committed or rolled back together with it.
+func enqueueWebhooks(tx Store, events ...VariableEvent) error {
+	for _, ev := range events {
+		hooks, err := tx.WebhooksForEvent(ev.ProjectID, ev.TableID)
+		if err != nil {
+			return err
+		}
+		if len(hooks) == 0 {
+			continue
+		}
+
+		now := time.Now().Unix()
+		payload, _ := json.Marshal(webhookPayload{ev, now})
+		for _, h := range hooks {
+			if err := tx.EnqueueWebhookDelivery(h.ID, ev.Kind, string(payload), now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Notify wakes the dispatcher to post the deliveries a committed change
+// enqueued. It is meant to be registered with hub.Listen.
+func (d *WebhookDispatcher) Notify(VariableEvent) {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers due deliveries until ctx is done.
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	poll := time.NewTicker(d.PollInterval)
+	defer poll.Stop()
+	for {
+		d.deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := d.store.DueWebhookDeliveries(time.Now().Unix(), webhookBatchSize)
+		if err != nil {
+			log.Printf("webhooks: %v", err)
+			return
+		}
+		for _, delivery := range deliveries {
+			d.deliver(ctx, delivery)
+		}
+		if len(deliveries) < webhookBatchSize {
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery WebhookDelivery) {
+	delivery.Attempts++
+	delivery.ResponseCode = 0
+	delivery.LastError = ""
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "reduser-webhooks")
+		req.Header.Set("X-Reduser-Event", delivery.Event)
+		req.Header.Set("X-Reduser-Delivery", strconv.Itoa(delivery.ID))
+		req.Header.Set("X-Reduser-Signature", signWebhook(delivery.Secret, body))
+
+		var resp *http.Response
+		resp, err = d.client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			delivery.ResponseCode = resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+			}
+		}
+	}
+
+	if err != nil && ctx.Err() != nil {
+		// cut short by shutdown rather than failed; it stays due as it was
+		// and goes out again once we're back
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		delivery.Status = "delivered"
+		delivery.NextAttemptAt = now.Unix()
+	case delivery.Attempts >= d.MaxAttempts:
+		delivery.Status = "failed"
+		delivery.LastError = err.Error()
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = now.Add(d.RetryBase << (delivery.Attempts - 1)).Unix()
+	}
+
+	if err := d.store.UpdateWebhookDelivery(delivery); err != nil {
+		log.Printf("webhooks: delivery %d: %v", delivery.ID, err)
+	}
+}
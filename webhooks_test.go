@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	db := InitDB("file:webhooks?mode=memory&cache=shared")
+	defer db.Close()
+	store := NewSQLStore(db)
+
+	assert.NoError(t, store.CreateUser("hookuser", "x"))
+	userID, _, _ := store.GetUserByUsername("hookuser")
+	projectID, _ := store.CreateProject(userID, "Hooks", "hooks-token")
+	tableID, _ := store.CreateTable(projectID, "Config", userID)
+	assert.NoError(t, store.CreateVariable(tableID, "cdn_version", "1", "int", nil, Constraints{}, userID))
+
+	// The receiver fails the first attempt so the delivery has to be retried
+	var calls atomic.Int32
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	secret := "s3cret"
+	webhookID, err := store.CreateWebhook(projectID, tableID, receiver.URL, secret, userID)
+	assert.NoError(t, err)
+
+	dispatcher := NewWebhookDispatcher(store)
+	dispatcher.AllowPrivate = true
+	dispatcher.RetryBase = time.Millisecond
+	dispatcher.PollInterval = 10 * time.Millisecond
+	defer hub.Listen(dispatcher.Notify)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx)
+
+	// Deliveries are rolled back with the change they belong to
+	failed := errors.New("failed")
+	assert.ErrorIs(t, store.Tx(func(tx Store) error {
+		assert.NoError(t, enqueueWebhooks(tx, VariableEvent{Kind: "set", ProjectID: projectID, TableID: tableID, Name: "cdn_version"}))
+		return failed
+	}), failed)
+	deliveries, _ := store.ListWebhookDeliveries(webhookID, userID, 10)
+	assert.Empty(t, deliveries)
+
+	scope := accessScope{ProjectID: projectID, UserID: userID}
+	_, err = runAccessSingle(store, scope, accessOp{Action: "set", Table: tableRef{ID: tableID}, VarName: "cdn_version", Value: 2})
+	assert.NoError(t, err)
+
+	var req *http.Request
+	var body []byte
+	select {
+	case req = <-received:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	assert.Equal(t, "set", req.Header.Get("X-Reduser-Event"))
+	assert.Equal(t, signWebhook(secret, body), req.Header.Get("X-Reduser-Signature"))
+
+	var payload webhookPayload
+	assert.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, "cdn_version", payload.Name)
+	assert.Equal(t, tableID, payload.TableID)
+	assert.Equal(t, float64(2), payload.Value)
+	assert.Equal(t, float64(1), payload.OldValue)
+
+	// The delivery log records both attempts
+	assert.Eventually(t, func() bool {
+		deliveries, err := store.ListWebhookDeliveries(webhookID, userID, 10)
+		return err == nil && len(deliveries) == 1 &&
+			deliveries[0].Status == "delivered" && deliveries[0].Attempts == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Events of other tables don't match a table webhook
+	otherTable, _ := store.CreateTable(projectID, "Other", userID)
+	assert.NoError(t, enqueueWebhooks(store, VariableEvent{Kind: "set", ProjectID: projectID, TableID: otherTable, Name: "x"}))
+	deliveries, _ = store.ListWebhookDeliveries(webhookID, userID, 10)
+	assert.Len(t, deliveries, 1)
+}
+
+func TestWebhookPrivateAddress(t *testing.T) {
+	db := InitDB("file:webhooks_private?mode=memory&cache=shared")
+	defer db.Close()
+	store := NewSQLStore(db)
+
+	assert.NoError(t, store.CreateUser("hookuser", "x"))
+	userID, _, _ := store.GetUserByUsername("hookuser")
+	projectID, _ := store.CreateProject(userID, "Hooks", "hooks-token")
+
+	// The receiver is on loopback, which the dispatcher refuses to dial
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer receiver.Close()
+	webhookID, err := store.CreateWebhook(projectID, 0, receiver.URL, "s3cret", userID)
+	assert.NoError(t, err)
+
+	dispatcher := NewWebhookDispatcher(store)
+	dispatcher.MaxAttempts = 1
+	assert.NoError(t, enqueueWebhooks(store, VariableEvent{Kind: "set", ProjectID: projectID, TableID: 1, Name: "x"}))
+
+	// An attempt cut short by shutdown doesn't count
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	due, _ := store.DueWebhookDeliveries(time.Now().Unix(), webhookBatchSize)
+	if assert.Len(t, due, 1) {
+		dispatcher.deliver(cancelled, due[0])
+	}
+	deliveries, _ := store.ListWebhookDeliveries(webhookID, userID, 10)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, "pending", deliveries[0].Status)
+		assert.Zero(t, deliveries[0].Attempts)
+	}
+
+	dispatcher.deliverDue(context.Background())
+
+	deliveries, _ = store.ListWebhookDeliveries(webhookID, userID, 10)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, "failed", deliveries[0].Status)
+		assert.Contains(t, deliveries[0].LastError, errPrivateAddress.Error())
+	}
+	assert.Zero(t, calls.Load())
+}
+
+func TestPublicAddress(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"93.184.215.14":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"0.0.0.0":          false,
+		"100.64.0.1":       false,
+		"::ffff:127.0.0.1": false,
+	} {
+		assert.Equal(t, public, publicAddress(netip.MustParseAddr(addr)), addr)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsWriteWait    = 10 * time.Second
+	wsMaxMessage   = 1 << 20
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// the project token is sent explicitly rather than as a cookie, so
+	// cross-origin clients are fine
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// sockets are the open WebSocket connections. http.Server.Shutdown doesn't
+// wait for them since they are hijacked, so CloseSockets does.
+var sockets = struct {
+	sync.Mutex
+	conns  map[*wsConn]struct{}
+	active sync.WaitGroup
+	closed bool
+}{conns: map[*wsConn]struct{}{}}
+
+// CloseSockets tells every WebSocket client that the server is going away,
+// closes their connections and waits until the requests they had sent are
+// done or ctx is.
+func CloseSockets(ctx context.Context) {
+	sockets.Lock()
+	sockets.closed = true
+	for c := range sockets.conns {
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(wsWriteWait))
+		c.conn.Close()
+	}
+	sockets.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sockets.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// wsRequest is a message sent by the client. Besides the access actions it
+// understands subscribe, unsubscribe and ping. ID is echoed in the reply.
+type wsRequest struct {
+	accessOp
+	ID     any        `json:"id"`
+	Ops    []accessOp `json:"ops"`
+	Atomic bool       `json:"atomic"`
+}
+
+// wsResponse is either the reply to a request, with the status code and body
+// /api/access would have answered with, a subscribed event, or the notice
+// that a subscription was dropped.
+type wsResponse struct {
+	ID           any             `json:"id,omitempty"`
+	Code         int             `json:"code,omitempty"`
+	Body         any             `json:"body,omitempty"`
+	Event        *VariableEvent  `json:"event,omitempty"`
+	Unsubscribed *wsUnsubscribed `json:"unsubscribed,omitempty"`
+}
+
+// wsUnsubscribed tells the client a subscription ended without it asking,
+// because it fell too far behind or the server is shutting down. TableID is
+// 0 for the whole project.
+type wsUnsubscribed struct {
+	TableID int    `json:"table_id"`
+	Error   string `json:"error"`
+}
+
+// ProjectAccessSocket serves the access API over a WebSocket. The project
+// token, from the token query parameter, is checked when connecting, with
+// every message and every tokenRecheck; once it stops working the socket is
+// closed with a policy violation.
+func ProjectAccessSocket(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		scope, err := authenticateToken(store, token)
+		if err == ErrNotFound {
+			writeJSON(w, http.StatusUnauthorized, errorResp{"invalid project token"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResp{err.Error()})
+			return
+		}
+
+		sockets.Lock()
+		if sockets.closed {
+			sockets.Unlock()
+			writeJSON(w, http.StatusServiceUnavailable, errorResp{"server shutting down"})
+			return
+		}
+		sockets.active.Add(1)
+		sockets.Unlock()
+		defer sockets.active.Done()
+
+		header := http.Header{}
+		scope.setDeprecation(header)
+		conn, err := wsUpgrader.Upgrade(w, r, header)
+		if err != nil {
+			// the upgrader has already replied
+			return
+		}
+
+		c := &wsConn{
+			conn:  conn,
+			store: store,
+			token: token,
+			scope: scope,
+			out:   make(chan wsResponse, subscriberBuffer),
+			done:  make(chan struct{}),
+			subs:  map[int]*Subscription{},
+		}
+		c.serve()
+	}
+}
+
+type wsConn struct {
+	conn  *websocket.Conn
+	store Store
+	token string
+	scope accessScope
+	out   chan wsResponse
+	done  chan struct{}
+
+	mu   sync.Mutex
+	subs map[int]*Subscription // by table id, 0 for the whole project
+}
+
+func (c *wsConn) serve() {
+	defer c.conn.Close()
+	sockets.Lock()
+	if sockets.closed {
+		sockets.Unlock()
+		return
+	}
+	sockets.conns[c] = struct{}{}
+	sockets.Unlock()
+	defer func() {
+		sockets.Lock()
+		delete(sockets.conns, c)
+		sockets.Unlock()
+	}()
+	// the scope is copied here, as the read loop refreshes its expiry
+	go c.writeLoop(watchToken(c.store, c.token, c.scope, c.done))
+
+	c.readLoop()
+
+	close(c.done)
+	c.mu.Lock()
+	for _, sub := range c.subs {
+		hub.Unsubscribe(sub)
+	}
+	c.mu.Unlock()
+}
+
+func (c *wsConn) send(msg wsResponse) {
+	select {
+	case c.out <- msg:
+	case <-c.done:
+	}
+}
+
+// writeLoop sends what the socket has to say until it's done or lost
+// closes.
+func (c *wsConn) writeLoop(lost <-chan struct{}) {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-lost:
+			c.closeRevoked()
+			return
+		case msg := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsConn) readLoop() {
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		if !c.scope.stillValid(c.store, c.token) {
+			c.closeRevoked()
+			return
+		}
+
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			c.send(wsResponse{Code: http.StatusBadRequest, Body: errorResp{err.Error()}})
+			continue
+		}
+		code, body := c.handle(req)
+		c.send(wsResponse{ID: req.ID, Code: code, Body: body})
+	}
+}
+
+// closeRevoked tells the client its token stopped working and closes the
+// connection.
+func (c *wsConn) closeRevoked() {
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid project token"),
+		time.Now().Add(wsWriteWait))
+	c.conn.Close()
+}
+
+func (c *wsConn) handle(req wsRequest) (int, any) {
+	// ops without an action are a batch, as on /api/access
+	if req.Action == "batch" || (req.Action == "" && len(req.Ops) > 0) {
+		return runAccessBatch(c.store, c.scope, req.Table, req.Ops, req.Atomic)
+	}
+
+	switch req.Action {
+	case "ping":
+		return http.StatusOK, map[string]string{"status": "pong"}
+
+	case "subscribe", "unsubscribe":
+		tableID := 0
+		if !req.Table.isZero() {
+			var err error
+			if tableID, err = c.scope.resolveTable(c.store, req.Table); err != nil {
+				return accessErrorBody(err)
+			}
+		}
+		if req.Action == "subscribe" {
+			if err := c.subscribe(tableID); err != nil {
+				return http.StatusServiceUnavailable, errorResp{err.Error()}
+			}
+		} else {
+			c.unsubscribe(tableID)
+		}
+		return http.StatusOK, map[string]string{"status": "ok"}
+
+	default:
+		result, err := runAccessSingle(c.store, c.scope, req.accessOp)
+		if err != nil {
+			return accessErrorBody(err)
+		}
+		return http.StatusOK, result
+	}
+}
+
+// subscribe starts forwarding the events of tableID, unless the hub refuses
+// because the server is shutting down.
+func (c *wsConn) subscribe(tableID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subs[tableID]; ok {
+		return nil
+	}
+
+	scope := c.scope
+	sub := hub.Subscribe(scope.ProjectID, tableID)
+	if sub.Err != nil {
+		return sub.Err
+	}
+	c.subs[tableID] = sub
+	go func() {
+		for ev := range sub.C {
+			if scope.allows(ev.TableID) {
+				c.send(wsResponse{Event: &ev})
+			}
+		}
+
+		// the hub dropped us or the client unsubscribed; only the first
+		// needs telling, and only a subscription that fell behind can be
+		// resumed
+		c.mu.Lock()
+		dropped := c.subs[tableID] == sub && sub.Err != nil
+		if dropped {
+			delete(c.subs, tableID)
+		}
+		c.mu.Unlock()
+		if dropped {
+			msg := sub.Err.Error()
+			if sub.Err == errSubscriberBehind {
+				msg += "; subscribe again to resume"
+			}
+			c.send(wsResponse{Unsubscribed: &wsUnsubscribed{TableID: tableID, Error: msg}})
+		}
+	}()
+	return nil
+}
+
+func (c *wsConn) unsubscribe(tableID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sub, ok := c.subs[tableID]; ok {
+		delete(c.subs, tableID)
+		hub.Unsubscribe(sub)
+	}
+}